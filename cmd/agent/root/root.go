@@ -44,7 +44,7 @@ var RootCmd = &cobra.Command{
 		errorChan := make(chan error)
 		c := collector.NewCollector(time.Duration(pollInterval)*time.Second, errorChan)
 		u := uploader.NewUploader(addr, time.Duration(reportInterval)*time.Second,
-			c.GetGaugeMetrics, c.GetCounterMetrics, errorChan)
+			c.GetGaugeMetrics, c.GetCounterMetrics, c.TakeHistogramMetrics, c.TakeSketchMetrics, errorChan)
 
 		go c.Run()
 		u.Run()
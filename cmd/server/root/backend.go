@@ -0,0 +1,234 @@
+package root
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+
+	"github.com/ElizavetaFirst/go-metrics-alerts/internal/env"
+	"github.com/ElizavetaFirst/go-metrics-alerts/internal/server/saver"
+	"github.com/ElizavetaFirst/go-metrics-alerts/internal/server/storage"
+)
+
+// storageConfig is the part of the flags that chooses the storage.
+type storageConfig struct {
+	walDir              string
+	databaseDSN         string
+	postgres            storage.PostgresOptions
+	cacheMaxAge         time.Duration
+	fileStoragePath     string
+	storeInterval       int
+	snapshotGenerations int
+	restore             bool
+	// strictRestore fails the open when the snapshot can't be loaded,
+	// instead of starting empty.
+	strictRestore bool
+	// degraded starts on memory when the database is unreachable, see
+	// storage.Fallback.
+	degraded           bool
+	degradedBufferSize int
+}
+
+func getStorageConfig(cmd *cobra.Command) (storageConfig, error) {
+	var cfg storageConfig
+	var err error
+	if cfg.storeInterval, err = cmd.Flags().GetInt("storeInterval"); err != nil {
+		return cfg, fmt.Errorf("can't get storeInterval flag %w", err)
+	}
+	if cfg.fileStoragePath, err = cmd.Flags().GetString("fileStoragePath"); err != nil {
+		return cfg, fmt.Errorf("can't get fileStoragePath flag %w", err)
+	}
+	if cfg.snapshotGenerations, err = cmd.Flags().GetInt("snapshotGenerations"); err != nil {
+		return cfg, fmt.Errorf("can't get snapshotGenerations flag %w", err)
+	}
+	if cfg.restore, err = cmd.Flags().GetBool("restore"); err != nil {
+		return cfg, fmt.Errorf("can't get restore flag %w", err)
+	}
+	if cfg.databaseDSN, err = cmd.Flags().GetString("databaseDSN"); err != nil {
+		return cfg, fmt.Errorf("can't get databaseDSN %w", err)
+	}
+	if cfg.postgres.AutoMigrate, err = cmd.Flags().GetBool("autoMigrate"); err != nil {
+		return cfg, fmt.Errorf("can't get autoMigrate flag %w", err)
+	}
+	maxConns, err := cmd.Flags().GetInt32("dbMaxConns")
+	if err != nil {
+		return cfg, fmt.Errorf("can't get dbMaxConns flag %w", err)
+	}
+	minConns, err := cmd.Flags().GetInt32("dbMinConns")
+	if err != nil {
+		return cfg, fmt.Errorf("can't get dbMinConns flag %w", err)
+	}
+	cfg.postgres.MaxConns, cfg.postgres.MinConns = maxConns, minConns
+	for _, d := range []struct {
+		flag  string
+		value *time.Duration
+	}{
+		{"dbMaxConnLifetime", &cfg.postgres.MaxConnLifetime},
+		{"dbHealthCheckPeriod", &cfg.postgres.HealthCheckPeriod},
+		{"dbStatementTimeout", &cfg.postgres.StatementTimeout},
+	} {
+		s, err := cmd.Flags().GetString(d.flag)
+		if err != nil {
+			return cfg, fmt.Errorf("can't get %s flag %w", d.flag, err)
+		}
+		if *d.value, err = env.ParseDuration(s); err != nil {
+			return cfg, fmt.Errorf("invalid %s flag %w", d.flag, err)
+		}
+	}
+	cacheMaxAge, err := cmd.Flags().GetString("cacheMaxAge")
+	if err != nil {
+		return cfg, fmt.Errorf("can't get cacheMaxAge flag %w", err)
+	}
+	if cfg.cacheMaxAge, err = env.ParseDuration(cacheMaxAge); err != nil {
+		return cfg, fmt.Errorf("invalid cacheMaxAge flag %w", err)
+	}
+	if cfg.degraded, err = cmd.Flags().GetBool("degradedMode"); err != nil {
+		return cfg, fmt.Errorf("can't get degradedMode flag %w", err)
+	}
+	if cfg.degradedBufferSize, err = cmd.Flags().GetInt("degradedBufferSize"); err != nil {
+		return cfg, fmt.Errorf("can't get degradedBufferSize flag %w", err)
+	}
+	if cfg.walDir, err = cmd.Flags().GetString("walDir"); err != nil {
+		return cfg, fmt.Errorf("can't get walDir flag %w", err)
+	}
+	return cfg, nil
+}
+
+// backend is the configured storage together with what keeps it on disk:
+// the WAL storage itself or the saver of the in-memory one.
+type backend struct {
+	storage storage.Storage
+	// mu guards db and cache, the fallback sets them once it switches to
+	// the database.
+	mu sync.Mutex
+	// db is set for Postgres, it keeps the history as well when it is
+	// connected on start.
+	db *storage.DBStorage
+	// cache is set for Postgres with a non-zero cacheMaxAge.
+	cache *storage.Cache
+	// fallback is set for Postgres in the degraded mode, it has to Run to
+	// reconnect.
+	fallback *storage.Fallback
+	wal      *storage.WALStorage
+	sv       *saver.Saver
+}
+
+// openBackend picks the WAL directory first, then the database, and keeps
+// the metrics in memory with snapshots to the file otherwise.
+func openBackend(ctx context.Context, cfg storageConfig, log *zap.Logger) (*backend, error) {
+	switch {
+	case cfg.walDir != "":
+		walStorage, err := storage.NewWALStorage(cfg.walDir, log)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create the WAL storage %w", err)
+		}
+		return &backend{storage: walStorage, wal: walStorage}, nil
+	case cfg.databaseDSN != "":
+		b := &backend{}
+		connect := func(ctx context.Context) (storage.Storage, error) {
+			dbStorage, err := storage.NewPostgresStorage(ctx, cfg.databaseDSN, &cfg.postgres, log)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create the postgres storage %w", err)
+			}
+			c := &dbConnection{Storage: storage.WithRetry(dbStorage, log), db: dbStorage}
+			if cfg.cacheMaxAge > 0 {
+				c.cache = storage.WithCache(c.Storage, cfg.cacheMaxAge)
+				c.Storage = c.cache
+			}
+			return c, nil
+		}
+		if cfg.degraded {
+			b.fallback = storage.NewFallback(ctx, connect, b.use, cfg.degradedBufferSize, log)
+			b.storage = b.fallback
+			return b, nil
+		}
+		var err error
+		if b.storage, err = connect(ctx); err != nil {
+			return nil, err
+		}
+		b.use(b.storage)
+		return b, nil
+	default:
+		s := storage.NewMemStorage(log)
+		sv := saver.NewSaver(cfg.storeInterval, cfg.fileStoragePath, cfg.snapshotGenerations, cfg.restore, s, log)
+		restore := sv.Restore
+		if cfg.strictRestore {
+			restore = sv.RestoreStrict
+		}
+		if err := restore(ctx); err != nil {
+			return nil, fmt.Errorf("error while saver Restore %w", err)
+		}
+		return &backend{storage: sv.Storage(), sv: sv}, nil
+	}
+}
+
+// dbConnection is the storage connect opens, with the parts of it the
+// backend reports on.
+type dbConnection struct {
+	storage.Storage
+	db    *storage.DBStorage
+	cache *storage.Cache
+}
+
+// use records the database storage s is served from, s comes from connect.
+func (b *backend) use(s storage.Storage) {
+	c := s.(*dbConnection)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.db, b.cache = c.db, c.cache
+}
+
+// flush saves the in-memory metrics to the file.
+func (b *backend) flush(ctx context.Context) error {
+	if b.sv == nil {
+		return nil
+	}
+	return b.sv.Flush(ctx)
+}
+
+func (b *backend) close() error {
+	if err := b.storage.Close(); err != nil {
+		return fmt.Errorf("failed to close the storage %w", err)
+	}
+	return nil
+}
+
+// connected returns the database storage and its cache, nil until the
+// fallback switches to the database.
+func (b *backend) connected() (*storage.DBStorage, *storage.Cache) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.db, b.cache
+}
+
+// diagnostics returns the state of the storage served by the diagnostics
+// endpoint.
+func (b *backend) diagnostics(cfg storageConfig) map[string]func() any {
+	d := make(map[string]func() any)
+	db, cache := b.connected()
+	if b.fallback != nil {
+		d["fallback"] = func() any { return b.fallback.Status() }
+	} else if db == nil {
+		return d
+	}
+	// The fallback may connect later, they are null until then.
+	d["pool"] = func() any {
+		if db, _ := b.connected(); db != nil {
+			return db.PoolStats()
+		}
+		return nil
+	}
+	if cache != nil || b.fallback != nil && cfg.cacheMaxAge > 0 {
+		d["cache"] = func() any {
+			if _, cache := b.connected(); cache != nil {
+				return cache.Stats()
+			}
+			return nil
+		}
+	}
+	return d
+}
@@ -0,0 +1,110 @@
+package root
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+
+	"github.com/ElizavetaFirst/go-metrics-alerts/internal/server/saver"
+	"github.com/ElizavetaFirst/go-metrics-alerts/internal/server/storage"
+)
+
+var backupCmd = &cobra.Command{
+	Use:   "backup",
+	Short: "Save all metrics of the configured storage to a file",
+	Long: "Save all metrics of the configured storage to a snapshot file, " +
+		"compressed if its name ends in .gz or .zst. Any storage can be restored from it.",
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		out, err := cmd.Flags().GetString("out")
+		if err != nil {
+			return fmt.Errorf("can't get out flag %w", err)
+		}
+		return withBackend(cmd, false, func(ctx context.Context, s storage.Storage) error {
+			metrics, err := s.GetAll(ctx)
+			if err != nil {
+				return fmt.Errorf("can't GetAll metrics %w", err)
+			}
+			if err := saver.WriteSnapshot(out, metrics, time.Now()); err != nil {
+				return fmt.Errorf("can't write the backup %w", err)
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "saved %d metrics to %s\n", len(metrics), out)
+			return nil
+		})
+	},
+}
+
+var restoreCmd = &cobra.Command{
+	Use:   "restore",
+	Short: "Load the metrics from a backup into the configured storage",
+	Long: "Load the metrics from a backup into the configured storage. The series in the " +
+		"backup get their saved values, counters included; the other series are kept.",
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		in, err := cmd.Flags().GetString("in")
+		if err != nil {
+			return fmt.Errorf("can't get in flag %w", err)
+		}
+		metrics, err := saver.ReadSnapshot(in)
+		if err != nil {
+			return fmt.Errorf("can't read the backup %w", err)
+		}
+		return withBackend(cmd, true, func(ctx context.Context, s storage.Storage) error {
+			if len(metrics) == 0 {
+				return nil
+			}
+			err := s.SetAll(ctx, &storage.SetAllOptions{Metrics: metrics, Replace: true})
+			if err != nil {
+				return fmt.Errorf("can't set all metrics %w", err)
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "restored %d metrics from %s\n", len(metrics), in)
+			return nil
+		})
+	},
+}
+
+func init() {
+	backupCmd.Flags().String("out", "", "the file to save the metrics to")
+	_ = backupCmd.MarkFlagRequired("out")
+	restoreCmd.Flags().String("in", "", "the file to load the metrics from")
+	_ = restoreCmd.MarkFlagRequired("in")
+	RootCmd.AddCommand(backupCmd, restoreCmd)
+}
+
+// withBackend opens the storage configured by the flags for fn and closes
+// it afterwards. The in-memory storage is always loaded from its file, so
+// that a backup has its metrics and a restore keeps the others; it is only
+// saved back when fn writes. A file that can't be loaded fails the command,
+// and the degraded mode is off: a command must not report success on
+// metrics it never reached.
+func withBackend(cmd *cobra.Command, writes bool, fn func(ctx context.Context, s storage.Storage) error) error {
+	cfg, err := getStorageConfig(cmd)
+	if err != nil {
+		return err
+	}
+	cfg.restore, cfg.strictRestore = true, true
+	cfg.degraded = false
+
+	log, err := zap.NewProduction()
+	if err != nil {
+		return fmt.Errorf("zap.NewProduction() return error %w", err)
+	}
+	defer func() {
+		_ = log.Sync()
+	}()
+
+	ctx := cmd.Context()
+	b, err := openBackend(ctx, cfg, log)
+	if err != nil {
+		return err
+	}
+	err = fn(ctx, b.storage)
+	if err == nil && writes {
+		err = b.flush(ctx)
+	}
+	return errors.Join(err, b.close())
+}
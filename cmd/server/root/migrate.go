@@ -0,0 +1,165 @@
+package root
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/spf13/cobra"
+
+	"github.com/ElizavetaFirst/go-metrics-alerts/internal/server/storage"
+)
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Manage the DB schema migrations",
+	Long: "Manage the DB schema migrations embedded in the server. Together with " +
+		"--autoMigrate=false it lets the migrations run separately from the server start.",
+}
+
+var migrateUpCmd = &cobra.Command{
+	Use:   "up",
+	Short: "Apply all pending migrations",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withMigrator(cmd, (*storage.Migrator).PlanUp, (*storage.Migrator).Up)
+	},
+}
+
+var migrateDownCmd = &cobra.Command{
+	Use:   "down [N]",
+	Short: "Roll back the latest N migrations, one by default",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		steps := 1
+		if len(args) > 0 {
+			var err error
+			if steps, err = strconv.Atoi(args[0]); err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of migrations %q", args[0])
+			}
+		}
+		return withMigrator(cmd,
+			func(mg *storage.Migrator) ([]storage.MigrationStep, error) { return mg.PlanDown(steps) },
+			func(mg *storage.Migrator) error { return mg.Down(steps) })
+	},
+}
+
+var migrateGotoCmd = &cobra.Command{
+	Use:   "goto N",
+	Short: "Migrate up or down to version N",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		version, err := strconv.ParseUint(args[0], 10, 0)
+		if err != nil {
+			return fmt.Errorf("invalid version %q", args[0])
+		}
+		return withMigrator(cmd,
+			func(mg *storage.Migrator) ([]storage.MigrationStep, error) { return mg.PlanGoto(uint(version)) },
+			func(mg *storage.Migrator) error { return mg.Goto(uint(version)) })
+	},
+}
+
+var migrateVersionCmd = &cobra.Command{
+	Use:   "version",
+	Short: "Print the applied migration version",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withMigrator(cmd, nil, func(*storage.Migrator) error { return nil })
+	},
+}
+
+var migrateForceCmd = &cobra.Command{
+	Use:   "force N|none",
+	Short: "Set the version to N without running migrations, none for no version",
+	Long: "Set the version to N without running migrations, none for no version. " +
+		"It clears the dirty flag left by a failed migration once the schema is fixed by hand. " +
+		"-1 means none as well but is taken for a flag unless it follows --, as in force -- -1.",
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		version, err := parseForceVersion(args[0])
+		if err != nil {
+			return err
+		}
+		return withMigrator(cmd, nil, func(mg *storage.Migrator) error { return mg.Force(version) })
+	},
+}
+
+// parseForceVersion returns -1, the version of no migrations, for none.
+func parseForceVersion(arg string) (int, error) {
+	if arg == "none" {
+		return -1, nil
+	}
+	version, err := strconv.Atoi(arg)
+	if err != nil || version < -1 {
+		return 0, fmt.Errorf("invalid version %q", arg)
+	}
+	return version, nil
+}
+
+func init() {
+	migrateCmd.PersistentFlags().Bool("dry-run", false, "only list the migrations that would run")
+	migrateCmd.AddCommand(migrateUpCmd, migrateDownCmd, migrateGotoCmd, migrateVersionCmd, migrateForceCmd)
+	RootCmd.AddCommand(migrateCmd)
+}
+
+// withMigrator runs the command on the configured database and prints the
+// version it leaves. With --dry-run, plan lists the migrations instead;
+// commands without a plan do nothing then.
+func withMigrator(
+	cmd *cobra.Command,
+	plan func(*storage.Migrator) ([]storage.MigrationStep, error),
+	run func(*storage.Migrator) error,
+) (err error) {
+	databaseDSN, err := cmd.Flags().GetString("databaseDSN")
+	if err != nil {
+		return fmt.Errorf("can't get databaseDSN %w", err)
+	}
+	if databaseDSN == "" {
+		return errors.New("migrations need a database, set databaseDSN")
+	}
+	dryRun, err := cmd.Flags().GetBool("dry-run")
+	if err != nil {
+		return fmt.Errorf("can't get dry-run flag %w", err)
+	}
+
+	mg, err := storage.NewMigrator(databaseDSN)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = errors.Join(err, mg.Close())
+	}()
+
+	out := cmd.OutOrStdout()
+	if dryRun && plan != nil {
+		steps, err := plan(mg)
+		if err != nil {
+			return err
+		}
+		if len(steps) == 0 {
+			fmt.Fprintln(out, "no pending migrations")
+		}
+		for _, step := range steps {
+			fmt.Fprintln(out, step)
+		}
+		return nil
+	}
+	if !dryRun {
+		if err := run(mg); err != nil {
+			return err
+		}
+	}
+
+	version, dirty, ok, err := mg.Version()
+	switch {
+	case err != nil:
+		return err
+	case !ok:
+		fmt.Fprintln(out, "no migrations applied")
+	case dirty:
+		fmt.Fprintf(out, "version %d (dirty)\n", version)
+	default:
+		fmt.Fprintf(out, "version %d\n", version)
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package root
+
+import (
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigrateForce(t *testing.T) {
+	// The flag is defined by main, the migrations stop at its empty value.
+	if RootCmd.PersistentFlags().Lookup("databaseDSN") == nil {
+		RootCmd.PersistentFlags().String("databaseDSN", "", "")
+	}
+	RootCmd.SetOut(io.Discard)
+	RootCmd.SetErr(io.Discard)
+	t.Cleanup(func() {
+		RootCmd.SetArgs(nil)
+		RootCmd.SetOut(nil)
+		RootCmd.SetErr(nil)
+	})
+
+	for _, tt := range []struct {
+		args []string
+		err  string
+	}{
+		{[]string{"none"}, "migrations need a database"},
+		{[]string{"--", "-1"}, "migrations need a database"},
+		{[]string{"3"}, "migrations need a database"},
+		{[]string{"-1"}, "unknown shorthand flag"},
+		{[]string{"latest"}, `invalid version "latest"`},
+		{[]string{"--", "-2"}, `invalid version "-2"`},
+	} {
+		RootCmd.SetArgs(append([]string{"migrate", "force", "--databaseDSN="}, tt.args...))
+		err := RootCmd.Execute()
+		assert.ErrorContains(t, err, tt.err, tt.args)
+	}
+}
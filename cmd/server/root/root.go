@@ -2,16 +2,20 @@ package root
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
 	"os"
 	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"go.uber.org/zap"
 
+	"github.com/ElizavetaFirst/go-metrics-alerts/internal/env"
+	"github.com/ElizavetaFirst/go-metrics-alerts/internal/server/compactor"
+	"github.com/ElizavetaFirst/go-metrics-alerts/internal/server/janitor"
 	"github.com/ElizavetaFirst/go-metrics-alerts/internal/server/saver"
 	"github.com/ElizavetaFirst/go-metrics-alerts/internal/server/storage"
 	"github.com/ElizavetaFirst/go-metrics-alerts/internal/server/webserver"
@@ -33,39 +37,30 @@ var RootCmd = &cobra.Command{
 		if len(parts) < 2 || parts[1] == "" {
 			return fmt.Errorf("you must provide a non-empty port number")
 		}
-		storeInterval, err := cmd.Flags().GetInt("storeInterval")
+		cfg, err := getStorageConfig(cmd)
 		if err != nil {
-			return fmt.Errorf("can't get storeInterval flag %w", err)
+			return err
 		}
-		fileStoragePath, err := cmd.Flags().GetString("fileStoragePath")
+		metricTTLStr, err := cmd.Flags().GetString("metricTTL")
 		if err != nil {
-			return fmt.Errorf("can't get fileStoragePath flag %w", err)
+			return fmt.Errorf("can't get metricTTL flag %w", err)
 		}
-		restore, err := cmd.Flags().GetBool("restore")
+		metricTTL, err := env.ParseDuration(metricTTLStr)
 		if err != nil {
-			return fmt.Errorf("can't get restore flag %w", err)
+			return fmt.Errorf("invalid metricTTL flag %w", err)
 		}
-		databaseDSN, err := cmd.Flags().GetString("databaseDSN")
+		janitorDryRun, err := cmd.Flags().GetBool("metricTTLDryRun")
 		if err != nil {
-			return fmt.Errorf("can't get databaseDSN %w", err)
+			return fmt.Errorf("can't get metricTTLDryRun flag %w", err)
+		}
+		historyEnabled, err := cmd.Flags().GetBool("history")
+		if err != nil {
+			return fmt.Errorf("can't get history flag %w", err)
 		}
 
-		ctx, cancelCtx := signal.NotifyContext(context.Background(), os.Interrupt)
+		ctx, cancelCtx := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 		defer cancelCtx()
 
-		context.AfterFunc(ctx, func() {
-			ctx, cancelCtx := context.WithTimeout(context.Background(), timeoutShutdown)
-			defer cancelCtx()
-
-			<-ctx.Done()
-			log.Fatal("failed to gracefully shutdown the service")
-		})
-
-		wg := &sync.WaitGroup{}
-		defer func() {
-			wg.Wait()
-		}()
-
 		log, err := zap.NewProduction()
 		if err != nil {
 			fmt.Printf("can't initialize zap logger: %v", err)
@@ -77,36 +72,139 @@ var RootCmd = &cobra.Command{
 			}
 		}()
 
-		var s storage.Storage
-		if databaseDSN != "" {
-			s, err = storage.NewPostgresStorage(ctx, databaseDSN, log)
-
-			if err != nil {
-				return fmt.Errorf("failed to create the postgres storage %w", err)
+		b, err := openBackend(ctx, cfg, log)
+		if err != nil {
+			return err
+		}
+		s, sv, walStorage := b.storage, b.sv, b.wal
+		var history storage.History
+		if historyEnabled {
+			switch db, _ := b.connected(); {
+			case b.fallback != nil:
+				// The history moves to the database once the fallback connects.
+				history = storage.NewFallbackHistory(func() storage.History {
+					if db, _ := b.connected(); db != nil {
+						return db
+					}
+					return nil
+				})
+			case db != nil:
+				history = db
+			default:
+				history = storage.NewMemHistory()
 			}
-			defer func() {
-				if err := s.Close(); err != nil {
-					log.Error("failed to close the postgres storage", zap.Error(err))
+		}
+		if history != nil {
+			s = storage.WithHistory(s, history, log)
+		}
+
+		server := webserver.NewWebserver(addr, s, history, b.diagnostics(cfg), log)
+
+		serverErr := make(chan error, 1)
+		go func() {
+			serverErr <- server.Run()
+		}()
+
+		tasksCtx, cancelTasks := context.WithCancel(context.Background())
+		defer cancelTasks()
+		saverErr := make(chan error, 1)
+		if sv != nil {
+			go func() {
+				saverErr <- sv.Run(tasksCtx)
+			}()
+		}
+		tasks := &sync.WaitGroup{}
+		if walStorage != nil {
+			tasks.Add(1)
+			go func() {
+				defer tasks.Done()
+				if err := walStorage.Run(tasksCtx); err != nil {
+					log.Error("WAL compaction Run return error", zap.Error(err))
 				}
 			}()
-		} else {
-			s = storage.NewMemStorage(log)
-			saver := saver.NewSaver(storeInterval, fileStoragePath, restore, s, log)
-			errChan := make(chan error)
-
+		}
+		if b.fallback != nil {
+			tasks.Add(1)
+			go func() {
+				defer tasks.Done()
+				if err := b.fallback.Run(tasksCtx); err != nil {
+					log.Error("storage fallback Run return error", zap.Error(err))
+				}
+			}()
+		}
+		if metricTTL > 0 {
+			j := janitor.NewJanitor(metricTTL, janitorDryRun, s, log)
+			tasks.Add(1)
 			go func() {
-				if err := saver.Run(ctx, wg); err != nil {
-					errChan <- err
+				defer tasks.Done()
+				if err := j.Run(tasksCtx); err != nil {
+					log.Error("janitor Run return error", zap.Error(err))
 				}
-				close(errChan)
 			}()
-			err := <-errChan
+		}
+		if history != nil {
+			c := compactor.NewCompactor(history, log)
+			tasks.Add(1)
+			go func() {
+				defer tasks.Done()
+				if err := c.Run(tasksCtx); err != nil {
+					log.Error("compactor Run return error", zap.Error(err))
+				}
+			}()
+		}
+
+		var runErr error
+		select {
+		case <-ctx.Done():
+			log.Info("shutdown signal received")
+		case err := <-serverErr:
 			if err != nil {
-				return fmt.Errorf("error while saver Run %w", err)
+				runErr = fmt.Errorf("error while server Run %w", err)
+			}
+		case err := <-saverErr:
+			if err != nil {
+				runErr = fmt.Errorf("error while saver Run %w", err)
 			}
 		}
-		server := webserver.NewWebserver(s, log)
 
-		return fmt.Errorf("error while server Run %w", server.Run(addr, wg))
+		stopTasks := func() {
+			cancelTasks()
+			tasks.Wait()
+		}
+		return errors.Join(runErr, shutdown(server, sv, stopTasks, s, log))
 	},
 }
+
+// shutdown stops the service in order: stop accepting requests and drain the
+// in-flight ones, take the final snapshot, then close the storage.
+func shutdown(
+	server *webserver.Webserver,
+	sv *saver.Saver,
+	stopTasks func(),
+	s storage.Storage,
+	log *zap.Logger,
+) error {
+	ctx, cancelCtx := context.WithTimeout(context.Background(), timeoutShutdown)
+	defer cancelCtx()
+
+	var errs []error
+	if err := server.Shutdown(ctx); err != nil {
+		log.Error("failed to gracefully shutdown the server", zap.Error(err))
+		errs = append(errs, err)
+	}
+
+	stopTasks()
+	if sv != nil {
+		if err := sv.Flush(ctx); err != nil {
+			log.Error("failed to save metrics on shutdown", zap.Error(err))
+			errs = append(errs, err)
+		}
+	}
+
+	if err := s.Close(); err != nil {
+		log.Error("failed to close the storage", zap.Error(err))
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
@@ -4,24 +4,39 @@ import (
 	"log"
 	"math/rand"
 	"runtime"
+	"sync"
 	"time"
+
+	"github.com/ElizavetaFirst/go-metrics-alerts/internal/metrics"
+)
+
+const (
+	randomFactor = 100
+	gcPauseName  = "GCPause"
 )
 
-const randomFactor = 100
+// gcPauseBounds are the GC pause histogram buckets in seconds, from 10µs to 100ms.
+var gcPauseBounds = []float64{0.00001, 0.00005, 0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1}
 
 type Collector struct {
 	CounterMetrics map[string]int64
 	GaugeMetrics   map[string]float64
+	gcPauses       metrics.Histogram
+	gcPauseSketch  metrics.Sketch
 	errorChan      chan error
 	RandomValue    float64
 	pollInterval   time.Duration
 	PollCount      int64
+	lastNumGC      uint32
+	mu             sync.Mutex
 }
 
 func NewCollector(pollInterval time.Duration, errorChan chan error) *Collector {
 	return &Collector{
 		GaugeMetrics:   make(map[string]float64),
 		CounterMetrics: make(map[string]int64),
+		gcPauses:       metrics.NewHistogram(gcPauseBounds),
+		gcPauseSketch:  metrics.NewSketch(metrics.DefaultSketchAlpha),
 		pollInterval:   pollInterval,
 		errorChan:      errorChan,
 	}
@@ -41,6 +56,7 @@ func (c *Collector) Run() {
 			c.RandomValue = rand.Float64()
 			runtime.ReadMemStats(&rtm)
 			c.updateMetrics(rtm)
+			c.observeGCPauses(rtm)
 		}
 	}
 }
@@ -110,6 +126,52 @@ func (c *Collector) updateMetrics(rtm runtime.MemStats) {
 	}
 }
 
+// observeGCPauses adds the pauses of the GC cycles that ended since the
+// previous poll. MemStats keeps only the last len(PauseNs) of them.
+func (c *Collector) observeGCPauses(rtm runtime.MemStats) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	first := c.lastNumGC
+	if rtm.NumGC-first > uint32(len(rtm.PauseNs)) {
+		first = rtm.NumGC - uint32(len(rtm.PauseNs))
+	}
+	for i := first; i < rtm.NumGC; i++ {
+		pause := time.Duration(rtm.PauseNs[i%uint32(len(rtm.PauseNs))])
+		c.gcPauses.Observe(pause.Seconds())
+		c.gcPauseSketch.Add(pause.Seconds())
+	}
+	c.lastNumGC = rtm.NumGC
+}
+
+// TakeHistogramMetrics returns the histograms observed since the previous call.
+// The server merges histograms, so every observation must be sent only once.
+func (c *Collector) TakeHistogramMetrics() map[string]metrics.Histogram {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.gcPauses.Count == 0 {
+		return nil
+	}
+	taken := c.gcPauses
+	c.gcPauses = metrics.NewHistogram(gcPauseBounds)
+	return map[string]metrics.Histogram{gcPauseName: taken}
+}
+
+// TakeSketchMetrics returns the sketches observed since the previous call.
+// Like histograms, the server merges them.
+func (c *Collector) TakeSketchMetrics() map[string]metrics.Sketch {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.gcPauseSketch.Count == 0 {
+		return nil
+	}
+	taken := c.gcPauseSketch
+	c.gcPauseSketch = metrics.NewSketch(metrics.DefaultSketchAlpha)
+	return map[string]metrics.Sketch{gcPauseName: taken}
+}
+
 func (c *Collector) GetGaugeMetrics() map[string]float64 {
 	return c.GaugeMetrics
 }
@@ -2,6 +2,7 @@ package collector
 
 import (
 	"reflect"
+	"runtime"
 	"testing"
 	"time"
 )
@@ -44,3 +45,56 @@ func TestNewCollector(t *testing.T) {
 		t.Errorf("Expected error channel to be %v, but got %v", errorChan, c.errorChan)
 	}
 }
+
+func TestCollector_TakeHistogramMetrics(t *testing.T) {
+	c := NewCollector(10*time.Second, make(chan error))
+
+	var rtm runtime.MemStats
+	rtm.NumGC = 3
+	rtm.PauseNs[0] = uint64(20 * time.Microsecond)
+	rtm.PauseNs[1] = uint64(2 * time.Millisecond)
+	rtm.PauseNs[2] = uint64(200 * time.Millisecond)
+	c.observeGCPauses(rtm)
+	// The same cycles must not be observed twice.
+	c.observeGCPauses(rtm)
+
+	got := c.TakeHistogramMetrics()[gcPauseName]
+	if got.Count != 3 {
+		t.Fatalf("Expected 3 GC pauses, got %+v", got)
+	}
+	if err := got.Validate(); err != nil {
+		t.Fatalf("Invalid histogram %v", err)
+	}
+	if last := got.Counts[len(got.Counts)-1]; last != 1 {
+		t.Errorf("Expected one pause above the last bound, got %d", last)
+	}
+
+	if taken := c.TakeHistogramMetrics(); taken != nil {
+		t.Errorf("Expected no histograms after take, got %+v", taken)
+	}
+}
+
+func TestCollector_TakeSketchMetrics(t *testing.T) {
+	c := NewCollector(10*time.Second, make(chan error))
+
+	var rtm runtime.MemStats
+	rtm.NumGC = 2
+	rtm.PauseNs[0] = uint64(1 * time.Millisecond)
+	rtm.PauseNs[1] = uint64(3 * time.Millisecond)
+	c.observeGCPauses(rtm)
+
+	got := c.TakeSketchMetrics()[gcPauseName]
+	if got.Count != 2 {
+		t.Fatalf("Expected 2 GC pauses, got %+v", got)
+	}
+	if err := got.Validate(); err != nil {
+		t.Fatalf("Invalid sketch %v", err)
+	}
+	if max := got.Quantile(1); max < 0.00297 || max > 0.00303 {
+		t.Errorf("Expected the longest pause to be about 3ms, got %v", max)
+	}
+
+	if taken := c.TakeSketchMetrics(); taken != nil {
+		t.Errorf("Expected no sketches after take, got %+v", taken)
+	}
+}
@@ -23,14 +23,18 @@ const (
 )
 
 type (
-	GaugeMetricsFuncType   func() map[string]float64
-	CounterMetricsFuncType func() map[string]int64
-	Uploader               struct {
-		counterMetricsFunc CounterMetricsFuncType
-		gaugeMetricsFunc   GaugeMetricsFuncType
-		errorChan          chan error
-		addr               string
-		reportInterval     time.Duration
+	GaugeMetricsFuncType     func() map[string]float64
+	CounterMetricsFuncType   func() map[string]int64
+	HistogramMetricsFuncType func() map[string]metrics.Histogram
+	SketchMetricsFuncType    func() map[string]metrics.Sketch
+	Uploader                 struct {
+		counterMetricsFunc   CounterMetricsFuncType
+		gaugeMetricsFunc     GaugeMetricsFuncType
+		histogramMetricsFunc HistogramMetricsFuncType
+		sketchMetricsFunc    SketchMetricsFuncType
+		errorChan            chan error
+		addr                 string
+		reportInterval       time.Duration
 	}
 )
 
@@ -38,14 +42,18 @@ func NewUploader(
 	addr string, reportInterval time.Duration,
 	gaugeMetricsFunc GaugeMetricsFuncType,
 	counterMetricsFunc CounterMetricsFuncType,
+	histogramMetricsFunc HistogramMetricsFuncType,
+	sketchMetricsFunc SketchMetricsFuncType,
 	errorChan chan error,
 ) *Uploader {
 	return &Uploader{
-		gaugeMetricsFunc:   gaugeMetricsFunc,
-		counterMetricsFunc: counterMetricsFunc,
-		addr:               addr,
-		reportInterval:     reportInterval,
-		errorChan:          errorChan,
+		gaugeMetricsFunc:     gaugeMetricsFunc,
+		counterMetricsFunc:   counterMetricsFunc,
+		histogramMetricsFunc: histogramMetricsFunc,
+		sketchMetricsFunc:    sketchMetricsFunc,
+		addr:                 addr,
+		reportInterval:       reportInterval,
+		errorChan:            errorChan,
 	}
 }
 
@@ -54,18 +62,14 @@ func (u *Uploader) Run() {
 
 	errorCount := 0
 	for range ticker.C {
+		// A report goes in one batch that the server applies as a whole, so
+		// a retry never resends metrics it already accepted. Histograms and
+		// sketches are taken once per report, retries resend the same ones.
+		gauges, counters := u.gaugeMetricsFunc(), u.counterMetricsFunc()
+		histograms, sketches := u.histogramMetricsFunc(), u.sketchMetricsFunc()
 		for {
-			if err := u.SendGaugeMetricsJSON(u.gaugeMetricsFunc()); err != nil {
-				log.Printf("SendGaugeMetricsJson return error %v", err)
-				errorCount++
-				if errorCount >= constants.MaxErrors {
-					u.errorChan <- err
-					return
-				}
-				continue
-			}
-			if err := u.SendCounterMetricsJSON(u.counterMetricsFunc()); err != nil {
-				log.Printf("SendCounterMetricsJson return error %v", err)
+			if err := u.SendMetricsUpdatesJSON(gauges, counters, histograms, sketches); err != nil {
+				log.Printf("SendMetricsUpdatesJSON return error %v", err)
 				errorCount++
 				if errorCount >= constants.MaxErrors {
 					u.errorChan <- err
@@ -229,3 +233,36 @@ func (u *Uploader) SendCounterMetricsUpdatesJSON(metricsMap map[string]int64) er
 	}
 	return u.sendMetricsJSON(url, metricsJSON)
 }
+
+// SendMetricsUpdatesJSON sends the metrics of every kind in one batch.
+func (u *Uploader) SendMetricsUpdatesJSON(
+	gauges map[string]float64,
+	counters map[string]int64,
+	histograms map[string]metrics.Histogram,
+	sketches map[string]metrics.Sketch,
+) error {
+	metricsList := make([]metrics.Metrics, 0, len(gauges)+len(counters)+len(histograms)+len(sketches))
+	for k, v := range gauges {
+		v := v
+		metricsList = append(metricsList, metrics.Metrics{ID: k, MType: constants.Gauge, Value: &v})
+	}
+	for k, v := range counters {
+		v := v
+		metricsList = append(metricsList, metrics.Metrics{ID: k, MType: constants.Counter, Delta: &v})
+	}
+	for k, v := range histograms {
+		v := v
+		metricsList = append(metricsList, metrics.Metrics{ID: k, MType: constants.Histogram, Histogram: &v})
+	}
+	for k, v := range sketches {
+		v := v
+		metricsList = append(metricsList, metrics.Metrics{ID: k, MType: constants.Summary, Sketch: &v})
+	}
+
+	url := fmt.Sprintf("http://%s/updates/", u.addr)
+	metricsJSON, err := json.Marshal(metricsList)
+	if err != nil {
+		return fmt.Errorf("can't marshal metrics to JSON %w", err)
+	}
+	return u.sendMetricsJSON(url, metricsJSON)
+}
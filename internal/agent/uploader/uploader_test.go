@@ -39,7 +39,7 @@ func TestNewUploader(t *testing.T) {
 	}
 
 	errorChan := make(chan error)
-	uploader := NewUploader("localhost:8080", 2*time.Second, gaugeFunc, counterFunc, errorChan)
+	uploader := NewUploader("localhost:8080", 2*time.Second, gaugeFunc, counterFunc, nil, nil, errorChan)
 
 	if reflect.ValueOf(uploader.gaugeMetricsFunc).Pointer() != reflect.ValueOf(gaugeFunc).Pointer() {
 		t.Error("Gauge metrics function not initialized correctly.")
@@ -59,7 +59,7 @@ func TestUploader_SendGaugeMetrics(t *testing.T) {
 	defer ts.Close()
 
 	errorChan := make(chan error)
-	uploader := NewUploader("localhost:8080", 2*time.Second, gaugeMetrics, counterMetrics, errorChan)
+	uploader := NewUploader("localhost:8080", 2*time.Second, gaugeMetrics, counterMetrics, nil, nil, errorChan)
 
 	if err := uploader.SendGaugeMetrics(gaugeMetrics()); err != nil {
 		log.Printf("SendGaugeMetrics return error %v", err)
@@ -75,7 +75,7 @@ func TestUploader_SendCounterMetrics(t *testing.T) {
 	defer ts.Close()
 
 	errorChan := make(chan error)
-	uploader := NewUploader("localhost:8080", 2*time.Second, gaugeMetrics, counterMetrics, errorChan)
+	uploader := NewUploader("localhost:8080", 2*time.Second, gaugeMetrics, counterMetrics, nil, nil, errorChan)
 
 	if err := uploader.SendCounterMetrics(counterMetrics()); err != nil {
 		log.Printf("SendCounterMetrics return error %v", err)
@@ -109,7 +109,7 @@ func newTestUploader(t *testing.T, ts *httptest.Server) *Uploader {
 	t.Helper()
 	errorChan := make(chan error)
 	trimmedURL := strings.TrimPrefix(ts.URL, "http://")
-	return NewUploader(trimmedURL, 2*time.Second, gaugeMetrics, counterMetrics, errorChan)
+	return NewUploader(trimmedURL, 2*time.Second, gaugeMetrics, counterMetrics, nil, nil, errorChan)
 }
 
 //nolint:dupl // no way to delete duplicate
@@ -167,3 +167,39 @@ func TestUploader_SendCounterMetricsJson(t *testing.T) {
 		t.Fatalf("SendCounterMetricsJson returned error: %v", err)
 	}
 }
+
+func TestUploader_SendMetricsUpdatesJSON(t *testing.T) {
+	histogram := metrics.NewHistogram([]float64{0.001, 0.01})
+	histogram.Observe(0.005)
+	sketch := metrics.NewSketch(metrics.DefaultSketchAlpha)
+	sketch.Add(0.005)
+
+	var requests []string
+	var got []metrics.Metrics
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path)
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("Failed to unmarshal request body: %v", err)
+		}
+	}))
+	defer ts.Close()
+
+	uploader := newTestUploader(t, ts)
+	err := uploader.SendMetricsUpdatesJSON(gaugeMetrics(), counterMetrics(),
+		map[string]metrics.Histogram{"GCPause": histogram}, map[string]metrics.Sketch{"GCPause": sketch})
+	if err != nil {
+		t.Fatalf("SendMetricsUpdatesJSON returned error: %v", err)
+	}
+
+	if !reflect.DeepEqual(requests, []string{"/updates/"}) {
+		t.Fatalf("Expected one batch to /updates/, got %v", requests)
+	}
+	kinds := make(map[string]int)
+	for _, m := range got {
+		kinds[m.MType]++
+	}
+	want := map[string]int{constants.Gauge: 2, constants.Counter: 2, constants.Histogram: 1, constants.Summary: 1}
+	if !reflect.DeepEqual(kinds, want) {
+		t.Fatalf("Batch kinds didn't match: got %v, expected: %v", kinds, want)
+	}
+}
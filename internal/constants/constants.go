@@ -3,6 +3,9 @@ package constants
 const (
 	Gauge     = "gauge"
 	Counter   = "counter"
+	Histogram = "histogram"
+	Summary   = "summary"
+	Set       = "set"
 	Gzip      = "gzip"
 	MaxErrors = 1000
 	Logger    = "logger"
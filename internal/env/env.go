@@ -1,11 +1,21 @@
 package env
 
 import (
+	"fmt"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
+const hoursInDay = 24
+
+// GetEnvDuration reads a duration in whole seconds.
 func GetEnvDuration(key string, defaultVal int) int {
+	return GetEnvInt(key, defaultVal)
+}
+
+func GetEnvInt(key string, defaultVal int) int {
 	if envVal, exists := os.LookupEnv(key); exists {
 		if i, err := strconv.Atoi(envVal); err == nil {
 			return i
@@ -30,3 +40,33 @@ func GetEnvBool(key string, defaultVal bool) bool {
 	}
 	return defaultVal
 }
+
+// ParseDuration extends time.ParseDuration with a `d` (24h) unit, so that
+// retention settings like "7d" or "1d12h" can be written naturally.
+func ParseDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	days, rest, found := strings.Cut(s, "d")
+	if !found {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return 0, fmt.Errorf("can't parse duration %q: %w", s, err)
+		}
+		return d, nil
+	}
+
+	n, err := strconv.Atoi(days)
+	if err != nil {
+		return 0, fmt.Errorf("can't parse days in duration %q: %w", s, err)
+	}
+	d := time.Duration(n) * hoursInDay * time.Hour
+	if rest != "" {
+		restDuration, err := time.ParseDuration(rest)
+		if err != nil {
+			return 0, fmt.Errorf("can't parse duration %q: %w", s, err)
+		}
+		d += restDuration
+	}
+	return d, nil
+}
@@ -0,0 +1,25 @@
+package fsutil
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// SyncDir makes the creation and renames of the files in dir durable.
+// Platforms that can't sync a directory report os.ErrInvalid, which is
+// ignored.
+func SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("can't open dir %w", err)
+	}
+	err = d.Sync()
+	if closeErr := d.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if err != nil && !errors.Is(err, os.ErrInvalid) {
+		return fmt.Errorf("can't sync dir %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// maxHistogramBounds bounds the buckets a client can make the server keep.
+const maxHistogramBounds = 1024
+
+var ErrHistogramBounds = errors.New("histogram bounds don't match")
+
+// Histogram counts observations in buckets. Bucket i counts the observations
+// in (Bounds[i-1], Bounds[i]], the last bucket counts the ones above the last bound.
+type Histogram struct {
+	Quantiles map[string]float64 `json:"quantiles,omitempty"` // оценки квантилей, только в ответах сервера
+	Bounds    []float64          `json:"bounds"`              // верхние границы корзин по возрастанию
+	Counts    []uint64           `json:"counts"`              // len(Bounds)+1 счётчиков
+	Sum       float64            `json:"sum"`
+	Count     uint64             `json:"count"`
+}
+
+func NewHistogram(bounds []float64) Histogram {
+	return Histogram{
+		Bounds: bounds,
+		Counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.Bounds, v)
+	h.Counts[i]++
+	h.Sum += v
+	h.Count++
+}
+
+func (h Histogram) Validate() error {
+	if len(h.Counts) != len(h.Bounds)+1 {
+		return fmt.Errorf("histogram has %d bounds and %d counts: %w", len(h.Bounds), len(h.Counts), ErrHistogramBounds)
+	}
+	if len(h.Bounds) > maxHistogramBounds {
+		return fmt.Errorf("histogram has %d bounds, at most %d: %w", len(h.Bounds), maxHistogramBounds, ErrHistogramBounds)
+	}
+	for i := 1; i < len(h.Bounds); i++ {
+		// Written so that a NaN bound fails too.
+		if !(h.Bounds[i] > h.Bounds[i-1]) {
+			return fmt.Errorf("histogram bounds are not strictly increasing: %w", ErrHistogramBounds)
+		}
+	}
+	var total uint64
+	for _, c := range h.Counts {
+		total += c
+	}
+	if total != h.Count {
+		return fmt.Errorf("histogram count %d doesn't match the buckets total %d", h.Count, total)
+	}
+	return nil
+}
+
+// Merge returns the sum of two histograms with the same bounds.
+func (h Histogram) Merge(other Histogram) (Histogram, error) {
+	if len(h.Bounds) != len(other.Bounds) || len(h.Counts) != len(other.Counts) {
+		return Histogram{}, ErrHistogramBounds
+	}
+	for i := range h.Bounds {
+		if h.Bounds[i] != other.Bounds[i] {
+			return Histogram{}, ErrHistogramBounds
+		}
+	}
+
+	merged := NewHistogram(append([]float64(nil), h.Bounds...))
+	for i := range h.Counts {
+		merged.Counts[i] = h.Counts[i] + other.Counts[i]
+	}
+	merged.Sum = h.Sum + other.Sum
+	merged.Count = h.Count + other.Count
+	return merged, nil
+}
+
+// Quantile estimates the q-quantile by linear interpolation inside the bucket
+// that holds it. The first bucket starts at zero, and the values in the last
+// one are reported as the last bound.
+func (h Histogram) Quantile(q float64) float64 {
+	if h.Count == 0 || len(h.Bounds) == 0 {
+		return 0
+	}
+	rank := q * float64(h.Count)
+
+	var seen float64
+	for i, c := range h.Counts {
+		if c == 0 || seen+float64(c) < rank {
+			seen += float64(c)
+			continue
+		}
+		if i == len(h.Bounds) {
+			return h.Bounds[len(h.Bounds)-1]
+		}
+		lower := 0.0
+		if i > 0 {
+			lower = h.Bounds[i-1]
+		}
+		return lower + (h.Bounds[i]-lower)*(rank-seen)/float64(c)
+	}
+	return h.Bounds[len(h.Bounds)-1]
+}
+
+// WithQuantiles returns h with the p50, p95 and p99 estimates filled in.
+func (h Histogram) WithQuantiles() Histogram {
+	h.Quantiles = map[string]float64{
+		"p50": h.Quantile(0.5),
+		"p95": h.Quantile(0.95),
+		"p99": h.Quantile(0.99),
+	}
+	return h
+}
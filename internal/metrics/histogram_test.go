@@ -0,0 +1,49 @@
+package metrics
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistogram_MergeAndQuantile(t *testing.T) {
+	a := NewHistogram([]float64{1, 2, 4})
+	for _, v := range []float64{0.5, 1.5, 1.5, 3} {
+		a.Observe(v)
+	}
+	b := NewHistogram([]float64{1, 2, 4})
+	for _, v := range []float64{1.5, 3, 3, 10} {
+		b.Observe(v)
+	}
+	assert.NoError(t, a.Validate())
+
+	merged, err := a.Merge(b)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{1, 3, 3, 1}, merged.Counts)
+	assert.Equal(t, uint64(8), merged.Count)
+	assert.InDelta(t, 24.0, merged.Sum, 1e-9)
+	assert.NoError(t, merged.Validate())
+
+	assert.InDelta(t, 1.0, merged.Quantile(0.125), 1e-9)
+	assert.InDelta(t, 2.0, merged.Quantile(0.5), 1e-9)
+	assert.InDelta(t, 4.0, merged.Quantile(0.99), 1e-9)
+
+	_, err = a.Merge(NewHistogram([]float64{1, 2, 5}))
+	assert.ErrorIs(t, err, ErrHistogramBounds)
+}
+
+func TestHistogram_Validate(t *testing.T) {
+	assert.ErrorIs(t, Histogram{Bounds: []float64{1}, Counts: []uint64{1}, Count: 1}.Validate(), ErrHistogramBounds)
+	assert.ErrorIs(t, Histogram{Bounds: []float64{2, 1}, Counts: []uint64{0, 0, 0}}.Validate(), ErrHistogramBounds)
+	assert.Error(t, Histogram{Bounds: []float64{1}, Counts: []uint64{1, 1}, Count: 3}.Validate())
+	assert.ErrorIs(t, Histogram{Bounds: []float64{1, 1}, Counts: []uint64{0, 0, 0}}.Validate(), ErrHistogramBounds)
+	assert.ErrorIs(t, Histogram{Bounds: []float64{1, math.NaN()}, Counts: []uint64{0, 0, 0}}.Validate(), ErrHistogramBounds)
+
+	bounds := make([]float64, maxHistogramBounds+1)
+	for i := range bounds {
+		bounds[i] = float64(i)
+	}
+	assert.ErrorIs(t, NewHistogram(bounds).Validate(), ErrHistogramBounds)
+	assert.NoError(t, NewHistogram(bounds[:maxHistogramBounds]).Validate())
+}
@@ -0,0 +1,104 @@
+package metrics
+
+import (
+	"errors"
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+const (
+	// hllPrecision gives 2^14 registers and a standard error of about 0.8%.
+	hllPrecision = 14
+	hllRegisters = 1 << hllPrecision
+)
+
+var ErrHyperLogLogRegisters = errors.New("hyperloglog register counts don't match")
+
+// HyperLogLog estimates the number of distinct members without storing them.
+// Two HyperLogLogs merge by taking the maximum of every register.
+type HyperLogLog struct {
+	Registers []byte `json:"registers"`
+}
+
+func NewHyperLogLog() HyperLogLog {
+	return HyperLogLog{Registers: make([]byte, hllRegisters)}
+}
+
+func (h *HyperLogLog) Add(member string) {
+	if h.Registers == nil {
+		h.Registers = make([]byte, hllRegisters)
+	}
+	x := hashMember(member)
+	index := x >> (64 - hllPrecision)
+	rank := byte(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1)) + 1)
+	if rank > h.Registers[index] {
+		h.Registers[index] = rank
+	}
+}
+
+func (h HyperLogLog) Validate() error {
+	if len(h.Registers) != hllRegisters {
+		return ErrHyperLogLogRegisters
+	}
+	return nil
+}
+
+func (h HyperLogLog) Merge(other HyperLogLog) (HyperLogLog, error) {
+	if len(h.Registers) != len(other.Registers) {
+		return HyperLogLog{}, ErrHyperLogLogRegisters
+	}
+	merged := HyperLogLog{Registers: make([]byte, len(h.Registers))}
+	for i := range h.Registers {
+		merged.Registers[i] = max(h.Registers[i], other.Registers[i])
+	}
+	return merged, nil
+}
+
+// Count returns the estimated number of distinct members.
+func (h HyperLogLog) Count() uint64 {
+	if len(h.Registers) == 0 {
+		return 0
+	}
+	m := float64(len(h.Registers))
+
+	var sum float64
+	zeros := 0
+	for _, r := range h.Registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	estimate := hllAlpha(m) * m * m / sum
+
+	// Linear counting is more accurate while many registers are still empty.
+	const smallRangeFactor = 2.5
+	if estimate <= smallRangeFactor*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return uint64(estimate + 0.5)
+}
+
+func hllAlpha(m float64) float64 {
+	const (
+		alphaInf  = 0.7213
+		alphaCorr = 1.079
+	)
+	return alphaInf / (1 + alphaCorr/m)
+}
+
+// hashMember must stay stable across processes, since registers are merged
+// across agents and restarts. The FNV hash is finalized with the SplitMix64
+// mixer to spread its bits evenly.
+func hashMember(member string) uint64 {
+	f := fnv.New64a()
+	_, _ = f.Write([]byte(member))
+	x := f.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
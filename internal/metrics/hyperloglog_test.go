@@ -0,0 +1,29 @@
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHyperLogLog_CountAndMerge(t *testing.T) {
+	for _, n := range []int{10, 1000, 100000} {
+		a, b := NewHyperLogLog(), NewHyperLogLog()
+		for i := 0; i < n; i++ {
+			// The halves overlap, so the merged count must not double.
+			a.Add(fmt.Sprintf("user-%d", i))
+			b.Add(fmt.Sprintf("user-%d", i/2))
+		}
+
+		merged, err := a.Merge(b)
+		assert.NoError(t, err)
+		got := float64(merged.Count())
+		assert.LessOrEqual(t, math.Abs(got-float64(n))/float64(n), 0.03, "n=%d got %v", n, got)
+	}
+
+	_, err := NewHyperLogLog().Merge(HyperLogLog{Registers: make([]byte, 16)})
+	assert.ErrorIs(t, err, ErrHyperLogLogRegisters)
+	assert.Equal(t, uint64(0), NewHyperLogLog().Count())
+}
@@ -1,8 +1,18 @@
 package metrics
 
 type Metrics struct {
-	Delta *int64   `json:"delta,omitempty"` // значение метрики в случае передачи counter
-	Value *float64 `json:"value,omitempty"` // значение метрики в случае передачи gauge
-	ID    string   `json:"id"`              // имя метрики
-	MType string   `json:"type"`            // параметр, принимающий значение gauge или counter
+	Delta     *int64     `json:"delta,omitempty"`     // значение метрики в случае передачи counter
+	Value     *float64   `json:"value,omitempty"`     // значение метрики в случае передачи gauge
+	Histogram *Histogram `json:"histogram,omitempty"` // значение метрики в случае передачи histogram
+	Sketch    *Sketch    `json:"sketch,omitempty"`    // значение метрики в случае передачи summary
+	Members   []string   `json:"members,omitempty"`   // элементы множества в случае передачи set
+	Count     *uint64    `json:"count,omitempty"`     // примерное число уникальных элементов set в ответе
+	Op        string     `json:"op,omitempty"`        // операция над gauge: set (по умолчанию), add, max или min
+	ID        string     `json:"id"`                  // имя метрики
+	MType     string     `json:"type"`                // параметр, принимающий значение gauge, counter, histogram, summary или set
+}
+
+// Mergeable values are merged on update instead of being overwritten.
+type Mergeable[T any] interface {
+	Merge(other T) (T, error)
 }
@@ -0,0 +1,228 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+const (
+	DefaultSketchAlpha = 0.01
+	// minSketchAlpha keeps the bin indexes of every float64 within int32.
+	minSketchAlpha = 1e-4
+	// maxSketchBins bounds the size of one store, the lowest bins are collapsed beyond it.
+	maxSketchBins = 2048
+	// minSketchValue is the smallest magnitude kept in a bin, anything closer to zero is zero.
+	minSketchValue = 1e-9
+)
+
+var (
+	ErrSketchAlpha = errors.New("sketch accuracies don't match")
+	ErrSketchBins  = errors.New("sketch bins are out of range")
+)
+
+// Sketch is a DDSketch: a quantile sketch with relative accuracy Alpha.
+// Values are counted in logarithmic bins, so sketches with the same
+// accuracy merge exactly by adding up their bins.
+type Sketch struct {
+	Quantiles map[string]float64 `json:"quantiles,omitempty"` // оценки квантилей, только в ответах сервера
+	Positive  map[int32]uint64   `json:"positive,omitempty"`  // корзины положительных значений
+	Negative  map[int32]uint64   `json:"negative,omitempty"`  // корзины модулей отрицательных значений
+	Alpha     float64            `json:"alpha"`               // относительная точность квантилей
+	Sum       float64            `json:"sum"`
+	Min       float64            `json:"min"`
+	Max       float64            `json:"max"`
+	Zero      uint64             `json:"zero,omitempty"`
+	Count     uint64             `json:"count"`
+}
+
+func NewSketch(alpha float64) Sketch {
+	return Sketch{
+		Alpha:    alpha,
+		Positive: make(map[int32]uint64),
+		Negative: make(map[int32]uint64),
+	}
+}
+
+func (s *Sketch) gamma() float64 {
+	return (1 + s.Alpha) / (1 - s.Alpha)
+}
+
+func (s *Sketch) index(v float64) int32 {
+	return int32(math.Ceil(math.Log(v) / math.Log(s.gamma())))
+}
+
+// value is the representative of a bin, within Alpha of every value in it.
+func (s *Sketch) value(index int32) float64 {
+	g := s.gamma()
+	return 2 * math.Pow(g, float64(index)) / (g + 1)
+}
+
+func (s *Sketch) Add(v float64) {
+	switch {
+	case v > minSketchValue:
+		if s.Positive == nil {
+			s.Positive = make(map[int32]uint64)
+		}
+		s.Positive[s.index(v)]++
+		collapseLowest(s.Positive, false)
+	case v < -minSketchValue:
+		if s.Negative == nil {
+			s.Negative = make(map[int32]uint64)
+		}
+		s.Negative[s.index(-v)]++
+		collapseLowest(s.Negative, true)
+	default:
+		s.Zero++
+	}
+	if s.Count == 0 || v < s.Min {
+		s.Min = v
+	}
+	if s.Count == 0 || v > s.Max {
+		s.Max = v
+	}
+	s.Count++
+	s.Sum += v
+}
+
+func (s Sketch) Validate() error {
+	if s.Alpha < minSketchAlpha || s.Alpha >= 1 {
+		return fmt.Errorf("sketch alpha %v is out of [%v, 1): %w", s.Alpha, minSketchAlpha, ErrSketchAlpha)
+	}
+	// A store never holds more bins than Add and Merge leave, nor bins that
+	// no float64 beyond minSketchValue maps to.
+	lowest, highest := s.index(minSketchValue), s.index(math.MaxFloat64)
+	for _, bins := range []map[int32]uint64{s.Positive, s.Negative} {
+		if len(bins) > maxSketchBins {
+			return fmt.Errorf("sketch has %d bins, at most %d: %w", len(bins), maxSketchBins, ErrSketchBins)
+		}
+		for i := range bins {
+			if i < lowest || i > highest {
+				return fmt.Errorf("sketch bin %d is out of [%d, %d]: %w", i, lowest, highest, ErrSketchBins)
+			}
+		}
+	}
+	total := s.Zero
+	for _, c := range s.Positive {
+		total += c
+	}
+	for _, c := range s.Negative {
+		total += c
+	}
+	if total != s.Count {
+		return fmt.Errorf("sketch count %d doesn't match the bins total %d", s.Count, total)
+	}
+	return nil
+}
+
+// Merge returns the sum of two sketches with the same accuracy.
+func (s Sketch) Merge(other Sketch) (Sketch, error) {
+	if s.Alpha != other.Alpha {
+		return Sketch{}, ErrSketchAlpha
+	}
+
+	merged := NewSketch(s.Alpha)
+	for _, src := range []Sketch{s, other} {
+		for i, c := range src.Positive {
+			merged.Positive[i] += c
+		}
+		for i, c := range src.Negative {
+			merged.Negative[i] += c
+		}
+		merged.Zero += src.Zero
+	}
+	collapseLowest(merged.Positive, false)
+	collapseLowest(merged.Negative, true)
+
+	merged.Count = s.Count + other.Count
+	merged.Sum = s.Sum + other.Sum
+	switch {
+	case s.Count == 0:
+		merged.Min, merged.Max = other.Min, other.Max
+	case other.Count == 0:
+		merged.Min, merged.Max = s.Min, s.Max
+	default:
+		merged.Min = math.Min(s.Min, other.Min)
+		merged.Max = math.Max(s.Max, other.Max)
+	}
+	return merged, nil
+}
+
+// Quantile returns the q-quantile within the relative accuracy of the sketch.
+func (s Sketch) Quantile(q float64) float64 {
+	if s.Count == 0 {
+		return 0
+	}
+	if q <= 0 {
+		return s.Min
+	}
+	if q >= 1 {
+		return s.Max
+	}
+	rank := q * float64(s.Count-1)
+
+	var seen float64
+	// The most negative values are in the highest negative bins.
+	for _, i := range sortedIndexes(s.Negative, true) {
+		seen += float64(s.Negative[i])
+		if seen > rank {
+			return s.clamp(-s.value(i))
+		}
+	}
+	seen += float64(s.Zero)
+	if seen > rank {
+		return 0
+	}
+	for _, i := range sortedIndexes(s.Positive, false) {
+		seen += float64(s.Positive[i])
+		if seen > rank {
+			return s.clamp(s.value(i))
+		}
+	}
+	return s.Max
+}
+
+func (s Sketch) clamp(v float64) float64 {
+	return math.Max(s.Min, math.Min(s.Max, v))
+}
+
+// WithQuantiles returns s with the p50, p95 and p99 estimates filled in.
+func (s Sketch) WithQuantiles() Sketch {
+	s.Quantiles = map[string]float64{
+		"p50": s.Quantile(0.5),
+		"p95": s.Quantile(0.95),
+		"p99": s.Quantile(0.99),
+	}
+	return s
+}
+
+func sortedIndexes(bins map[int32]uint64, descending bool) []int32 {
+	indexes := make([]int32, 0, len(bins))
+	for i := range bins {
+		indexes = append(indexes, i)
+	}
+	sort.Slice(indexes, func(a, b int) bool {
+		if descending {
+			return indexes[a] > indexes[b]
+		}
+		return indexes[a] < indexes[b]
+	})
+	return indexes
+}
+
+// collapseLowest folds the bins of the lowest values into one so that a store
+// never holds more than maxSketchBins bins. High quantiles stay accurate.
+func collapseLowest(bins map[int32]uint64, negative bool) {
+	if len(bins) <= maxSketchBins {
+		return
+	}
+	// For the negative store the lowest values are the highest indexes.
+	indexes := sortedIndexes(bins, negative)
+	extra := indexes[:len(indexes)-maxSketchBins+1]
+	target := indexes[len(indexes)-maxSketchBins+1]
+	for _, i := range extra {
+		bins[target] += bins[i]
+		delete(bins, i)
+	}
+}
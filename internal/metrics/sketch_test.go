@@ -0,0 +1,78 @@
+package metrics
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSketch_MergeAndQuantile(t *testing.T) {
+	// Two agents observe disjoint halves of 1..10000, the merged sketch
+	// must answer as if it had seen all of them.
+	a, b := NewSketch(DefaultSketchAlpha), NewSketch(DefaultSketchAlpha)
+	for v := 1; v <= 10000; v++ {
+		if v%2 == 0 {
+			a.Add(float64(v))
+		} else {
+			b.Add(float64(v))
+		}
+	}
+	assert.NoError(t, a.Validate())
+
+	merged, err := a.Merge(b)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(10000), merged.Count)
+	assert.Equal(t, float64(1), merged.Min)
+	assert.Equal(t, float64(10000), merged.Max)
+
+	for _, q := range []float64{0.5, 0.9, 0.99, 0.999} {
+		expected := q * 9999
+		got := merged.Quantile(q)
+		assert.LessOrEqual(t, math.Abs(got-expected)/expected, 2*DefaultSketchAlpha, "q=%v got %v", q, got)
+	}
+
+	_, err = a.Merge(NewSketch(0.02))
+	assert.ErrorIs(t, err, ErrSketchAlpha)
+}
+
+func TestSketch_NegativeAndZero(t *testing.T) {
+	s := NewSketch(DefaultSketchAlpha)
+	for _, v := range []float64{-100, -10, 0, 10, 100} {
+		s.Add(v)
+	}
+	assert.Equal(t, float64(-100), s.Quantile(0))
+	assert.InDelta(t, -10, s.Quantile(0.25), 10*DefaultSketchAlpha)
+	assert.Equal(t, float64(0), s.Quantile(0.5))
+	assert.InDelta(t, 10, s.Quantile(0.75), 10*DefaultSketchAlpha)
+	assert.Equal(t, float64(100), s.Quantile(1))
+}
+
+func TestSketch_CollapseKeepsBinsBounded(t *testing.T) {
+	s := NewSketch(DefaultSketchAlpha)
+	for e := -300.0; e < 300; e += 0.01 {
+		s.Add(math.Pow(10, e/10))
+	}
+	assert.LessOrEqual(t, len(s.Positive), maxSketchBins)
+	assert.NoError(t, s.Validate())
+}
+
+func TestSketch_ValidateBins(t *testing.T) {
+	s := NewSketch(DefaultSketchAlpha)
+	s.Add(1)
+	assert.NoError(t, s.Validate())
+
+	outOfRange := NewSketch(DefaultSketchAlpha)
+	outOfRange.Positive[math.MaxInt32] = 1
+	outOfRange.Count = 1
+	assert.ErrorIs(t, outOfRange.Validate(), ErrSketchBins)
+
+	tooMany := NewSketch(DefaultSketchAlpha)
+	for i := int32(0); i <= maxSketchBins; i++ {
+		tooMany.Negative[i] = 1
+	}
+	tooMany.Count = maxSketchBins + 1
+	assert.ErrorIs(t, tooMany.Validate(), ErrSketchBins)
+
+	assert.ErrorIs(t, NewSketch(1e-9).Validate(), ErrSketchAlpha)
+}
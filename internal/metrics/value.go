@@ -0,0 +1,178 @@
+package metrics
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/ElizavetaFirst/go-metrics-alerts/internal/constants"
+)
+
+var (
+	ErrUnknownType  = errors.New("unknown metric type")
+	ErrTypeMismatch = errors.New("metric values have different types")
+)
+
+// Value is the value of one metric, its dynamic type is the metric type:
+// Gauge, Counter, Histogram, Sketch for summaries or HyperLogLog for sets.
+type Value interface {
+	MetricType() string
+}
+
+type (
+	Gauge   float64
+	Counter int64
+)
+
+func (Gauge) MetricType() string       { return constants.Gauge }
+func (Counter) MetricType() string     { return constants.Counter }
+func (Histogram) MetricType() string   { return constants.Histogram }
+func (Sketch) MetricType() string      { return constants.Summary }
+func (HyperLogLog) MetricType() string { return constants.Set }
+
+// Merge combines an update with the current value of the same type:
+// counters are added, gauges are replaced and the rest are merged.
+func Merge(current, update Value) (Value, error) {
+	if current.MetricType() != update.MetricType() {
+		return nil, fmt.Errorf("can't merge %s into %s: %w", update.MetricType(), current.MetricType(), ErrTypeMismatch)
+	}
+	switch c := current.(type) {
+	case Counter:
+		return c + update.(Counter), nil
+	case Histogram:
+		return mergeTyped(c, update.(Histogram))
+	case Sketch:
+		return mergeTyped(c, update.(Sketch))
+	case HyperLogLog:
+		return mergeTyped(c, update.(HyperLogLog))
+	default:
+		return update, nil
+	}
+}
+
+func mergeTyped[T interface {
+	Value
+	Mergeable[T]
+}](current, update T) (Value, error) {
+	merged, err := current.Merge(update)
+	if err != nil {
+		return nil, fmt.Errorf("can't merge %s values %w", current.MetricType(), err)
+	}
+	return merged, nil
+}
+
+// DecodeValue decodes the JSON form of a value of the given type.
+func DecodeValue(metricType string, data []byte) (Value, error) {
+	switch metricType {
+	case constants.Gauge:
+		var v float64
+		if err := json.Unmarshal(data, &v); err != nil {
+			return nil, fmt.Errorf("can't decode gauge %w", err)
+		}
+		return Gauge(v), nil
+	case constants.Counter:
+		// Snapshots written while values were untyped may hold counters as floats.
+		var n json.Number
+		if err := json.Unmarshal(data, &n); err != nil {
+			return nil, fmt.Errorf("can't decode counter %w", err)
+		}
+		if c, err := n.Int64(); err == nil {
+			return Counter(c), nil
+		}
+		f, err := n.Float64()
+		if err != nil || f != math.Trunc(f) {
+			return nil, fmt.Errorf("counter %s is not an integer", n)
+		}
+		return Counter(f), nil
+	case constants.Histogram:
+		return decodeTyped[Histogram](data)
+	case constants.Summary:
+		return decodeTyped[Sketch](data)
+	case constants.Set:
+		return decodeTyped[HyperLogLog](data)
+	default:
+		return nil, fmt.Errorf("%q: %w", metricType, ErrUnknownType)
+	}
+}
+
+func decodeTyped[T interface {
+	Value
+	Validate() error
+}](data []byte) (Value, error) {
+	var v T
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, fmt.Errorf("can't decode %s %w", v.MetricType(), err)
+	}
+	if err := v.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid %s %w", v.MetricType(), err)
+	}
+	return v, nil
+}
+
+// MetricValue returns the value carried by the field of m's type.
+func (m Metrics) MetricValue() (Value, error) {
+	switch m.MType {
+	case constants.Gauge:
+		if m.Value == nil {
+			return nil, errors.New("gauge value is required")
+		}
+		return Gauge(*m.Value), nil
+	case constants.Counter:
+		if m.Delta == nil {
+			return nil, errors.New("counter delta is required")
+		}
+		return Counter(*m.Delta), nil
+	case constants.Histogram:
+		if m.Histogram == nil {
+			return nil, errors.New("histogram is required")
+		}
+		if err := m.Histogram.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid histogram %w", err)
+		}
+		return *m.Histogram, nil
+	case constants.Summary:
+		if m.Sketch == nil {
+			return nil, errors.New("sketch is required")
+		}
+		if err := m.Sketch.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid sketch %w", err)
+		}
+		return *m.Sketch, nil
+	case constants.Set:
+		if len(m.Members) == 0 {
+			return nil, errors.New("set members are required")
+		}
+		set := NewHyperLogLog()
+		for _, member := range m.Members {
+			set.Add(member)
+		}
+		return set, nil
+	default:
+		return nil, fmt.Errorf("%q: %w", m.MType, ErrUnknownType)
+	}
+}
+
+// NewMetrics returns the wire form of a value, with the quantiles of
+// histograms and sketches and the distinct count of sets.
+func NewMetrics(id string, v Value) Metrics {
+	m := Metrics{ID: id, MType: v.MetricType()}
+	switch value := v.(type) {
+	case Gauge:
+		f := float64(value)
+		m.Value = &f
+	case Counter:
+		d := int64(value)
+		m.Delta = &d
+	case Histogram:
+		h := value.WithQuantiles()
+		m.Histogram = &h
+	case Sketch:
+		s := value.WithQuantiles()
+		m.Sketch = &s
+	case HyperLogLog:
+		count := value.Count()
+		m.Count = &count
+	}
+	return m
+}
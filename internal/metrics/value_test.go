@@ -0,0 +1,33 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMerge(t *testing.T) {
+	v, err := Merge(Counter(2), Counter(3))
+	assert.NoError(t, err)
+	assert.Equal(t, Counter(5), v)
+
+	v, err = Merge(Gauge(2), Gauge(3))
+	assert.NoError(t, err)
+	assert.Equal(t, Gauge(3), v)
+
+	_, err = Merge(Gauge(2), Counter(3))
+	assert.ErrorIs(t, err, ErrTypeMismatch)
+}
+
+func TestMetrics_MetricValue(t *testing.T) {
+	delta := int64(4)
+	v, err := Metrics{ID: "PollCount", MType: "counter", Delta: &delta}.MetricValue()
+	assert.NoError(t, err)
+	assert.Equal(t, Counter(4), v)
+	assert.Equal(t, &delta, NewMetrics("PollCount", v).Delta)
+
+	_, err = Metrics{ID: "Alloc", MType: "gauge"}.MetricValue()
+	assert.Error(t, err)
+	_, err = Metrics{ID: "Alloc", MType: "unknown"}.MetricValue()
+	assert.ErrorIs(t, err, ErrUnknownType)
+}
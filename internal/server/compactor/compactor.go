@@ -0,0 +1,52 @@
+package compactor
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/ElizavetaFirst/go-metrics-alerts/internal/server/storage"
+)
+
+const compactInterval = time.Minute
+
+// Compactor periodically rolls raw samples up into coarser history tiers
+// and drops the points that outlived their tier's retention.
+type Compactor struct {
+	log     *zap.Logger
+	history storage.History
+	now     func() time.Time
+}
+
+func NewCompactor(history storage.History, log *zap.Logger) *Compactor {
+	return &Compactor{
+		log:     log,
+		history: history,
+		now:     time.Now,
+	}
+}
+
+func (c *Compactor) Run(ctx context.Context) error {
+	ticker := time.NewTicker(compactInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.Compact(ctx); err != nil {
+				c.log.Warn("can't compact history", zap.Error(err))
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (c *Compactor) Compact(ctx context.Context) error {
+	if err := c.history.Compact(ctx, c.now()); err != nil {
+		return fmt.Errorf("history Compact return error %w", err)
+	}
+	return nil
+}
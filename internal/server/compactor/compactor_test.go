@@ -0,0 +1,65 @@
+package compactor
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/ElizavetaFirst/go-metrics-alerts/internal/constants"
+	"github.com/ElizavetaFirst/go-metrics-alerts/internal/server/storage"
+)
+
+func TestCompactor_Compact(t *testing.T) {
+	ctx := context.Background()
+	start := time.Now().Add(-3 * time.Hour).Truncate(time.Hour)
+	h := storage.NewMemHistory()
+
+	var samples []storage.Sample
+	for i := 0; i < 120; i++ {
+		samples = append(samples, storage.Sample{
+			Time:  start.Add(time.Duration(i) * time.Second),
+			Name:  "PollCount",
+			Type:  constants.Counter,
+			Value: float64(i % 10),
+		})
+	}
+	assert.NoError(t, h.AppendSamples(ctx, samples))
+
+	now := start.Add(2 * time.Hour)
+	c := NewCompactor(h, zap.NewNop())
+	c.now = func() time.Time { return now }
+	assert.NoError(t, c.Compact(ctx))
+	// A second run must not count the same buckets twice.
+	assert.NoError(t, c.Compact(ctx))
+
+	opts := &storage.HistoryOptions{
+		From:       start,
+		To:         now,
+		MetricName: "PollCount",
+		MetricType: constants.Counter,
+		Step:       time.Minute,
+	}
+	resolution, points, err := h.QueryHistory(ctx, opts)
+	assert.NoError(t, err)
+	assert.Equal(t, storage.ResolutionMinute, resolution)
+	assert.Len(t, points, 2)
+	for _, p := range points {
+		assert.Equal(t, int64(60), p.Count)
+		assert.Equal(t, float64(0), p.Min)
+		assert.Equal(t, float64(9), p.Max)
+		assert.Equal(t, float64(270), p.Sum)
+		assert.Equal(t, float64(9), p.Last)
+	}
+
+	opts.Step = time.Hour
+	resolution, points, err = h.QueryHistory(ctx, opts)
+	assert.NoError(t, err)
+	assert.Equal(t, storage.ResolutionHour, resolution)
+	assert.Len(t, points, 1)
+	assert.Equal(t, int64(120), points[0].Count)
+	assert.Equal(t, float64(540), points[0].Sum)
+	assert.InDelta(t, 4.5, points[0].Avg(), 1e-9)
+}
@@ -1,12 +1,15 @@
 package handler
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"go.uber.org/zap"
 
@@ -21,11 +24,54 @@ const (
 	updateURL     = "/update/:metricType/:metricName/:metricValue"
 	metricTypeStr = "metricType"
 	metricNameStr = "metricName"
+
+	defaultListLimit = 100
+	maxListLimit     = 1000
+
+	defaultHistoryRange = time.Hour
+	maxHistoryPoints    = 1000
+)
+
+type (
+	listedMetric struct {
+		Value any    `json:"value"`
+		ID    string `json:"id"`
+		MType string `json:"type"`
+	}
+
+	listResponse struct {
+		Cursor  string         `json:"cursor,omitempty"`
+		Metrics []listedMetric `json:"metrics"`
+	}
+
+	listCursor struct {
+		ID    string `json:"id"`
+		MType string `json:"type"`
+	}
+
+	historyPoint struct {
+		Time  time.Time `json:"time"`
+		Sum   *float64  `json:"sum,omitempty"`
+		Min   float64   `json:"min"`
+		Max   float64   `json:"max"`
+		Avg   float64   `json:"avg"`
+		Last  float64   `json:"last"`
+		Count int64     `json:"count"`
+	}
+
+	historyResponse struct {
+		Resolution string         `json:"resolution"`
+		Points     []historyPoint `json:"points"`
+	}
 )
 
 type Handler struct {
 	Storage storage.Storage
-	log     *zap.Logger
+	// History is optional, the history endpoint answers 404 without it.
+	History storage.History
+	// Diagnostics are the named reports of the diagnostics endpoint.
+	Diagnostics map[string]func() any
+	log         *zap.Logger
 }
 
 func NewHandler(s storage.Storage, log *zap.Logger) *Handler {
@@ -44,38 +90,45 @@ func (h *Handler) RegisterRoutes(r *gin.Engine) {
 	r.GET("/value/:metricType/:metricName", logger.LogResponse(), h.handleGetValue)
 	r.GET("/", logger.LogResponse(), h.handleGetAllValues)
 	r.GET("/ping", logger.LogResponse(), h.handlePing)
+	r.GET("/api/v1/metrics", logger.LogResponse(), h.handleListMetrics)
+	r.DELETE("/value/:metricType/:metricName", logger.LogRequest(), h.handleDelete)
+	r.DELETE("/api/v1/metrics", logger.LogRequest(), h.handleDeleteMatching)
+	r.POST("/reset/:metricType/:metricName", logger.LogRequest(), h.handleReset)
+	r.GET("/api/v1/history/:metricType/:metricName", logger.LogResponse(), h.handleHistory)
+	r.GET("/api/v1/diagnostics", logger.LogResponse(), h.handleDiagnostics)
 }
 
 func (h *Handler) handleJSONUpdate(c *gin.Context) {
-	var metricType string
-	var metricName string
-	var metricValue any
-	var metrics metrics.Metrics
-	if err := c.ShouldBindJSON(&metrics); err != nil {
+	var metric metrics.Metrics
+	if err := c.ShouldBindJSON(&metric); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Bad Request: malformed JSON"})
 		return
 	}
 
-	metricName = metrics.ID
-	metricType = metrics.MType
-
-	switch metricType {
-	case constants.Gauge:
-		metricValue = *metrics.Value
-	case constants.Counter:
-		metricValue = *metrics.Delta
-	default:
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Bad Request: metricType should be gauge or counter"})
+	op, err := gaugeOp(metric.MType, metric.Op)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Bad Request: %v", err)})
+		return
+	}
+	value, err := metric.MetricValue()
+	if err != nil {
+		if errors.Is(err, metrics.ErrUnknownType) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Bad Request: metricType should be gauge, counter, histogram, summary or set"})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Bad Request: %v", err)})
 		return
 	}
 
 	if err := h.Storage.Update(c, &storage.UpdateOptions{
-		MetricName: metricName,
-		Update: storage.Metric{
-			Type:  storage.MetricType(metricType),
-			Value: metricValue,
-		},
+		MetricName: metric.ID,
+		Update:     storage.Metric{Value: value},
+		Op:         op,
 	}); err != nil {
+		if isIncompatibleUpdate(err) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Bad Request: %v", err)})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error updating metric"})
 		return
 	}
@@ -84,21 +137,29 @@ func (h *Handler) handleJSONUpdate(c *gin.Context) {
 }
 
 func (h *Handler) handleUpdate(c *gin.Context) {
-	var metricType string
-	var metricName string
-	var metricValue any
+	var metricValue metrics.Value
 
-	metricType = c.Param(metricTypeStr)
-	metricName = c.Param(metricNameStr)
+	metricType := c.Param(metricTypeStr)
+	metricName := c.Param(metricNameStr)
 	metricValueParam := c.Param("metricValue")
 	log.Println(metricType, metricName, metricValueParam)
 
-	var err error
+	op, err := gaugeOp(metricType, c.Query("op"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Bad Request: %v", err)})
+		return
+	}
 	switch metricType {
 	case constants.Gauge:
-		metricValue, err = strconv.ParseFloat(metricValueParam, 64)
+		var v float64
+		v, err = strconv.ParseFloat(metricValueParam, 64)
+		metricValue = metrics.Gauge(v)
 	case constants.Counter:
-		metricValue, err = strconv.ParseInt(metricValueParam, 10, 64)
+		var v int64
+		v, err = strconv.ParseInt(metricValueParam, 10, 64)
+		metricValue = metrics.Counter(v)
+	case constants.Set:
+		metricValue, err = metrics.Metrics{MType: metricType, Members: []string{metricValueParam}}.MetricValue()
 	default:
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Bad Request"})
 		return
@@ -110,10 +171,8 @@ func (h *Handler) handleUpdate(c *gin.Context) {
 	}
 	if err := h.Storage.Update(c, &storage.UpdateOptions{
 		MetricName: metricName,
-		Update: storage.Metric{
-			Type:  storage.MetricType(metricType),
-			Value: metricValue,
-		},
+		Update:     storage.Metric{Value: metricValue},
+		Op:         op,
 	}); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error updating metric"})
 		return
@@ -127,8 +186,8 @@ func (h *Handler) handleNotAllowed(c *gin.Context) {
 }
 
 func (h *Handler) handleJSONGetValue(c *gin.Context) {
-	var metrics metrics.Metrics
-	if err := c.ShouldBindJSON(&metrics); err != nil {
+	var metric metrics.Metrics
+	if err := c.ShouldBindJSON(&metric); err != nil {
 		h.log.Error("ShouldBindJSON return error",
 			zap.Error(err))
 		c.Status(http.StatusBadRequest)
@@ -136,12 +195,12 @@ func (h *Handler) handleJSONGetValue(c *gin.Context) {
 	}
 
 	value, err := h.Storage.Get(c, &storage.GetOptions{
-		MetricName: metrics.ID,
-		MetricType: metrics.MType,
+		MetricName: metric.ID,
+		MetricType: metric.MType,
 	})
 
 	if err != nil {
-		if errors.Is(err, storage.ErrMetricNotFound) || string(value.Type) != metrics.MType {
+		if errors.Is(err, storage.ErrMetricNotFound) {
 			c.Status(http.StatusNotFound)
 			return
 		}
@@ -151,76 +210,74 @@ func (h *Handler) handleJSONGetValue(c *gin.Context) {
 		return
 	}
 
-	if metrics.MType == constants.Counter {
-		delta, ok := value.Value.(int64)
-		if !ok {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid data type for Delta"})
-			return
-		}
-		metrics.Delta = &delta
-	} else if metrics.MType == constants.Gauge {
-		val, ok := value.Value.(float64)
-		if !ok {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid data type for Value"})
-			return
-		}
-		metrics.Value = &val
-	}
-
-	c.JSON(http.StatusOK, metrics)
+	c.JSON(http.StatusOK, metrics.NewMetrics(metric.ID, value.Value))
 }
 
 func (h *Handler) handleUpdates(c *gin.Context) {
-	var metrics []metrics.Metrics
+	var batch []metrics.Metrics
 
-	if err := c.BindJSON(&metrics); err != nil {
+	if err := c.BindJSON(&batch); err != nil {
 		h.log.Error("BindJSON return error",
 			zap.Error(err))
 		c.Status(http.StatusBadRequest)
 		return
 	}
 
-	metricsMap := make(map[string]storage.Metric)
-	for _, m := range metrics {
-		switch m.MType {
-		case constants.Gauge:
-			metricsMap[m.ID] = storage.Metric{
-				Value: m.Value,
-				Type:  storage.MetricType(m.MType),
+	metricsMap := make(map[storage.MetricKey]storage.Metric)
+	gaugeOps := make(map[storage.MetricKey]storage.GaugeOp)
+	for _, m := range batch {
+		op, err := gaugeOp(m.MType, m.Op)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Bad Request: %v", err)})
+			return
+		}
+		value, err := m.MetricValue()
+		if err != nil {
+			if errors.Is(err, metrics.ErrUnknownType) {
+				h.log.Error(
+					"metrics can be only counter, gauge, histogram, summary or set type, but this metric has incorrect type",
+					zap.String("MetricType", m.MType))
+				continue
 			}
+			h.log.Error("invalid metric", zap.String("MetricName", m.ID), zap.Error(err))
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Bad Request: %v", err)})
+			return
+		}
 
-		case constants.Counter:
-			if m.Delta != nil {
-				existingMetric, ok := metricsMap[m.ID]
-				if ok {
-					existingDelta, ok := existingMetric.Value.(*int64)
-					if !ok {
-						h.log.Error("all counter values must be int64")
-						continue
-					}
-					newDelta := *existingDelta + *m.Delta
-					existingMetric.Value = &newDelta
-					metricsMap[m.ID] = existingMetric
-				} else {
-					delta := *m.Delta
-					metricsMap[m.ID] = storage.Metric{
-						Value: &delta,
-						Type:  storage.MetricType(m.MType),
-					}
+		// A series sent several times in a batch is combined like the storage would.
+		key := storage.MetricKey{Name: m.ID, Type: storage.MetricType(m.MType)}
+		if existing, ok := metricsMap[key]; ok {
+			if gauge, isGauge := value.(metrics.Gauge); isGauge {
+				combined, v, ok := storage.CombineGaugeOps(
+					gaugeOps[key], float64(existing.Value.(metrics.Gauge)), op, float64(gauge))
+				if !ok {
+					c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf(
+						"Bad Request: can't apply %s after %s to gauge %s in one batch", op, gaugeOps[key], m.ID)})
+					return
 				}
+				op, value = combined, metrics.Gauge(v)
+			} else if value, err = metrics.Merge(existing.Value, value); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Bad Request: %v", err)})
+				return
 			}
-
-		default:
-			h.log.Error(
-				"metrics can be only counter or gauge type, but this metric has incorrect type",
-				zap.String("MetricType", m.MType))
+		}
+		metricsMap[key] = storage.Metric{Value: value}
+		if op != storage.GaugeSet {
+			gaugeOps[key] = op
+		} else {
+			delete(gaugeOps, key)
 		}
 	}
 
-	setAllOpts := storage.SetAllOptions{Metrics: metricsMap}
+	// The ops are part of the batch, so that it is applied as a whole.
+	setAllOpts := storage.SetAllOptions{Metrics: metricsMap, GaugeOps: gaugeOps}
 	err := h.Storage.SetAll(c.Request.Context(), &setAllOpts)
 
 	if err != nil {
+		if isIncompatibleUpdate(err) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Bad Request: %v", err)})
+			return
+		}
 		h.log.Error("SetAll return error",
 			zap.Error(err))
 		c.Status(http.StatusInternalServerError)
@@ -239,7 +296,7 @@ func (h *Handler) handleGetValue(c *gin.Context) {
 		MetricType: metricType,
 	})
 	if err != nil {
-		if errors.Is(err, storage.ErrMetricNotFound) || string(value.Type) != metricType {
+		if errors.Is(err, storage.ErrMetricNotFound) {
 			c.Status(http.StatusNotFound)
 			return
 		}
@@ -249,11 +306,18 @@ func (h *Handler) handleGetValue(c *gin.Context) {
 		return
 	}
 
-	c.String(http.StatusOK, "%v", value.Value)
+	switch v := value.Value.(type) {
+	case metrics.Histogram:
+		c.JSON(http.StatusOK, v.WithQuantiles())
+	case metrics.Sketch:
+		h.writeSummary(c, v)
+	default:
+		c.String(http.StatusOK, "%v", displayValue(v))
+	}
 }
 
 func (h *Handler) handleGetAllValues(c *gin.Context) {
-	values, err := h.Storage.GetAll(c)
+	values, err := h.Storage.List(c, &storage.ListOptions{})
 	if err != nil {
 		c.Status(http.StatusNotFound)
 		return
@@ -262,18 +326,285 @@ func (h *Handler) handleGetAllValues(c *gin.Context) {
 	var htmlResponse strings.Builder
 
 	htmlResponse.WriteString("<html><body>")
-	for name, metric := range values {
-		metricTypeStr := string(metric.Type)
-		metricName := strings.TrimSuffix(name, metricTypeStr)
-		htmlResponse.WriteString(fmt.Sprintf("<p>%s (%s): %v</p>", metricName, metric.Type, metric.Value))
+	for _, metric := range values {
+		htmlResponse.WriteString(fmt.Sprintf("<p>%s (%s): %v</p>", metric.Name, metric.Type(), displayValue(metric.Value)))
 	}
 	htmlResponse.WriteString("</body></html>")
 
 	c.Data(http.StatusOK, "text/html", []byte(htmlResponse.String()))
 }
 
+func (h *Handler) handleListMetrics(c *gin.Context) {
+	opts := storage.ListOptions{
+		MetricType: c.Query("type"),
+		Match:      c.Query("match"),
+		Limit:      defaultListLimit,
+	}
+
+	switch opts.MetricType {
+	case "", constants.Gauge, constants.Counter, constants.Histogram, constants.Summary, constants.Set:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Bad Request: type should be gauge, counter, histogram, summary or set"})
+		return
+	}
+
+	if limitParam := c.Query("limit"); limitParam != "" {
+		limit, err := strconv.Atoi(limitParam)
+		if err != nil || limit <= 0 || limit > maxListLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Bad Request: limit should be in 1..%d", maxListLimit)})
+			return
+		}
+		opts.Limit = limit
+	}
+
+	if cursorParam := c.Query("cursor"); cursorParam != "" {
+		cursor, err := decodeListCursor(cursorParam)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Bad Request: malformed cursor"})
+			return
+		}
+		opts.AfterName = cursor.ID
+		opts.AfterType = cursor.MType
+	}
+
+	// One extra metric tells whether there is a next page.
+	pageLimit := opts.Limit
+	opts.Limit++
+	values, err := h.Storage.List(c, &opts)
+	if err != nil {
+		h.log.Error("List return error",
+			zap.Error(err))
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	response := listResponse{Metrics: make([]listedMetric, 0, len(values))}
+	if len(values) > pageLimit {
+		values = values[:pageLimit]
+		last := values[len(values)-1]
+		response.Cursor = encodeListCursor(listCursor{ID: last.Name, MType: string(last.Type())})
+	}
+	for _, v := range values {
+		response.Metrics = append(response.Metrics, listedMetric{
+			ID:    v.Name,
+			MType: string(v.Type()),
+			Value: displayValue(v.Value),
+		})
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// writeSummary answers with one quantile when q is given, and with the whole
+// sketch and its usual quantiles otherwise.
+func (h *Handler) writeSummary(c *gin.Context, sketch metrics.Sketch) {
+	qParam := c.Query("q")
+	if qParam == "" {
+		c.JSON(http.StatusOK, sketch.WithQuantiles())
+		return
+	}
+	q, err := strconv.ParseFloat(qParam, 64)
+	if err != nil || q < 0 || q > 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Bad Request: q should be in [0, 1]"})
+		return
+	}
+	c.String(http.StatusOK, "%v", sketch.Quantile(q))
+}
+
+func gaugeOp(metricType, op string) (storage.GaugeOp, error) {
+	if op != "" && metricType != constants.Gauge {
+		return storage.GaugeSet, errors.New("op is only supported for gauges")
+	}
+	gaugeOp, err := storage.ParseGaugeOp(op)
+	if err != nil {
+		return storage.GaugeSet, fmt.Errorf("invalid op %w", err)
+	}
+	return gaugeOp, nil
+}
+
+// displayValue shows a set as its distinct count rather than its registers.
+func displayValue(v metrics.Value) any {
+	if set, ok := v.(metrics.HyperLogLog); ok {
+		return set.Count()
+	}
+	return v
+}
+
+// isIncompatibleUpdate reports whether the update was rejected because of
+// the data the client sent rather than a storage failure.
+func isIncompatibleUpdate(err error) bool {
+	return errors.Is(err, metrics.ErrHistogramBounds) ||
+		errors.Is(err, metrics.ErrSketchAlpha) ||
+		errors.Is(err, metrics.ErrSketchBins) ||
+		errors.Is(err, metrics.ErrHyperLogLogRegisters) ||
+		errors.Is(err, metrics.ErrTypeMismatch) ||
+		errors.Is(err, storage.ErrIncorrectType)
+}
+
+func encodeListCursor(cursor listCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeListCursor(s string) (listCursor, error) {
+	var cursor listCursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return cursor, fmt.Errorf("can't decode cursor %w", err)
+	}
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return cursor, fmt.Errorf("can't unmarshal cursor %w", err)
+	}
+	return cursor, nil
+}
+
+func (h *Handler) handleDelete(c *gin.Context) {
+	err := h.Storage.Delete(c, &storage.DeleteOptions{
+		MetricName: c.Param(metricNameStr),
+		MetricType: c.Param(metricTypeStr),
+	})
+	if err != nil {
+		if errors.Is(err, storage.ErrMetricNotFound) {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		h.log.Error("Delete return error",
+			zap.Error(err))
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+func (h *Handler) handleDeleteMatching(c *gin.Context) {
+	opts := storage.DeleteMatchingOptions{
+		MetricType: c.Query("type"),
+		Match:      c.Query("match"),
+	}
+	if opts.Match == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Bad Request: match is required, use * to delete everything"})
+		return
+	}
+
+	deleted, err := h.Storage.DeleteMatching(c, &opts)
+	if err != nil {
+		h.log.Error("DeleteMatching return error",
+			zap.Error(err))
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"deleted": deleted})
+}
+
+func (h *Handler) handleReset(c *gin.Context) {
+	err := h.Storage.Reset(c, &storage.ResetOptions{
+		MetricName: c.Param(metricNameStr),
+		MetricType: c.Param(metricTypeStr),
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrIncorrectType):
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Bad Request: only counters can be reset"})
+		case errors.Is(err, storage.ErrMetricNotFound):
+			c.Status(http.StatusNotFound)
+		default:
+			h.log.Error("Reset return error",
+				zap.Error(err))
+			c.Status(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+func (h *Handler) handleHistory(c *gin.Context) {
+	if h.History == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "history is disabled"})
+		return
+	}
+
+	opts := storage.HistoryOptions{
+		MetricName: c.Param(metricNameStr),
+		MetricType: c.Param(metricTypeStr),
+		To:         time.Now(),
+	}
+	var err error
+	if to := c.Query("to"); to != "" {
+		if opts.To, err = time.Parse(time.RFC3339, to); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Bad Request: to should be RFC 3339 time"})
+			return
+		}
+	}
+	opts.From = opts.To.Add(-defaultHistoryRange)
+	if from := c.Query("from"); from != "" {
+		if opts.From, err = time.Parse(time.RFC3339, from); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Bad Request: from should be RFC 3339 time"})
+			return
+		}
+	}
+	if !opts.From.Before(opts.To) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Bad Request: from should be before to"})
+		return
+	}
+	opts.Step = (opts.To.Sub(opts.From) / maxHistoryPoints).Truncate(time.Second)
+	if step := c.Query("step"); step != "" {
+		if opts.Step, err = time.ParseDuration(step); err != nil || opts.Step < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Bad Request: step should be a duration"})
+			return
+		}
+	}
+
+	resolution, points, err := h.History.QueryHistory(c, &opts)
+	if err != nil {
+		h.log.Error("QueryHistory return error",
+			zap.Error(err))
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	response := historyResponse{
+		Resolution: resolution.String(),
+		Points:     make([]historyPoint, 0, len(points)),
+	}
+	for _, p := range points {
+		hp := historyPoint{
+			Time:  p.Time,
+			Min:   p.Min,
+			Max:   p.Max,
+			Avg:   p.Avg(),
+			Last:  p.Last,
+			Count: p.Count,
+		}
+		if opts.MetricType == constants.Counter {
+			sum := p.Sum
+			hp.Sum = &sum
+		}
+		response.Points = append(response.Points, hp)
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+func (h *Handler) handleDiagnostics(c *gin.Context) {
+	report := make(map[string]any, len(h.Diagnostics))
+	for name, diagnose := range h.Diagnostics {
+		report[name] = diagnose()
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// handlePing answers 200 with "degraded" while the metrics are served from
+// memory, the server is up and keeps the writes for the database.
 func (h *Handler) handlePing(c *gin.Context) {
 	err := h.Storage.Ping(c)
+	if errors.Is(err, storage.ErrDegraded) {
+		h.log.Warn("Ping: storage is degraded", zap.Error(err))
+		c.String(http.StatusOK, "degraded")
+		return
+	}
 	if err != nil {
 		h.log.Error("Ping return error",
 			zap.Error(err))
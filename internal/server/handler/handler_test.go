@@ -1,12 +1,21 @@
 package handler
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/ElizavetaFirst/go-metrics-alerts/internal/metrics"
 	"github.com/ElizavetaFirst/go-metrics-alerts/internal/server/storage"
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
@@ -119,3 +128,360 @@ func TestSendCounterMetricsJson(t *testing.T) {
 		t.Errorf("Wrong status code: got %v want %v", status, http.StatusOK)
 	}
 }
+
+// testRouter serves the routes of a handler over a storage.
+type testRouter struct {
+	*gin.Engine
+	h *Handler
+}
+
+func newTestRouter(t *testing.T, s storage.Storage) *testRouter {
+	t.Helper()
+	h := NewHandler(s, zap.NewNop())
+	r := &testRouter{Engine: gin.Default(), h: h}
+	h.RegisterRoutes(r.Engine)
+	return r
+}
+
+func (r *testRouter) do(method, url, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(method, url, strings.NewReader(body)))
+	return rec
+}
+
+func (r *testRouter) get(url string) *httptest.ResponseRecorder {
+	return r.do(http.MethodGet, url, "")
+}
+
+// post returns the status of the response.
+func (r *testRouter) post(url, body string) int {
+	return r.do(http.MethodPost, url, body).Code
+}
+
+func TestHandler_ListMetrics(t *testing.T) {
+	r := newTestRouter(t, storage.NewMemStorage(zap.NewNop()))
+
+	for _, url := range []string{
+		"/update/gauge/HeapAlloc/1.5",
+		"/update/gauge/HeapSys/2",
+		"/update/counter/HeapAlloc/3",
+		"/update/counter/PollCount/4",
+	} {
+		assert.Equal(t, http.StatusOK, r.post(url, ""))
+	}
+
+	get := func(url string) listResponse {
+		t.Helper()
+		rec := r.get(url)
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		var resp listResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := get("/api/v1/metrics?match=Heap*&limit=2")
+	assert.Equal(t, []listedMetric{
+		{ID: "HeapAlloc", MType: "counter", Value: float64(3)},
+		{ID: "HeapAlloc", MType: "gauge", Value: 1.5},
+	}, resp.Metrics)
+	assert.NotEmpty(t, resp.Cursor)
+
+	resp = get("/api/v1/metrics?match=Heap*&limit=2&cursor=" + resp.Cursor)
+	assert.Equal(t, []listedMetric{
+		{ID: "HeapSys", MType: "gauge", Value: float64(2)},
+	}, resp.Metrics)
+	assert.Empty(t, resp.Cursor)
+
+	resp = get("/api/v1/metrics?type=counter")
+	assert.Len(t, resp.Metrics, 2)
+
+	for _, url := range []string{
+		"/api/v1/metrics?type=unknown",
+		"/api/v1/metrics?limit=0",
+		"/api/v1/metrics?cursor=not-a-cursor!",
+	} {
+		assert.Equal(t, http.StatusBadRequest, r.get(url).Code, url)
+	}
+}
+
+func TestHandler_DeleteAndReset(t *testing.T) {
+	r := newTestRouter(t, storage.NewMemStorage(zap.NewNop()))
+
+	tests := []struct {
+		name           string
+		method         string
+		url            string
+		expectedStatus int
+	}{
+		{"Add counter", http.MethodPost, "/update/counter/PollCount/5", http.StatusOK},
+		{"Add gauge", http.MethodPost, "/update/gauge/HeapAlloc/1.5", http.StatusOK},
+		{"Add another gauge", http.MethodPost, "/update/gauge/HeapSys/2", http.StatusOK},
+		{"Reset counter", http.MethodPost, "/reset/counter/PollCount", http.StatusOK},
+		{"Reset gauge", http.MethodPost, "/reset/gauge/HeapAlloc", http.StatusBadRequest},
+		{"Reset missing counter", http.MethodPost, "/reset/counter/Missing", http.StatusNotFound},
+		{"Delete gauge", http.MethodDelete, "/value/gauge/HeapAlloc", http.StatusOK},
+		{"Get deleted gauge", http.MethodGet, "/value/gauge/HeapAlloc", http.StatusNotFound},
+		{"Delete deleted gauge", http.MethodDelete, "/value/gauge/HeapAlloc", http.StatusNotFound},
+		{"Delete matching without pattern", http.MethodDelete, "/api/v1/metrics", http.StatusBadRequest},
+		{"Delete matching", http.MethodDelete, "/api/v1/metrics?match=Heap*", http.StatusOK},
+		{"Get deleted by pattern gauge", http.MethodGet, "/value/gauge/HeapSys", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.expectedStatus, r.do(tt.method, tt.url, "").Code, tt.name)
+	}
+
+	assert.Equal(t, "0", r.get("/value/counter/PollCount").Body.String())
+}
+
+func TestHandler_History(t *testing.T) {
+	r := newTestRouter(t, storage.NewMemStorage(zap.NewNop()))
+	assert.Equal(t, http.StatusNotFound, r.get("/api/v1/history/counter/Hits").Code)
+
+	history := storage.NewMemHistory()
+	r.h.History = history
+	now := time.Now()
+	minute := now.Add(-10 * time.Minute).Truncate(time.Minute)
+	err := history.AppendSamples(context.Background(), []storage.Sample{
+		{Time: minute.Add(time.Second), Name: "Hits", Type: storage.Counter, Value: 2},
+		{Time: minute.Add(30 * time.Second), Name: "Hits", Type: storage.Counter, Value: 3},
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, history.Compact(context.Background(), now))
+
+	for _, url := range []string{
+		"/api/v1/history/counter/Hits?to=yesterday",
+		"/api/v1/history/counter/Hits?from=yesterday",
+		"/api/v1/history/counter/Hits?from=" + now.Add(time.Hour).Format(time.RFC3339),
+		"/api/v1/history/counter/Hits?step=often",
+		"/api/v1/history/counter/Hits?step=-1m",
+	} {
+		assert.Equal(t, http.StatusBadRequest, r.get(url).Code, url)
+	}
+
+	query := func(params string) historyResponse {
+		rec := r.get("/api/v1/history/counter/Hits?" + params)
+		assert.Equal(t, http.StatusOK, rec.Code, params)
+		var resp historyResponse
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		return resp
+	}
+	at := func(d time.Duration) string {
+		return "from=" + url.QueryEscape(now.Add(-d).Format(time.RFC3339))
+	}
+
+	// The last hour at the default step is served from the raw samples.
+	resp := query("")
+	assert.Equal(t, "raw", resp.Resolution)
+	assert.Len(t, resp.Points, 2)
+
+	// A step of a minute or more is served from the minute rollup.
+	resp = query("step=1m")
+	assert.Equal(t, "1m0s", resp.Resolution)
+	if assert.Len(t, resp.Points, 1) {
+		assert.Equal(t, int64(2), resp.Points[0].Count)
+		if assert.NotNil(t, resp.Points[0].Sum) {
+			assert.Equal(t, 5.0, *resp.Points[0].Sum)
+		}
+	}
+
+	// Ranges older than a tier's retention fall back to a coarser tier.
+	assert.Equal(t, "1m0s", query(at(2*24*time.Hour)+"&step=0s").Resolution)
+	assert.Equal(t, "1h0m0s", query(at(60*24*time.Hour)+"&step=0s").Resolution)
+}
+
+func TestHandler_Histogram(t *testing.T) {
+	r := newTestRouter(t, storage.NewMemStorage(zap.NewNop()))
+
+	update := `{"id":"Latency","type":"histogram","histogram":` +
+		`{"bounds":[1,2,4],"counts":[1,2,1,0],"sum":6,"count":4}}`
+	assert.Equal(t, http.StatusOK, r.post("/update", update))
+	assert.Equal(t, http.StatusOK, r.post("/update", update))
+	assert.Equal(t, http.StatusOK, r.post("/updates/", "["+update+","+update+"]"))
+	assert.Equal(t, http.StatusBadRequest, r.post("/update",
+		`{"id":"Latency","type":"histogram","histogram":{"bounds":[1],"counts":[1,0],"sum":1,"count":1}}`))
+	assert.Equal(t, http.StatusBadRequest, r.post("/update",
+		`{"id":"Broken","type":"histogram","histogram":{"bounds":[1],"counts":[1],"sum":1,"count":1}}`))
+
+	rec := r.get("/value/histogram/Latency")
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var got metrics.Histogram
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	// Two single updates and a batch of two land in the same series.
+	assert.Equal(t, []uint64{4, 8, 4, 0}, got.Counts)
+	assert.Equal(t, uint64(16), got.Count)
+	assert.InDelta(t, 1.5, got.Quantiles["p50"], 1e-9)
+	assert.Contains(t, got.Quantiles, "p99")
+}
+
+func TestHandler_Summary(t *testing.T) {
+	r := newTestRouter(t, storage.NewMemStorage(zap.NewNop()))
+
+	// Two agents observe the odd and the even latencies from 1 to 1000.
+	for agent := 0; agent < 2; agent++ {
+		sketch := metrics.NewSketch(metrics.DefaultSketchAlpha)
+		for v := 1 + agent; v <= 1000; v += 2 {
+			sketch.Add(float64(v))
+		}
+		body, err := json.Marshal(metrics.Metrics{ID: "Latency", MType: "summary", Sketch: &sketch})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, http.StatusOK, r.post("/update", string(body)))
+	}
+
+	rec := r.get("/value/summary/Latency?q=0.99")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	p99, err := strconv.ParseFloat(rec.Body.String(), 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.InDelta(t, 990, p99, 990*2*metrics.DefaultSketchAlpha)
+
+	assert.Equal(t, http.StatusBadRequest, r.get("/value/summary/Latency?q=2").Code)
+	assert.Equal(t, http.StatusBadRequest,
+		r.post("/update", `{"id":"Latency","type":"summary","sketch":{"alpha":0.05,"count":0}}`))
+}
+
+func TestHandler_Set(t *testing.T) {
+	r := newTestRouter(t, storage.NewMemStorage(zap.NewNop()))
+
+	// Two agents report overlapping users, 150 distinct ones in total.
+	for agent := 0; agent < 2; agent++ {
+		members := make([]string, 0, 100)
+		for i := agent * 50; i < agent*50+100; i++ {
+			members = append(members, fmt.Sprintf("user-%d", i))
+		}
+		body, err := json.Marshal(metrics.Metrics{ID: "Users", MType: "set", Members: members})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, http.StatusOK, r.post("/update", string(body)))
+	}
+	assert.Equal(t, http.StatusOK, r.post("/update/set/Users/user-0", ""))
+
+	rec := r.get("/value/set/Users")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	count, err := strconv.ParseFloat(rec.Body.String(), 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.InDelta(t, 150, count, 3)
+
+	rec = r.do(http.MethodPost, "/value/", `{"id":"Users","type":"set"}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var got metrics.Metrics
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &got))
+	if assert.NotNil(t, got.Count) {
+		assert.InDelta(t, 150, float64(*got.Count), 3)
+	}
+
+	assert.Equal(t, http.StatusBadRequest, r.post("/update", `{"id":"Users","type":"set"}`))
+}
+
+func TestHandler_GaugeOps(t *testing.T) {
+	r := newTestRouter(t, storage.NewMemStorage(zap.NewNop()))
+	post := r.post
+	get := func(name string) string {
+		return r.get("/value/gauge/" + name).Body.String()
+	}
+
+	// Concurrent producers must not lose each other's increments.
+	assert.Equal(t, http.StatusOK, post("/update", `{"id":"QueueDepth","type":"gauge","value":100}`))
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			post("/update", `{"id":"QueueDepth","type":"gauge","op":"add","value":-3}`)
+			post("/update/gauge/QueueDepth/1?op=add", "")
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, "0", get("QueueDepth"))
+
+	assert.Equal(t, http.StatusOK, post("/updates/", `[
+		{"id":"Peak","type":"gauge","op":"max","value":5},
+		{"id":"Peak","type":"gauge","op":"max","value":9},
+		{"id":"Peak","type":"gauge","op":"max","value":7},
+		{"id":"Low","type":"gauge","op":"min","value":3},
+		{"id":"Low","type":"gauge","value":10},
+		{"id":"Low","type":"gauge","op":"min","value":4}
+	]`))
+	assert.Equal(t, "9", get("Peak"))
+	assert.Equal(t, "4", get("Low"))
+
+	// Ops that don't fold into one refuse the whole batch.
+	assert.Equal(t, http.StatusBadRequest, post("/updates/", `[
+		{"id":"Peak","type":"gauge","op":"add","value":1},
+		{"id":"Peak","type":"gauge","op":"max","value":20}
+	]`))
+	assert.Equal(t, "9", get("Peak"))
+	assert.Equal(t, http.StatusOK, post("/updates/", `[
+		{"id":"Peak","type":"gauge","value":1},
+		{"id":"Peak","type":"gauge","op":"add","value":2},
+		{"id":"Low","type":"gauge","op":"add","value":1},
+		{"id":"Low","type":"gauge","op":"add","value":2}
+	]`))
+	assert.Equal(t, "3", get("Peak"))
+	assert.Equal(t, "7", get("Low"))
+
+	assert.Equal(t, http.StatusBadRequest, post("/update", `{"id":"Peak","type":"gauge","op":"mul","value":2}`))
+	assert.Equal(t, http.StatusBadRequest, post("/update", `{"id":"Hits","type":"counter","op":"add","delta":2}`))
+}
+
+func TestHandler_UpdatesKeepSeriesApart(t *testing.T) {
+	r := newTestRouter(t, storage.NewMemStorage(zap.NewNop()))
+
+	assert.Equal(t, http.StatusOK, r.post("/updates/", `[
+		{"id":"Alloc","type":"gauge","value":1.5},
+		{"id":"Alloc","type":"counter","delta":2},
+		{"id":"foogauge","type":"counter","delta":3},
+		{"id":"foo","type":"gauge","value":4}
+	]`))
+
+	for url, want := range map[string]string{
+		"/value/gauge/Alloc":      "1.5",
+		"/value/counter/Alloc":    "2",
+		"/value/counter/foogauge": "3",
+		"/value/gauge/foo":        "4",
+	} {
+		rec := r.get(url)
+		assert.Equal(t, http.StatusOK, rec.Code, url)
+		assert.Equal(t, want, rec.Body.String(), url)
+	}
+}
+
+func TestHandler_Diagnostics(t *testing.T) {
+	cache := storage.WithCache(storage.NewMemStorage(zap.NewNop()), time.Minute)
+	r := newTestRouter(t, cache)
+	r.h.Diagnostics = map[string]func() any{
+		"cache": func() any { return cache.Stats() },
+	}
+
+	assert.Equal(t, http.StatusOK, r.post("/update/gauge/Alloc/1", ""))
+	for _, url := range []string{"/value/gauge/Alloc", "/value/gauge/Alloc", "/"} {
+		assert.Equal(t, http.StatusOK, r.get(url).Code, url)
+	}
+
+	rec := r.get("/api/v1/diagnostics")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"cache":{"hits":1,"misses":2}}`, rec.Body.String())
+}
+
+func TestHandler_PingDegraded(t *testing.T) {
+	connect := func(context.Context) (storage.Storage, error) {
+		return nil, errors.New("connection refused")
+	}
+	r := newTestRouter(t, storage.NewFallback(context.Background(), connect, nil, 0, zap.NewNop()))
+
+	rec := r.get("/ping")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "degraded", rec.Body.String())
+}
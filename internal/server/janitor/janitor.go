@@ -0,0 +1,70 @@
+package janitor
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/ElizavetaFirst/go-metrics-alerts/internal/server/storage"
+)
+
+const maxSweepInterval = time.Minute
+
+// Janitor removes series whose last update is older than the TTL.
+type Janitor struct {
+	log           *zap.Logger
+	storage       storage.Storage
+	now           func() time.Time
+	ttl           time.Duration
+	sweepInterval time.Duration
+	dryRun        bool
+}
+
+func NewJanitor(ttl time.Duration, dryRun bool, storage storage.Storage, log *zap.Logger) *Janitor {
+	return &Janitor{
+		log:           log,
+		storage:       storage,
+		now:           time.Now,
+		ttl:           ttl,
+		sweepInterval: min(ttl, maxSweepInterval),
+		dryRun:        dryRun,
+	}
+}
+
+func (j *Janitor) Run(ctx context.Context) error {
+	ticker := time.NewTicker(j.sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := j.Sweep(ctx); err != nil {
+				j.log.Warn("can't sweep stale metrics", zap.Error(err))
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Sweep expires stale series once and returns how many were expired,
+// or would have been in dry-run mode.
+func (j *Janitor) Sweep(ctx context.Context) (int64, error) {
+	expired, err := j.storage.DeleteStale(ctx, &storage.DeleteStaleOptions{
+		Before: j.now().Add(-j.ttl),
+		DryRun: j.dryRun,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("DeleteStale return error %w", err)
+	}
+
+	if expired > 0 || j.dryRun {
+		j.log.Info("stale metrics expired",
+			zap.Int64("expired", expired),
+			zap.Duration("ttl", j.ttl),
+			zap.Bool("dryRun", j.dryRun))
+	}
+	return expired, nil
+}
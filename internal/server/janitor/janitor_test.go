@@ -0,0 +1,72 @@
+package janitor
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/ElizavetaFirst/go-metrics-alerts/internal/constants"
+	"github.com/ElizavetaFirst/go-metrics-alerts/internal/metrics"
+	"github.com/ElizavetaFirst/go-metrics-alerts/internal/server/storage"
+)
+
+func TestJanitor_Sweep(t *testing.T) {
+	ctx := context.Background()
+	ms := storage.NewMemStorage(zap.NewNop())
+	for _, name := range []string{"fresh", "stale"} {
+		err := ms.Update(ctx, &storage.UpdateOptions{
+			MetricName: name,
+			Update:     storage.Metric{Value: metrics.Gauge(1)},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	staleUpdate := time.Now().Add(-2 * time.Hour)
+	err := ms.SetAll(ctx, &storage.SetAllOptions{Metrics: map[storage.MetricKey]storage.Metric{
+		{Name: "stale", Type: constants.Gauge}: {Value: metrics.Gauge(1), UpdatedAt: staleUpdate},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dryRun := NewJanitor(time.Hour, true, ms, zap.NewNop())
+	expired, err := dryRun.Sweep(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), expired)
+	_, err = ms.Get(ctx, &storage.GetOptions{MetricName: "stale", MetricType: constants.Gauge})
+	assert.NoError(t, err, "dry run must not delete metrics")
+
+	j := NewJanitor(time.Hour, false, ms, zap.NewNop())
+	expired, err = j.Sweep(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), expired)
+	_, err = ms.Get(ctx, &storage.GetOptions{MetricName: "stale", MetricType: constants.Gauge})
+	assert.ErrorIs(t, err, storage.ErrMetricNotFound)
+	_, err = ms.Get(ctx, &storage.GetOptions{MetricName: "fresh", MetricType: constants.Gauge})
+	assert.NoError(t, err)
+}
+
+func TestJanitor_SweepHistogram(t *testing.T) {
+	ctx := context.Background()
+	ms := storage.NewMemStorage(zap.NewNop())
+	err := ms.SetAll(ctx, &storage.SetAllOptions{Metrics: map[storage.MetricKey]storage.Metric{
+		{Name: "Latency", Type: constants.Histogram}: {
+			Value:     metrics.Histogram{Bounds: []float64{1}, Counts: []uint64{1, 0}, Sum: 0.5, Count: 1},
+			UpdatedAt: time.Now().Add(-2 * time.Hour),
+		},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	j := NewJanitor(time.Hour, false, ms, zap.NewNop())
+	expired, err := j.Sweep(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), expired)
+	_, err = ms.Get(ctx, &storage.GetOptions{MetricName: "Latency", MetricType: constants.Histogram})
+	assert.ErrorIs(t, err, storage.ErrMetricNotFound)
+}
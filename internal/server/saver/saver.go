@@ -2,11 +2,8 @@ package saver
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
-	"os"
 	"sync"
 	"time"
 
@@ -16,72 +13,110 @@ import (
 	"github.com/ElizavetaFirst/go-metrics-alerts/internal/server/storage"
 )
 
-const failedCloseFile = "Failed to close file: %v"
-
 type Saver struct {
-	log             *zap.Logger
-	storage         storage.Storage
-	fileStoragePath string
-	storeInterval   time.Duration
-	restore         bool
+	mu            sync.Mutex
+	snapshots     snapshotQueue
+	log           *zap.Logger
+	storage       storage.Storage
+	file          snapshotFile
+	now           func() time.Time
+	storeInterval time.Duration
+	restore       bool
+	// restoreFailed keeps an empty storage from replacing a snapshot that
+	// couldn't be loaded, until something is written.
+	restoreFailed bool
 }
 
+// NewSaver keeps the given number of snapshot generations, the latest
+// one included.
 func NewSaver(storeInterval int,
 	fileStoragePath string,
+	generations int,
 	restore bool,
 	storage storage.Storage,
 	log *zap.Logger,
 ) *Saver {
 	return &Saver{
-		storeInterval:   time.Duration(storeInterval) * time.Second,
-		fileStoragePath: fileStoragePath,
-		restore:         restore,
-		storage:         storage,
+		storeInterval: time.Duration(storeInterval) * time.Second,
+		file:          snapshotFile{path: fileStoragePath, generations: max(generations, 1)},
+		now:           time.Now,
+		restore:       restore,
+		storage:       storage,
+		log:           log,
 	}
 }
 
 func (s *Saver) getAndSaveMetrics(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	metrics, err := s.storage.GetAll(ctx)
 	if err != nil {
 		s.log.Warn("can't GetAll metrics", zap.Error(err))
+		return fmt.Errorf("can't GetAll metrics %w", err)
 	}
-	if len(metrics) == 0 {
-		return nil
+	if s.restoreFailed {
+		if len(metrics) == 0 {
+			s.log.Warn("not replacing the snapshot that failed to load with an empty one",
+				zap.String("fileStoragePath", s.file.path))
+			return nil
+		}
+		s.restoreFailed = false
 	}
 
-	if err := saveMetricsToFile(metrics, s.fileStoragePath); err != nil {
+	if err := s.file.save(metrics, s.now()); err != nil {
 		s.log.Warn("can't save metrics to file",
-			zap.String("fileStoragePath", s.fileStoragePath))
+			zap.String("fileStoragePath", s.file.path), zap.Error(err))
 		return err
 	}
 	return nil
 }
 
-func (s *Saver) Run(ctx context.Context, wg *sync.WaitGroup) error {
-	wg.Add(1)
-	defer wg.Done()
-
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
+// Restore loads the snapshot into the storage if restoring is enabled.
+// It must be called before the storage starts receiving writes. A snapshot
+// that can't be loaded is logged and the storage starts empty.
+func (s *Saver) Restore(ctx context.Context) error {
+	return s.restoreSnapshot(ctx, false)
+}
 
-	defer func() {
-		if err := s.getAndSaveMetrics(ctx); err != nil {
-			s.log.Warn("can't save metrics on interrupt signal", zap.Error(err))
-		}
-	}()
+// RestoreStrict is Restore failing when the snapshot can't be loaded, for
+// the commands that would otherwise work on no metrics and succeed.
+func (s *Saver) RestoreStrict(ctx context.Context) error {
+	return s.restoreSnapshot(ctx, true)
+}
 
-	if s.restore {
-		metrics, err := loadMetricsFromFile(s.fileStoragePath)
-		if err != nil {
-			s.log.Warn("cannot load metrics from file", zap.Error(err))
-		}
-		err = s.storage.SetAll(ctx, &storage.SetAllOptions{Metrics: metrics})
-		if err != nil {
-			s.log.Warn("cannot set all metrics", zap.Error(err))
-			return fmt.Errorf("cannot set all metrics: %w", err)
+func (s *Saver) restoreSnapshot(ctx context.Context, strict bool) error {
+	if !s.restore {
+		return nil
+	}
+	metrics, path, err := s.file.load()
+	if err != nil {
+		if strict {
+			return fmt.Errorf("cannot load metrics from file: %w", err)
 		}
+		s.log.Warn("cannot load metrics from file", zap.Error(err))
+		s.mu.Lock()
+		s.restoreFailed = true
+		s.mu.Unlock()
+	} else if path != "" && path != s.file.path {
+		s.log.Warn("restored metrics from an older snapshot", zap.String("path", path))
+	}
+	err = s.storage.SetAll(ctx, &storage.SetAllOptions{Metrics: metrics})
+	if err != nil {
+		s.log.Warn("cannot set all metrics", zap.Error(err))
+		return fmt.Errorf("cannot set all metrics: %w", err)
 	}
+	return nil
+}
 
+// Run saves metrics periodically until ctx is cancelled. The final snapshot
+// is left to Flush so that it can be taken after the writers have stopped.
+// With a zero interval the writes are saved by Storage and Run only waits.
+func (s *Saver) Run(ctx context.Context) error {
+	if s.synchronous() {
+		<-ctx.Done()
+		return nil
+	}
 	ticker := time.NewTicker(s.storeInterval)
 	defer ticker.Stop()
 
@@ -99,58 +134,15 @@ func (s *Saver) Run(ctx context.Context, wg *sync.WaitGroup) error {
 				return errors.New("too many errors in Saver:Run")
 			}
 		case <-ctx.Done():
-			if err := s.getAndSaveMetrics(ctx); err != nil {
-				s.log.Warn("can't save metrics when closing Saver",
-					zap.Error(err))
-			}
-			return fmt.Errorf("saver run() context return error %w", ctx.Err())
+			return nil
 		}
 	}
 }
 
-func saveMetricsToFile(metrics map[string]storage.Metric, filePath string) error {
-	file, err := os.Create(filePath)
-	if err != nil {
-		return fmt.Errorf("failed to create file: %w", err)
+// Flush writes the current state of the storage to the file.
+func (s *Saver) Flush(ctx context.Context) error {
+	if err := s.getAndSaveMetrics(ctx); err != nil {
+		return fmt.Errorf("can't flush metrics %w", err)
 	}
-
-	defer func() {
-		closeErr := file.Close()
-		if closeErr != nil {
-			log.Printf(failedCloseFile, closeErr)
-		}
-	}()
-
-	encoder := json.NewEncoder(file)
-	if err := encoder.Encode(metrics); err != nil {
-		return fmt.Errorf("failed to encode metrics: %w", err)
-	}
-
 	return nil
 }
-
-func loadMetricsFromFile(filePath string) (map[string]storage.Metric, error) {
-	metrics := make(map[string]storage.Metric)
-
-	file, err := os.Open(filePath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return metrics, nil
-		} else {
-			return nil, fmt.Errorf("failed to open file: %w", err)
-		}
-	}
-
-	defer func() {
-		closeErr := file.Close()
-		if closeErr != nil {
-			log.Printf(failedCloseFile, closeErr)
-		}
-	}()
-
-	decoder := json.NewDecoder(file)
-	if err := decoder.Decode(&metrics); err != nil {
-		return nil, fmt.Errorf("failed to decode file: %w", err)
-	}
-	return metrics, nil
-}
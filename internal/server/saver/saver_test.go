@@ -1,83 +1,413 @@
 package saver
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
+	"hash/crc32"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
+
+	"go.uber.org/zap"
 
 	"github.com/ElizavetaFirst/go-metrics-alerts/internal/constants"
+	"github.com/ElizavetaFirst/go-metrics-alerts/internal/metrics"
 	"github.com/ElizavetaFirst/go-metrics-alerts/internal/server/storage"
 )
 
-func Test_saveMetricsToFile(t *testing.T) {
-	filePath := "/tmp/metrics-db.json"
+func loadSnapshot(t *testing.T, filePath string) map[storage.MetricKey]storage.Metric {
+	t.Helper()
+	metrics, _, err := snapshotFile{path: filePath}.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return metrics
+}
+
+func Test_snapshotFile_save(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "metrics-db.json")
+	file := snapshotFile{path: filePath, generations: 1}
 
-	metrics := make(map[string]storage.Metric)
-	metrics["test_metric"] = storage.Metric{
-		Type:  constants.Gauge,
-		Value: 1.0,
+	saved := map[storage.MetricKey]storage.Metric{
+		{Name: "test_metric", Type: constants.Gauge}: {Value: metrics.Gauge(1)},
+		// A name ending with a type name must not lose that suffix.
+		{Name: "foogauge", Type: constants.Counter}: {Value: metrics.Counter(2)},
+		{Name: "foo", Type: constants.Counter}:      {Value: metrics.Counter(3)},
 	}
 
-	err := saveMetricsToFile(metrics, filePath)
+	err := file.save(saved, time.Now())
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	loadedMetrics, err := loadMetricsFromFile(filePath)
+	loadedMetrics := loadSnapshot(t, filePath)
+
+	metric, ok := loadedMetrics[storage.MetricKey{Name: "test_metric", Type: constants.Gauge}]
+	if !ok {
+		t.Fatal("Test metric not found")
+	}
+
+	if metric.Value != metrics.Gauge(1) {
+		t.Fatalf("Incorrect metric value; got %+v", metric)
+	}
+
+	metric = loadedMetrics[storage.MetricKey{Name: "foogauge", Type: constants.Counter}]
+	if metric.Value != metrics.Counter(2) || len(loadedMetrics) != 3 {
+		t.Fatalf("Incorrect metrics; got %+v", loadedMetrics)
+	}
+}
+
+func Test_snapshotFile_loadLegacy(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "metrics-db.json")
+	// Snapshots used to be a map keyed by the name followed by the type,
+	// without a header.
+	saved := make(map[string]storage.Metric)
+	saved["test_metricgauge"] = storage.Metric{
+		Value: metrics.Gauge(1),
+	}
+
+	file, err := os.Create(filePath)
 	if err != nil {
 		t.Fatal(err)
 	}
+	encoder := json.NewEncoder(file)
+	if err = encoder.Encode(saved); err != nil {
+		t.Fatal(err)
+	}
 
-	metric, ok := loadedMetrics["test_metric"]
+	if err = file.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	loadedMetrics := loadSnapshot(t, filePath)
+
+	metric, ok := loadedMetrics[storage.MetricKey{Name: "test_metric", Type: constants.Gauge}]
 	if !ok {
 		t.Fatal("Test metric not found")
 	}
 
-	if metric.Type != constants.Gauge || metric.Value != 1.0 {
+	if metric.Value != metrics.Gauge(1) {
 		t.Fatalf("Incorrect metric value; got %+v", metric)
 	}
+}
+
+func Test_snapshotFile_compressed(t *testing.T) {
+	key := storage.MetricKey{Name: "PollCount", Type: constants.Counter}
+	saved := map[storage.MetricKey]storage.Metric{key: {Value: metrics.Counter(7)}}
+
+	for name, magic := range map[string][]byte{
+		"metrics-db.json.gz":   gzipMagic,
+		"metrics-db.json.zst":  zstdMagic,
+		"metrics-db.json.zstd": zstdMagic,
+	} {
+		t.Run(name, func(t *testing.T) {
+			filePath := filepath.Join(t.TempDir(), name)
+			if err := (snapshotFile{path: filePath, generations: 1}).save(saved, time.Now()); err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(filePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.HasPrefix(data, magic) {
+				t.Fatalf("The snapshot isn't compressed: %q", data)
+			}
+			if loadSnapshot(t, filePath)[key].Value != metrics.Counter(7) {
+				t.Fatal("The counter should be restored exactly")
+			}
+
+			// A cut compressed file is not taken for an empty snapshot.
+			if err := os.WriteFile(filePath, data[:len(data)/2], 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := (snapshotFile{path: filePath}).load(); err == nil {
+				t.Fatal("A truncated snapshot should fail to load")
+			}
+		})
+	}
+}
+
+func Test_snapshotFile_envelope(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "metrics-db.json")
+	created := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	key := storage.MetricKey{Name: "PollCount", Type: constants.Counter}
+	saved := map[storage.MetricKey]storage.Metric{key: {Value: metrics.Counter(1 << 60)}}
+	if err := (snapshotFile{path: filePath, generations: 1}).save(saved, created); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, body, _ := bytes.Cut(data, []byte("\n"))
+	var envelope snapshotEnvelope
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		t.Fatal(err)
+	}
+	if envelope.FormatVersion != snapshotFormatVersion || !envelope.CreatedAt.Equal(created) {
+		t.Fatalf("Incorrect envelope; got %+v", envelope)
+	}
+	// Counters above 2^53 don't survive a float64.
+	if loadSnapshot(t, filePath)[key].Value != metrics.Counter(1<<60) {
+		t.Fatal("The counter should be restored exactly")
+	}
+
+	// A newer format is refused rather than read as something else.
+	body = bytes.Replace(body, []byte(`"format_version":2`), []byte(`"format_version":3`), 1)
+	if err := os.WriteFile(filePath, body, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := (snapshotFile{path: filePath}).load(); err == nil {
+		t.Fatal("An unknown format version should fail to load")
+	}
+}
+
+func Test_snapshotFile_loadVersion1(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "metrics-db.json")
+	// Version 1 is the list of named metrics, with or without the header.
+	body := `[{"name":"PollCount","type":"counter","value":3,"updated_at":"2024-05-01T12:00:00Z"}]`
+	header := fmt.Sprintf("%s crc32c=%08x created=2024-05-01T12:00:00Z\n",
+		snapshotMagic, crc32.Checksum([]byte(body), snapshotTable))
+
+	for _, data := range []string{body, header + body} {
+		if err := os.WriteFile(filePath, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		metric := loadSnapshot(t, filePath)[storage.MetricKey{Name: "PollCount", Type: constants.Counter}]
+		if metric.Value != metrics.Counter(3) {
+			t.Fatalf("Incorrect metric value; got %+v", metric)
+		}
+	}
+}
+
+func Test_snapshotFile_generations(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "metrics-db.json")
+	file := snapshotFile{path: filePath, generations: 3}
+	key := storage.MetricKey{Name: "PollCount", Type: constants.Counter}
+
+	start := time.Now()
+	for i := 1; i <= 5; i++ {
+		saved := map[storage.MetricKey]storage.Metric{key: {Value: metrics.Counter(i)}}
+		if err := file.save(saved, start.Add(time.Duration(i)*time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		// Generations are named by the modification time of the file.
+		mtime := start.Add(time.Duration(i) * time.Second)
+		if err := os.Chtimes(filePath, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	generations, err := file.olderGenerations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(generations) != 2 {
+		t.Fatalf("Expected two older generations; got %v", generations)
+	}
+	if loadSnapshot(t, filePath)[key].Value != metrics.Counter(5) {
+		t.Fatal("The latest snapshot should be loaded")
+	}
+
+	// A torn latest snapshot falls back to the newest intact generation.
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filePath, data[:len(data)-5], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	loadedMetrics, path, err := file.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != generations[0] || loadedMetrics[key].Value != metrics.Counter(4) {
+		t.Fatalf("Expected the fourth snapshot from %s; got %+v from %s", generations[0], loadedMetrics, path)
+	}
 
+	// So does a missing one, left by a crash between the two renames.
 	if err := os.Remove(filePath); err != nil {
 		t.Fatal(err)
 	}
+	if loadSnapshot(t, filePath)[key].Value != metrics.Counter(4) {
+		t.Fatal("Expected the fourth snapshot")
+	}
+
+	for _, path := range generations {
+		if err := os.WriteFile(path, []byte("#metrics-snapshot crc32c=00000000 created=x\n[]"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := file.load(); err == nil {
+		t.Fatal("Expected an error when no snapshot is intact")
+	}
 }
 
-func Test_loadMetricsFromFile(t *testing.T) {
-	filePath := "/tmp/metrics-db.json"
-	metrics := make(map[string]storage.Metric)
-	metrics["test_metric"] = storage.Metric{
-		Type:  constants.Gauge,
-		Value: 1.0,
+func TestSaver_StorageSavesDeletions(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "metrics-db.json")
+	ctx := context.Background()
+
+	ms := storage.NewMemStorage(zap.NewNop())
+	s := NewSaver(1, filePath, 1, false, ms, zap.NewNop()).Storage()
+
+	for _, name := range []string{"a", "b"} {
+		err := s.Update(ctx, &storage.UpdateOptions{
+			MetricName: name,
+			Update:     storage.Metric{Value: metrics.Gauge(1)},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
 	}
 
-	file, err := os.Create(filePath)
+	if err := s.Delete(ctx, &storage.DeleteOptions{MetricName: "a", MetricType: constants.Gauge}); err != nil {
+		t.Fatal(err)
+	}
+	loadedMetrics := loadSnapshot(t, filePath)
+	if _, ok := loadedMetrics[storage.MetricKey{Name: "a", Type: constants.Gauge}]; ok || len(loadedMetrics) != 1 {
+		t.Fatalf("Deleted metric is in the snapshot; got %+v", loadedMetrics)
+	}
+
+	deleted, err := s.DeleteMatching(ctx, &storage.DeleteMatchingOptions{Match: "*"})
+	if err != nil || deleted != 1 {
+		t.Fatalf("Expected one deleted metric; got %d, %v", deleted, err)
+	}
+	loadedMetrics = loadSnapshot(t, filePath)
+	if len(loadedMetrics) != 0 {
+		t.Fatalf("Snapshot should be empty; got %+v", loadedMetrics)
+	}
+}
+
+func TestSaver_SynchronousWrites(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "metrics-db.json")
+	ctx := context.Background()
+
+	sv := NewSaver(0, filePath, 1, false, storage.NewMemStorage(zap.NewNop()), zap.NewNop())
+	s := sv.Storage()
+
+	hits := storage.MetricKey{Name: "Hits", Type: constants.Counter}
+	err := s.Update(ctx, &storage.UpdateOptions{
+		MetricName: hits.Name,
+		Update:     storage.Metric{Value: metrics.Counter(1)},
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
-	encoder := json.NewEncoder(file)
-	if err = encoder.Encode(metrics); err != nil {
+	loadedMetrics := loadSnapshot(t, filePath)
+	if loadedMetrics[hits].Value != metrics.Counter(1) {
+		t.Fatalf("Update is not in the snapshot; got %+v", loadedMetrics)
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				err := s.SetAll(ctx, &storage.SetAllOptions{Metrics: map[storage.MetricKey]storage.Metric{
+					hits: {Value: metrics.Counter(1)},
+				}})
+				if err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	loadedMetrics = loadSnapshot(t, filePath)
+	if loadedMetrics[hits].Value != metrics.Counter(161) {
+		t.Fatalf("Incorrect metrics in the snapshot; got %+v", loadedMetrics)
+	}
+
+	// A zero interval used to panic in time.NewTicker.
+	runCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := sv.Run(runCtx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSaver_KeepsSnapshotThatFailedToLoad(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "metrics-db.json")
+	broken := []byte("{not json")
+	if err := os.WriteFile(filePath, broken, 0o644); err != nil {
 		t.Fatal(err)
 	}
+	ctx := context.Background()
 
-	if err = file.Close(); err != nil {
+	sv := NewSaver(1, filePath, 2, true, storage.NewMemStorage(zap.NewNop()), zap.NewNop())
+	if err := sv.Restore(ctx); err != nil {
 		t.Fatal(err)
 	}
+	if err := sv.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filePath)
+	if err != nil || !bytes.Equal(data, broken) {
+		t.Fatalf("An empty storage replaced the snapshot; got %q, %v", data, err)
+	}
 
-	loadedMetrics, err := loadMetricsFromFile(filePath)
+	// Once something is written, it is saved.
+	err = sv.Storage().Update(ctx, &storage.UpdateOptions{
+		MetricName: "Hits",
+		Update:     storage.Metric{Value: metrics.Counter(1)},
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
+	if err := sv.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	loadedMetrics := loadSnapshot(t, filePath)
+	if len(loadedMetrics) != 1 {
+		t.Fatalf("Incorrect metrics in the snapshot; got %+v", loadedMetrics)
+	}
+}
 
-	metric, ok := loadedMetrics["test_metric"]
-	if !ok {
-		t.Fatal("Test metric not found")
+func TestSaver_RestoreStrict(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "metrics-db.json")
+	if err := os.WriteFile(filePath, []byte("{not json"), 0o644); err != nil {
+		t.Fatal(err)
 	}
+	ctx := context.Background()
 
-	if metric.Type != constants.Gauge || metric.Value != 1.0 {
-		t.Fatalf("Incorrect metric value; got %+v", metric)
+	sv := NewSaver(1, filePath, 1, true, storage.NewMemStorage(zap.NewNop()), zap.NewNop())
+	if err := sv.Restore(ctx); err != nil {
+		t.Fatalf("Restore should start empty on a broken file; got %v", err)
+	}
+	if err := sv.RestoreStrict(ctx); err == nil {
+		t.Fatal("RestoreStrict should fail on a broken file")
 	}
 
-	if err := os.Remove(filePath); err != nil {
+	// A missing file is an empty storage, not an error.
+	sv = NewSaver(1, filePath+".missing", 1, true, storage.NewMemStorage(zap.NewNop()), zap.NewNop())
+	if err := sv.RestoreStrict(ctx); err != nil {
 		t.Fatal(err)
 	}
 }
+
+func TestReadSnapshot(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "backup.json.gz")
+	key := storage.MetricKey{Name: "PollCount", Type: constants.Counter}
+	saved := map[storage.MetricKey]storage.Metric{key: {Value: metrics.Counter(7)}}
+	if err := WriteSnapshot(filePath, saved, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := ReadSnapshot(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded[key].Value != metrics.Counter(7) || len(loaded) != 1 {
+		t.Fatalf("Incorrect metrics; got %+v", loaded)
+	}
+
+	// Unlike the saver's own file, a missing backup is an error.
+	if _, err := ReadSnapshot(filePath + ".missing"); err == nil {
+		t.Fatal("A missing backup should fail to load")
+	}
+}
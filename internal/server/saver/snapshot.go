@@ -0,0 +1,363 @@
+package saver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/ElizavetaFirst/go-metrics-alerts/internal/fsutil"
+	"github.com/ElizavetaFirst/go-metrics-alerts/internal/server/storage"
+)
+
+const (
+	// snapshotMagic starts the header line: the checksum of the rest of the
+	// file and the time it was taken.
+	snapshotMagic = "#metrics-snapshot"
+	// generationLayout is the suffix of the older snapshots, it sorts by time.
+	generationLayout = "20060102T150405.000000000Z"
+	// snapshotFormatVersion is the version of the envelope written by save.
+	// Version 1 is the bare list of named metrics.
+	snapshotFormatVersion = 2
+)
+
+var (
+	snapshotTable = crc32.MakeTable(crc32.Castagnoli)
+
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// snapshotEnvelope is the body of the snapshots since format version 2.
+type snapshotEnvelope struct {
+	FormatVersion int                   `json:"format_version"`
+	CreatedAt     time.Time             `json:"created_at"`
+	ServerVersion string                `json:"server_version,omitempty"`
+	Metrics       []storage.NamedMetric `json:"metrics"`
+}
+
+// serverVersion is the module version the binary was built from.
+func serverVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+	return info.Main.Version
+}
+
+// snapshotFile is the snapshot at path and the older generations next to
+// it, named path.<time>. Saving replaces the file in one rename, so a crash
+// leaves the previous snapshot intact. A path ending in .gz or .zst is
+// compressed with gzip or zstd.
+type snapshotFile struct {
+	path string
+	// generations is how many snapshots are kept, the latest included.
+	generations int
+}
+
+func (f snapshotFile) save(metrics map[storage.MetricKey]storage.Metric, now time.Time) error {
+	data, err := encodeSnapshot(metrics, now)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(f.path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(f.path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+	err = compressSnapshot(tmp, f.path, data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+
+	if err := f.rotate(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), f.path); err != nil {
+		return fmt.Errorf("failed to replace file: %w", err)
+	}
+	if err := fsutil.SyncDir(dir); err != nil {
+		return err
+	}
+	return f.prune()
+}
+
+// WriteSnapshot saves the metrics to path in the snapshot format, which
+// any storage can be restored from. Like the snapshots of the saver, the
+// file is compressed if path ends in .gz or .zst.
+func WriteSnapshot(path string, metrics map[storage.MetricKey]storage.Metric, now time.Time) error {
+	return snapshotFile{path: path, generations: 1}.save(metrics, now)
+}
+
+// ReadSnapshot reads a file written by WriteSnapshot or by the saver of
+// any version.
+func ReadSnapshot(path string) (map[storage.MetricKey]storage.Metric, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	metrics, err := decodeSnapshot(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid snapshot %s: %w", path, err)
+	}
+	return metrics, nil
+}
+
+// encodeSnapshot returns the header line followed by the envelope.
+func encodeSnapshot(metrics map[storage.MetricKey]storage.Metric, now time.Time) ([]byte, error) {
+	envelope := snapshotEnvelope{
+		FormatVersion: snapshotFormatVersion,
+		CreatedAt:     now.UTC(),
+		ServerVersion: serverVersion(),
+		Metrics:       make([]storage.NamedMetric, 0, len(metrics)),
+	}
+	for key, metric := range metrics {
+		envelope.Metrics = append(envelope.Metrics, storage.NamedMetric{Name: key.Name, Metric: metric})
+	}
+	sort.Slice(envelope.Metrics, func(i, j int) bool {
+		a, b := envelope.Metrics[i], envelope.Metrics[j]
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.Type() < b.Type()
+	})
+	body, err := json.Marshal(envelope)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode metrics: %w", err)
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s crc32c=%08x created=%s\n",
+		snapshotMagic, crc32.Checksum(body, snapshotTable), envelope.CreatedAt.Format(time.RFC3339Nano))
+	buf.Write(body)
+	return buf.Bytes(), nil
+}
+
+// compressSnapshot writes data to w compressed as the extension of path asks.
+func compressSnapshot(w io.Writer, path string, data []byte) error {
+	var (
+		zw  io.WriteCloser
+		err error
+	)
+	switch filepath.Ext(path) {
+	case ".gz":
+		zw = gzip.NewWriter(w)
+	case ".zst", ".zstd":
+		zw, err = zstd.NewWriter(w)
+		if err != nil {
+			return fmt.Errorf("failed to start zstd: %w", err)
+		}
+	default:
+		_, err = w.Write(data)
+		return err
+	}
+	_, err = zw.Write(data)
+	if closeErr := zw.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// decompressSnapshot recognizes the compression by its magic bytes rather
+// than the extension, so that the snapshots written before the path was
+// changed still load.
+func decompressSnapshot(data []byte) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(data, gzipMagic):
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open gzip: %w", err)
+		}
+		defer zr.Close()
+		data, err = io.ReadAll(zr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress gzip: %w", err)
+		}
+		return data, nil
+	case bytes.HasPrefix(data, zstdMagic):
+		zr, err := zstd.NewReader(nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to start zstd: %w", err)
+		}
+		defer zr.Close()
+		data, err = zr.DecodeAll(data, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress zstd: %w", err)
+		}
+		return data, nil
+	default:
+		return data, nil
+	}
+}
+
+// rotate moves the current snapshot to a generation named by its time.
+func (f snapshotFile) rotate() error {
+	if f.generations <= 1 {
+		return nil
+	}
+	info, err := os.Stat(f.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to stat file: %w", err)
+	}
+	generation := f.path + "." + info.ModTime().UTC().Format(generationLayout)
+	if err := os.Rename(f.path, generation); err != nil {
+		return fmt.Errorf("failed to keep the previous snapshot: %w", err)
+	}
+	return nil
+}
+
+// prune removes the generations beyond the kept ones.
+func (f snapshotFile) prune() error {
+	generations, err := f.olderGenerations()
+	if err != nil {
+		return err
+	}
+	keep := max(f.generations-1, 0)
+	for _, path := range generations[min(keep, len(generations)):] {
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("failed to remove an old snapshot: %w", err)
+		}
+	}
+	return nil
+}
+
+// olderGenerations returns the generation files, newest first.
+func (f snapshotFile) olderGenerations() ([]string, error) {
+	matches, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots: %w", err)
+	}
+	var generations []string
+	for _, path := range matches {
+		if _, err := time.Parse(generationLayout, strings.TrimPrefix(path, f.path+".")); err == nil {
+			generations = append(generations, path)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(generations)))
+	return generations, nil
+}
+
+// load reads the latest snapshot that is intact and returns the file it came
+// from. No snapshot at all is an empty storage, not an error.
+func (f snapshotFile) load() (map[storage.MetricKey]storage.Metric, string, error) {
+	generations, err := f.olderGenerations()
+	if err != nil {
+		return nil, "", err
+	}
+	var errs []error
+	for _, path := range append([]string{f.path}, generations...) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				errs = append(errs, fmt.Errorf("failed to read %s: %w", path, err))
+			}
+			continue
+		}
+		metrics, err := decodeSnapshot(data)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid snapshot %s: %w", path, err))
+			continue
+		}
+		return metrics, path, nil
+	}
+	if len(errs) > 0 {
+		return nil, "", errors.Join(errs...)
+	}
+	return make(map[storage.MetricKey]storage.Metric), "", nil
+}
+
+// decodeSnapshot checks the header of the file if it has one, the files
+// written before there were headers are taken as they are. The body is
+// either an envelope, a version 1 list or a legacy map.
+func decodeSnapshot(data []byte) (map[storage.MetricKey]storage.Metric, error) {
+	data, err := decompressSnapshot(data)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(data, []byte(snapshotMagic)) {
+		header, body, ok := bytes.Cut(data, []byte("\n"))
+		if !ok {
+			return nil, errors.New("no snapshot after the header")
+		}
+		var checksum uint32
+		if _, err := fmt.Sscanf(string(header), snapshotMagic+" crc32c=%08x", &checksum); err != nil {
+			return nil, fmt.Errorf("invalid header %q: %w", header, err)
+		}
+		if crc32.Checksum(body, snapshotTable) != checksum {
+			return nil, errors.New("checksum mismatch")
+		}
+		data = body
+	}
+
+	var snapshot []storage.NamedMetric
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		var envelope struct {
+			FormatVersion int `json:"format_version"`
+		}
+		if err := json.Unmarshal(data, &envelope); err != nil {
+			return nil, fmt.Errorf("failed to decode file: %w", err)
+		}
+		switch envelope.FormatVersion {
+		case 0:
+			return decodeLegacySnapshot(data)
+		case snapshotFormatVersion:
+			var envelope snapshotEnvelope
+			if err := json.Unmarshal(data, &envelope); err != nil {
+				return nil, fmt.Errorf("failed to decode file: %w", err)
+			}
+			snapshot = envelope.Metrics
+		default:
+			return nil, fmt.Errorf("unsupported snapshot format version %d", envelope.FormatVersion)
+		}
+	} else if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, fmt.Errorf("failed to decode file: %w", err)
+	}
+
+	metrics := make(map[storage.MetricKey]storage.Metric, len(snapshot))
+	for _, nm := range snapshot {
+		metrics[nm.Key()] = nm.Metric
+	}
+	return metrics, nil
+}
+
+// decodeLegacySnapshot reads the map snapshots keyed by the name followed
+// by the type, the type of each entry tells where the name ends.
+func decodeLegacySnapshot(data []byte) (map[storage.MetricKey]storage.Metric, error) {
+	var legacy map[string]storage.Metric
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		return nil, fmt.Errorf("failed to decode file: %w", err)
+	}
+	metrics := make(map[storage.MetricKey]storage.Metric, len(legacy))
+	for key, metric := range legacy {
+		name, ok := strings.CutSuffix(key, string(metric.Type()))
+		if !ok {
+			return nil, fmt.Errorf("snapshot key %q doesn't end with its type %s", key, metric.Type())
+		}
+		metrics[storage.MetricKey{Name: name, Type: metric.Type()}] = metric
+	}
+	return metrics, nil
+}
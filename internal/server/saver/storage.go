@@ -0,0 +1,142 @@
+package saver
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"github.com/ElizavetaFirst/go-metrics-alerts/internal/server/storage"
+)
+
+// deletionTracker takes a snapshot right after every destructive operation,
+// so deleted or reset series don't come back on restore.
+type deletionTracker struct {
+	storage.Storage
+	saver *Saver
+}
+
+// synchronousWriter takes a snapshot after every write as well, so that
+// an acknowledged update survives a crash.
+type synchronousWriter struct {
+	storage.Storage
+	saver *Saver
+}
+
+// Storage returns the saver's storage wrapped so that deletions and resets
+// reach the snapshot file before the caller gets the result. With a zero
+// store interval, updates do too.
+func (s *Saver) Storage() storage.Storage {
+	var st storage.Storage = &deletionTracker{
+		Storage: s.storage,
+		saver:   s,
+	}
+	if s.synchronous() {
+		st = &synchronousWriter{
+			Storage: st,
+			saver:   s,
+		}
+	}
+	return st
+}
+
+func (s *Saver) synchronous() bool {
+	return s.storeInterval == 0
+}
+
+func (sw *synchronousWriter) Update(ctx context.Context, opts *storage.UpdateOptions) error {
+	if err := sw.Storage.Update(ctx, opts); err != nil {
+		return fmt.Errorf("can't update metric %w", err)
+	}
+	return sw.saver.snapshot(ctx)
+}
+
+func (sw *synchronousWriter) SetAll(ctx context.Context, opts *storage.SetAllOptions) error {
+	if err := sw.Storage.SetAll(ctx, opts); err != nil {
+		return fmt.Errorf("can't set all metrics %w", err)
+	}
+	return sw.saver.snapshot(ctx)
+}
+
+func (dt *deletionTracker) Delete(ctx context.Context, opts *storage.DeleteOptions) error {
+	if err := dt.Storage.Delete(ctx, opts); err != nil {
+		return fmt.Errorf("can't delete metric %w", err)
+	}
+	return dt.saver.snapshot(ctx)
+}
+
+func (dt *deletionTracker) DeleteMatching(ctx context.Context, opts *storage.DeleteMatchingOptions) (int64, error) {
+	deleted, err := dt.Storage.DeleteMatching(ctx, opts)
+	if err != nil {
+		return 0, fmt.Errorf("can't delete matching metrics %w", err)
+	}
+	if deleted == 0 {
+		return 0, nil
+	}
+	return deleted, dt.saver.snapshot(ctx)
+}
+
+func (dt *deletionTracker) Reset(ctx context.Context, opts *storage.ResetOptions) error {
+	if err := dt.Storage.Reset(ctx, opts); err != nil {
+		return fmt.Errorf("can't reset metric %w", err)
+	}
+	return dt.saver.snapshot(ctx)
+}
+
+func (dt *deletionTracker) DeleteStale(ctx context.Context, opts *storage.DeleteStaleOptions) (int64, error) {
+	deleted, err := dt.Storage.DeleteStale(ctx, opts)
+	if err != nil {
+		return 0, fmt.Errorf("can't delete stale metrics %w", err)
+	}
+	if deleted == 0 || opts.DryRun {
+		return deleted, nil
+	}
+	return deleted, dt.saver.snapshot(ctx)
+}
+
+// snapshotQueue coalesces the snapshot requests: a request is served by
+// the first snapshot started after it, so writers that arrive while a
+// snapshot is being written share the next one.
+type snapshotQueue struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	requested uint64
+	saved     uint64
+	saving    bool
+}
+
+// snapshot returns once a snapshot taken after the caller's change is saved.
+func (s *Saver) snapshot(ctx context.Context) error {
+	q := &s.snapshots
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.cond == nil {
+		q.cond = sync.NewCond(&q.mu)
+	}
+	q.requested++
+	request := q.requested
+
+	for q.saved < request {
+		if q.saving {
+			q.cond.Wait()
+			continue
+		}
+
+		q.saving = true
+		target := q.requested
+		q.mu.Unlock()
+		err := s.getAndSaveMetrics(ctx)
+		q.mu.Lock()
+		q.saving = false
+		if err == nil {
+			q.saved = max(q.saved, target)
+		}
+		q.cond.Broadcast()
+		if err != nil {
+			s.log.Error("can't save metrics after a change", zap.Error(err))
+			return err
+		}
+	}
+	return nil
+}
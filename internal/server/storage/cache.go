@@ -0,0 +1,206 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// cacheMaxEntries bounds the single metrics kept, so that reads of many
+// missing names can't grow the cache without limit.
+const cacheMaxEntries = 10000
+
+// CacheStats counts the reads of a Cache.
+type CacheStats struct {
+	Hits   uint64 `json:"hits"`
+	Misses uint64 `json:"misses"`
+}
+
+type cacheEntry struct {
+	metric Metric
+	found  bool
+	at     time.Time
+}
+
+// Cache serves Get, GetAll and List from memory. Every write through the cache
+// drops what it may have changed; maxAge bounds how stale the answers are
+// for the writes that don't go through it, such as of another server on
+// the same database.
+type Cache struct {
+	Storage
+	maxAge time.Duration
+	now    func() time.Time
+
+	mu      sync.RWMutex
+	entries map[MetricKey]cacheEntry
+	all     map[MetricKey]Metric
+	allAt   time.Time
+	// generation changes on every write, a read that started before it
+	// must not fill the cache.
+	generation uint64
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+func WithCache(s Storage, maxAge time.Duration) *Cache {
+	return &Cache{
+		Storage: s,
+		maxAge:  maxAge,
+		now:     time.Now,
+		entries: make(map[MetricKey]cacheEntry),
+	}
+}
+
+func (c *Cache) Stats() CacheStats {
+	return CacheStats{Hits: c.hits.Load(), Misses: c.misses.Load()}
+}
+
+func (c *Cache) fresh(at, now time.Time) bool {
+	return now.Sub(at) < c.maxAge
+}
+
+func (c *Cache) Get(ctx context.Context, opts *GetOptions) (Metric, error) {
+	key := MetricKey{Name: opts.MetricName, Type: MetricType(opts.MetricType)}
+	now := c.now()
+
+	c.mu.RLock()
+	entry, ok := c.entries[key]
+	ok = ok && c.fresh(entry.at, now)
+	if !ok && c.all != nil && c.fresh(c.allAt, now) {
+		entry.metric, entry.found = c.all[key]
+		ok = true
+	}
+	generation := c.generation
+	c.mu.RUnlock()
+	if ok {
+		c.hits.Add(1)
+		if !entry.found {
+			return Metric{}, fmt.Errorf("can't get metric from cache %s %s: %w",
+				opts.MetricName, opts.MetricType, ErrMetricNotFound)
+		}
+		return entry.metric, nil
+	}
+
+	c.misses.Add(1)
+	metric, err := c.Storage.Get(ctx, opts)
+	found := err == nil
+	if err != nil && !errors.Is(err, ErrMetricNotFound) {
+		return Metric{}, err
+	}
+	c.mu.Lock()
+	if c.generation == generation {
+		if len(c.entries) >= cacheMaxEntries {
+			c.entries = make(map[MetricKey]cacheEntry)
+		}
+		c.entries[key] = cacheEntry{metric: metric, found: found, at: now}
+	}
+	c.mu.Unlock()
+	return metric, err
+}
+
+func (c *Cache) GetAll(ctx context.Context) (map[MetricKey]Metric, error) {
+	now := c.now()
+
+	c.mu.RLock()
+	all, allAt, generation := c.all, c.allAt, c.generation
+	c.mu.RUnlock()
+	if all != nil && c.fresh(allAt, now) {
+		c.hits.Add(1)
+		return copyMetrics(all), nil
+	}
+
+	c.misses.Add(1)
+	all, err := c.Storage.GetAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	if c.generation == generation {
+		c.all, c.allAt = copyMetrics(all), now
+	}
+	c.mu.Unlock()
+	return all, nil
+}
+
+// List filters the cached GetAll while it is fresh. Otherwise the listing
+// goes to the storage, which filters and cuts the page itself.
+func (c *Cache) List(ctx context.Context, opts *ListOptions) ([]NamedMetric, error) {
+	c.mu.RLock()
+	all, allAt := c.all, c.allAt
+	c.mu.RUnlock()
+	if all == nil || !c.fresh(allAt, c.now()) {
+		c.misses.Add(1)
+		return c.Storage.List(ctx, opts)
+	}
+	c.hits.Add(1)
+	return sortListed(appendListed(nil, all, opts), opts), nil
+}
+
+// invalidate drops the cached keys and the cached GetAll.
+func (c *Cache) invalidate(keys ...MetricKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	c.all = nil
+	for _, key := range keys {
+		delete(c.entries, key)
+	}
+}
+
+// invalidateAll drops every cached metric, for the writes whose keys
+// aren't known in advance.
+func (c *Cache) invalidateAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	c.all = nil
+	c.entries = make(map[MetricKey]cacheEntry)
+}
+
+func (c *Cache) Update(ctx context.Context, opts *UpdateOptions) error {
+	defer c.invalidate(MetricKey{Name: opts.MetricName, Type: opts.Update.Type()})
+	return c.Storage.Update(ctx, opts)
+}
+
+func (c *Cache) SetAll(ctx context.Context, opts *SetAllOptions) error {
+	keys := make([]MetricKey, 0, len(opts.Metrics))
+	for key := range opts.Metrics {
+		keys = append(keys, key)
+	}
+	defer c.invalidate(keys...)
+	return c.Storage.SetAll(ctx, opts)
+}
+
+func (c *Cache) Delete(ctx context.Context, opts *DeleteOptions) error {
+	defer c.invalidate(MetricKey{Name: opts.MetricName, Type: MetricType(opts.MetricType)})
+	return c.Storage.Delete(ctx, opts)
+}
+
+func (c *Cache) DeleteMatching(ctx context.Context, opts *DeleteMatchingOptions) (int64, error) {
+	defer c.invalidateAll()
+	return c.Storage.DeleteMatching(ctx, opts)
+}
+
+func (c *Cache) Reset(ctx context.Context, opts *ResetOptions) error {
+	defer c.invalidate(MetricKey{Name: opts.MetricName, Type: MetricType(opts.MetricType)})
+	return c.Storage.Reset(ctx, opts)
+}
+
+func (c *Cache) DeleteStale(ctx context.Context, opts *DeleteStaleOptions) (int64, error) {
+	if !opts.DryRun {
+		defer c.invalidateAll()
+	}
+	return c.Storage.DeleteStale(ctx, opts)
+}
+
+func copyMetrics(metrics map[MetricKey]Metric) map[MetricKey]Metric {
+	result := make(map[MetricKey]Metric, len(metrics))
+	for key, metric := range metrics {
+		result[key] = metric
+	}
+	return result
+}
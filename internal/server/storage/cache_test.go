@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/ElizavetaFirst/go-metrics-alerts/internal/metrics"
+)
+
+func TestCache_Conformance(t *testing.T) {
+	testConformance(t, func(t *testing.T) Storage {
+		return WithCache(NewMemStorage(zap.NewNop()), time.Minute)
+	})
+}
+
+func TestCache_HitsAndStaleness(t *testing.T) {
+	ctx := context.Background()
+	backend := NewMemStorage(zap.NewNop())
+	c := WithCache(backend, time.Second)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	c.now = func() time.Time { return now }
+	get := &GetOptions{MetricName: "Hits", MetricType: string(Counter)}
+
+	require.NoError(t, c.Update(ctx, &UpdateOptions{MetricName: "Hits", Update: Metric{Value: metrics.Counter(1)}}))
+	for i := 0; i < 3; i++ {
+		metric, err := c.Get(ctx, get)
+		require.NoError(t, err)
+		assert.Equal(t, metrics.Counter(1), metric.Value)
+	}
+	assert.Equal(t, CacheStats{Hits: 2, Misses: 1}, c.Stats())
+
+	// A write through the cache is seen at once.
+	require.NoError(t, c.Update(ctx, &UpdateOptions{MetricName: "Hits", Update: Metric{Value: metrics.Counter(1)}}))
+	metric, err := c.Get(ctx, get)
+	require.NoError(t, err)
+	assert.Equal(t, metrics.Counter(2), metric.Value)
+
+	// A write that bypasses it is seen once the entry is older than maxAge.
+	require.NoError(t, backend.Update(ctx, &UpdateOptions{MetricName: "Hits", Update: Metric{Value: metrics.Counter(1)}}))
+	metric, err = c.Get(ctx, get)
+	require.NoError(t, err)
+	assert.Equal(t, metrics.Counter(2), metric.Value)
+	now = now.Add(time.Second)
+	metric, err = c.Get(ctx, get)
+	require.NoError(t, err)
+	assert.Equal(t, metrics.Counter(3), metric.Value)
+}
+
+func TestCache_GetAll(t *testing.T) {
+	ctx := context.Background()
+	c := WithCache(NewMemStorage(zap.NewNop()), time.Minute)
+	require.NoError(t, c.Update(ctx, &UpdateOptions{MetricName: "Alloc", Update: Metric{Value: metrics.Gauge(1)}}))
+
+	all, err := c.GetAll(ctx)
+	require.NoError(t, err)
+	require.Len(t, all, 1)
+	// The caller's map is its own.
+	delete(all, MetricKey{Name: "Alloc", Type: Gauge})
+
+	// Get is answered from the cached GetAll, missing metrics included.
+	metric, err := c.Get(ctx, &GetOptions{MetricName: "Alloc", MetricType: string(Gauge)})
+	require.NoError(t, err)
+	assert.Equal(t, metrics.Gauge(1), metric.Value)
+	_, err = c.Get(ctx, &GetOptions{MetricName: "Missing", MetricType: string(Gauge)})
+	assert.ErrorIs(t, err, ErrMetricNotFound)
+	assert.Equal(t, CacheStats{Hits: 2, Misses: 1}, c.Stats())
+
+	// So is List, with the filters of the storage.
+	list, err := c.List(ctx, &ListOptions{MetricType: string(Gauge)})
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	assert.Equal(t, "Alloc", list[0].Name)
+	list, err = c.List(ctx, &ListOptions{Match: "Heap*"})
+	require.NoError(t, err)
+	assert.Empty(t, list)
+	assert.Equal(t, CacheStats{Hits: 4, Misses: 1}, c.Stats())
+
+	deleted, err := c.DeleteMatching(ctx, &DeleteMatchingOptions{Match: "*"})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), deleted)
+	all, err = c.GetAll(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, all)
+}
+
+func TestCache_SetAllKeepsOtherSeries(t *testing.T) {
+	ctx := context.Background()
+	c := WithCache(NewMemStorage(zap.NewNop()), time.Minute)
+	require.NoError(t, c.Update(ctx, &UpdateOptions{MetricName: "Hits", Update: Metric{Value: metrics.Counter(1)}}))
+	require.NoError(t, c.Update(ctx, &UpdateOptions{MetricName: "Alloc", Update: Metric{Value: metrics.Gauge(1)}}))
+	hits := &GetOptions{MetricName: "Hits", MetricType: string(Counter)}
+	alloc := &GetOptions{MetricName: "Alloc", MetricType: string(Gauge)}
+	_, err := c.Get(ctx, hits)
+	require.NoError(t, err)
+	_, err = c.Get(ctx, alloc)
+	require.NoError(t, err)
+	assert.Equal(t, CacheStats{Misses: 2}, c.Stats())
+
+	// A batch for Alloc drops only Alloc.
+	require.NoError(t, c.SetAll(ctx, &SetAllOptions{Metrics: map[MetricKey]Metric{
+		{Name: "Alloc", Type: Gauge}: {Value: metrics.Gauge(2)},
+	}}))
+	metric, err := c.Get(ctx, hits)
+	require.NoError(t, err)
+	assert.Equal(t, metrics.Counter(1), metric.Value)
+	metric, err = c.Get(ctx, alloc)
+	require.NoError(t, err)
+	assert.Equal(t, metrics.Gauge(2), metric.Value)
+	assert.Equal(t, CacheStats{Hits: 1, Misses: 3}, c.Stats())
+}
+
+func TestCache_ListWithoutFreshGetAll(t *testing.T) {
+	ctx := context.Background()
+	backend := NewMemStorage(zap.NewNop())
+	c := WithCache(backend, time.Second)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	c.now = func() time.Time { return now }
+	require.NoError(t, c.Update(ctx, &UpdateOptions{MetricName: "Alloc", Update: Metric{Value: metrics.Gauge(1)}}))
+
+	// Without a cached GetAll the listing goes to the storage and isn't cached.
+	list, err := c.List(ctx, &ListOptions{Limit: 1})
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	assert.Nil(t, c.all)
+	assert.Equal(t, CacheStats{Misses: 1}, c.Stats())
+
+	// A stale GetAll isn't used either.
+	_, err = c.GetAll(ctx)
+	require.NoError(t, err)
+	require.NoError(t, backend.Update(ctx, &UpdateOptions{MetricName: "HeapInuse", Update: Metric{Value: metrics.Gauge(2)}}))
+	list, err = c.List(ctx, &ListOptions{Match: "Heap*"})
+	require.NoError(t, err)
+	assert.Empty(t, list)
+	now = now.Add(time.Second)
+	list, err = c.List(ctx, &ListOptions{Match: "Heap*"})
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	assert.Equal(t, "HeapInuse", list[0].Name)
+	assert.Equal(t, CacheStats{Hits: 1, Misses: 3}, c.Stats())
+}
@@ -0,0 +1,289 @@
+package storage
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/ElizavetaFirst/go-metrics-alerts/internal/metrics"
+)
+
+// testConformance is the behavior every Storage must share. newStorage
+// returns an empty storage for each case.
+func testConformance(t *testing.T, newStorage func(t *testing.T) Storage) {
+	cases := []struct {
+		name string
+		test func(t *testing.T, s Storage)
+	}{
+		{"CounterAccumulates", testCounterAccumulates},
+		{"GaugeOverwrites", testGaugeOverwrites},
+		{"TypeMismatch", testTypeMismatch},
+		{"SetAllGetAllRoundTrip", testSetAllGetAllRoundTrip},
+		{"SetAllReplace", testSetAllReplace},
+		{"SetAllGaugeOps", testSetAllGaugeOps},
+		{"NotFound", testNotFound},
+		{"ConcurrentUpdates", testConcurrentUpdates},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			c.test(t, newStorage(t))
+		})
+	}
+}
+
+func mustGet(t *testing.T, s Storage, name string, metricType MetricType) Metric {
+	t.Helper()
+	metric, err := s.Get(context.Background(), &GetOptions{MetricName: name, MetricType: string(metricType)})
+	require.NoError(t, err)
+	return metric
+}
+
+func testCounterAccumulates(t *testing.T, s Storage) {
+	ctx := context.Background()
+	for _, delta := range []metrics.Counter{2, 3} {
+		require.NoError(t, s.Update(ctx, &UpdateOptions{MetricName: "Hits", Update: Metric{Value: delta}}))
+	}
+	assert.Equal(t, metrics.Counter(5), mustGet(t, s, "Hits", Counter).Value)
+
+	require.NoError(t, s.SetAll(ctx, &SetAllOptions{Metrics: map[MetricKey]Metric{
+		{Name: "Hits", Type: Counter}: {Value: metrics.Counter(4)},
+	}}))
+	assert.Equal(t, metrics.Counter(9), mustGet(t, s, "Hits", Counter).Value)
+
+	require.NoError(t, s.Reset(ctx, &ResetOptions{MetricName: "Hits", MetricType: string(Counter)}))
+	assert.Equal(t, metrics.Counter(0), mustGet(t, s, "Hits", Counter).Value)
+}
+
+func testGaugeOverwrites(t *testing.T, s Storage) {
+	ctx := context.Background()
+	for _, value := range []metrics.Gauge{1.5, 2.5} {
+		require.NoError(t, s.Update(ctx, &UpdateOptions{MetricName: "Alloc", Update: Metric{Value: value}}))
+	}
+	assert.Equal(t, metrics.Gauge(2.5), mustGet(t, s, "Alloc", Gauge).Value)
+
+	require.NoError(t, s.SetAll(ctx, &SetAllOptions{Metrics: map[MetricKey]Metric{
+		{Name: "Alloc", Type: Gauge}: {Value: metrics.Gauge(0.5)},
+	}}))
+	assert.Equal(t, metrics.Gauge(0.5), mustGet(t, s, "Alloc", Gauge).Value)
+
+	for _, u := range []struct {
+		op    GaugeOp
+		value metrics.Gauge
+		want  metrics.Gauge
+	}{
+		{GaugeAdd, 2, 2.5},
+		{GaugeMax, 1, 2.5},
+		{GaugeMin, 1, 1},
+	} {
+		var result Metric
+		require.NoError(t, s.Update(ctx, &UpdateOptions{
+			MetricName: "Alloc", Update: Metric{Value: u.value}, Op: u.op, Result: &result,
+		}))
+		assert.Equal(t, u.want, result.Value, u.op)
+		assert.Equal(t, u.want, mustGet(t, s, "Alloc", Gauge).Value, u.op)
+	}
+}
+
+func testTypeMismatch(t *testing.T, s Storage) {
+	ctx := context.Background()
+	require.NoError(t, s.Update(ctx, &UpdateOptions{MetricName: "Load", Update: Metric{Value: metrics.Gauge(1.5)}}))
+	require.NoError(t, s.Update(ctx, &UpdateOptions{MetricName: "Load", Update: Metric{Value: metrics.Counter(2)}}))
+	assert.Equal(t, metrics.Gauge(1.5), mustGet(t, s, "Load", Gauge).Value)
+	assert.Equal(t, metrics.Counter(2), mustGet(t, s, "Load", Counter).Value)
+
+	_, err := s.Get(ctx, &GetOptions{MetricName: "Load", MetricType: string(Histogram)})
+	assert.ErrorIs(t, err, ErrMetricNotFound)
+
+	err = s.Update(ctx, &UpdateOptions{MetricName: "Load", Update: Metric{Value: metrics.Counter(1)}, Op: GaugeAdd})
+	assert.ErrorIs(t, err, ErrIncorrectType)
+	err = s.Reset(ctx, &ResetOptions{MetricName: "Load", MetricType: string(Gauge)})
+	assert.ErrorIs(t, err, ErrIncorrectType)
+
+	histogram := metrics.NewHistogram([]float64{1, 2})
+	require.NoError(t, s.Update(ctx, &UpdateOptions{MetricName: "Latency", Update: Metric{Value: histogram}}))
+	err = s.Update(ctx, &UpdateOptions{MetricName: "Latency", Update: Metric{Value: metrics.NewHistogram([]float64{1})}})
+	assert.ErrorIs(t, err, metrics.ErrHistogramBounds)
+
+	// A batch with a value under a key of another type is rejected as a whole.
+	err = s.SetAll(ctx, &SetAllOptions{Metrics: map[MetricKey]Metric{
+		{Name: "Load", Type: Counter}: {Value: metrics.Counter(1)},
+		{Name: "Fresh", Type: Gauge}:  {Value: metrics.Counter(1)},
+	}})
+	assert.ErrorIs(t, err, ErrIncorrectType)
+	assert.Equal(t, metrics.Counter(2), mustGet(t, s, "Load", Counter).Value)
+}
+
+func testSetAllGetAllRoundTrip(t *testing.T, s Storage) {
+	ctx := context.Background()
+	updatedAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	histogram := metrics.NewHistogram([]float64{1, 10})
+	histogram.Observe(5)
+	sketch := metrics.NewSketch(metrics.DefaultSketchAlpha)
+	sketch.Add(5)
+	set := metrics.NewHyperLogLog()
+	set.Add("user-1")
+
+	batch := map[MetricKey]Metric{
+		{Name: "foo", Type: Gauge}:         {Value: metrics.Gauge(1.5), UpdatedAt: updatedAt},
+		{Name: "foo", Type: Counter}:       {Value: metrics.Counter(7), UpdatedAt: updatedAt},
+		{Name: "foogauge", Type: Counter}:  {Value: metrics.Counter(3), UpdatedAt: updatedAt},
+		{Name: "Latency", Type: Histogram}: {Value: histogram, UpdatedAt: updatedAt},
+		{Name: "Latency", Type: Summary}:   {Value: sketch, UpdatedAt: updatedAt},
+		{Name: "Users", Type: Set}:         {Value: set, UpdatedAt: updatedAt},
+	}
+	require.NoError(t, s.SetAll(ctx, &SetAllOptions{Metrics: batch}))
+
+	all, err := s.GetAll(ctx)
+	require.NoError(t, err)
+	require.Len(t, all, len(batch))
+	for key, want := range batch {
+		got, ok := all[key]
+		require.True(t, ok, key)
+		assert.True(t, want.UpdatedAt.Equal(got.UpdatedAt), "%v updated at %v", key, got.UpdatedAt)
+		if key.Type == Summary {
+			// Empty bin maps don't survive encoding, the content does.
+			assert.Equal(t, sketch.Count, got.Value.(metrics.Sketch).Count)
+			assert.Equal(t, sketch.Positive, got.Value.(metrics.Sketch).Positive)
+			continue
+		}
+		assert.Equal(t, want.Value, got.Value, key)
+	}
+
+	// The snapshot restores into an empty storage unchanged.
+	restored := NewMemStorage(zap.NewNop())
+	require.NoError(t, restored.SetAll(ctx, &SetAllOptions{Metrics: all}))
+	again, err := restored.GetAll(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, all, again)
+}
+
+func testSetAllReplace(t *testing.T, s Storage) {
+	ctx := context.Background()
+	updatedAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	require.NoError(t, s.Update(ctx, &UpdateOptions{MetricName: "Hits", Update: Metric{Value: metrics.Counter(5)}}))
+	require.NoError(t, s.Update(ctx, &UpdateOptions{MetricName: "Latency", Update: Metric{Value: metrics.NewHistogram([]float64{1})}}))
+	require.NoError(t, s.Update(ctx, &UpdateOptions{MetricName: "Kept", Update: Metric{Value: metrics.Gauge(1)}}))
+
+	// Replaced series take the saved values, even with other histogram bounds.
+	histogram := metrics.NewHistogram([]float64{1, 10})
+	histogram.Observe(5)
+	require.NoError(t, s.SetAll(ctx, &SetAllOptions{Replace: true, Metrics: map[MetricKey]Metric{
+		{Name: "Hits", Type: Counter}:      {Value: metrics.Counter(3), UpdatedAt: updatedAt},
+		{Name: "Latency", Type: Histogram}: {Value: histogram, UpdatedAt: updatedAt},
+	}}))
+	hits := mustGet(t, s, "Hits", Counter)
+	assert.Equal(t, metrics.Counter(3), hits.Value)
+	assert.True(t, updatedAt.Equal(hits.UpdatedAt), "updated at %v", hits.UpdatedAt)
+	assert.Equal(t, histogram, mustGet(t, s, "Latency", Histogram).Value)
+	assert.Equal(t, metrics.Gauge(1), mustGet(t, s, "Kept", Gauge).Value)
+}
+
+func testSetAllGaugeOps(t *testing.T, s Storage) {
+	ctx := context.Background()
+	require.NoError(t, s.Update(ctx, &UpdateOptions{MetricName: "Depth", Update: Metric{Value: metrics.Gauge(10)}}))
+	require.NoError(t, s.Update(ctx, &UpdateOptions{MetricName: "Peak", Update: Metric{Value: metrics.Gauge(10)}}))
+
+	results := make(map[MetricKey]Metric)
+	require.NoError(t, s.SetAll(ctx, &SetAllOptions{
+		Metrics: map[MetricKey]Metric{
+			{Name: "Depth", Type: Gauge}: {Value: metrics.Gauge(-3)},
+			{Name: "Peak", Type: Gauge}:  {Value: metrics.Gauge(4)},
+			{Name: "Fresh", Type: Gauge}: {Value: metrics.Gauge(2)},
+		},
+		GaugeOps: map[MetricKey]GaugeOp{
+			{Name: "Depth", Type: Gauge}: GaugeAdd,
+			{Name: "Peak", Type: Gauge}:  GaugeMax,
+			{Name: "Fresh", Type: Gauge}: GaugeMin,
+		},
+		Results: results,
+	}))
+	assert.Equal(t, metrics.Gauge(7), mustGet(t, s, "Depth", Gauge).Value)
+	assert.Equal(t, metrics.Gauge(10), mustGet(t, s, "Peak", Gauge).Value)
+	assert.Equal(t, metrics.Gauge(2), mustGet(t, s, "Fresh", Gauge).Value)
+	resultValues := make(map[string]metrics.Value, len(results))
+	for key, result := range results {
+		resultValues[key.Name] = result.Value
+	}
+	assert.Equal(t, map[string]metrics.Value{
+		"Depth": metrics.Gauge(7), "Peak": metrics.Gauge(10), "Fresh": metrics.Gauge(2),
+	}, resultValues)
+
+	// An op on another type rejects the whole batch.
+	err := s.SetAll(ctx, &SetAllOptions{
+		Metrics: map[MetricKey]Metric{
+			{Name: "Depth", Type: Gauge}:  {Value: metrics.Gauge(1)},
+			{Name: "Hits", Type: Counter}: {Value: metrics.Counter(1)},
+		},
+		GaugeOps: map[MetricKey]GaugeOp{
+			{Name: "Depth", Type: Gauge}:  GaugeAdd,
+			{Name: "Hits", Type: Counter}: GaugeAdd,
+		},
+	})
+	assert.ErrorIs(t, err, ErrIncorrectType)
+	assert.Equal(t, metrics.Gauge(7), mustGet(t, s, "Depth", Gauge).Value)
+}
+
+func testNotFound(t *testing.T, s Storage) {
+	ctx := context.Background()
+	_, err := s.Get(ctx, &GetOptions{MetricName: "Missing", MetricType: string(Gauge)})
+	assert.ErrorIs(t, err, ErrMetricNotFound)
+	err = s.Delete(ctx, &DeleteOptions{MetricName: "Missing", MetricType: string(Gauge)})
+	assert.ErrorIs(t, err, ErrMetricNotFound)
+	err = s.Reset(ctx, &ResetOptions{MetricName: "Missing", MetricType: string(Counter)})
+	assert.ErrorIs(t, err, ErrMetricNotFound)
+
+	require.NoError(t, s.Update(ctx, &UpdateOptions{MetricName: "Alloc", Update: Metric{Value: metrics.Gauge(1)}}))
+	require.NoError(t, s.Delete(ctx, &DeleteOptions{MetricName: "Alloc", MetricType: string(Gauge)}))
+	_, err = s.Get(ctx, &GetOptions{MetricName: "Alloc", MetricType: string(Gauge)})
+	assert.ErrorIs(t, err, ErrMetricNotFound)
+
+	all, err := s.GetAll(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, all)
+}
+
+func testConcurrentUpdates(t *testing.T, s Storage) {
+	ctx := context.Background()
+	const workers, updates = 8, 50
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < updates; i++ {
+				assert.NoError(t, s.Update(ctx, &UpdateOptions{MetricName: "Hits", Update: Metric{Value: metrics.Counter(1)}}))
+				assert.NoError(t, s.Update(ctx, &UpdateOptions{
+					MetricName: "Depth",
+					Update:     Metric{Value: metrics.Gauge(1)},
+					Op:         GaugeAdd,
+				}))
+				assert.NoError(t, s.SetAll(ctx, &SetAllOptions{Metrics: map[MetricKey]Metric{
+					{Name: "Hits", Type: Counter}: {Value: metrics.Counter(2)},
+				}}))
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, metrics.Counter(3*workers*updates), mustGet(t, s, "Hits", Counter).Value)
+	assert.Equal(t, metrics.Gauge(workers*updates), mustGet(t, s, "Depth", Gauge).Value)
+}
+
+func TestMemStorage_Conformance(t *testing.T) {
+	testConformance(t, func(t *testing.T) Storage {
+		return NewMemStorage(zap.NewNop())
+	})
+}
+
+func TestWithRetry_Conformance(t *testing.T) {
+	testConformance(t, func(t *testing.T) Storage {
+		return WithRetry(NewMemStorage(zap.NewNop()), zap.NewNop())
+	})
+}
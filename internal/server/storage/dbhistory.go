@@ -0,0 +1,227 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"go.uber.org/zap"
+)
+
+const (
+	samplesTable   = "metric_samples"
+	rollups1mTable = "metric_rollups_1m"
+	rollups1hTable = "metric_rollups_1h"
+)
+
+// Rollups aggregate the complete buckets in [$1, $2) and merge them into the
+// existing rows, so a bucket split between two runs is still counted once.
+const (
+	rollUpSamplesSQL = `
+	INSERT INTO metric_rollups_1m (name, type, ts, min, max, sum, last, count)
+	SELECT name, type, date_trunc('minute', ts), min(value), max(value), sum(value),
+		(array_agg(value ORDER BY ts DESC))[1], count(*)
+	FROM metric_samples
+	WHERE ts >= $1 AND ts < $2
+	GROUP BY name, type, date_trunc('minute', ts)
+	ON CONFLICT (name, type, ts) DO UPDATE
+	SET min = LEAST(metric_rollups_1m.min, EXCLUDED.min),
+		max = GREATEST(metric_rollups_1m.max, EXCLUDED.max),
+		sum = metric_rollups_1m.sum + EXCLUDED.sum,
+		last = EXCLUDED.last,
+		count = metric_rollups_1m.count + EXCLUDED.count;`
+
+	rollUpMinutesSQL = `
+	INSERT INTO metric_rollups_1h (name, type, ts, min, max, sum, last, count)
+	SELECT name, type, date_trunc('hour', ts), min(min), max(max), sum(sum),
+		(array_agg(last ORDER BY ts DESC))[1], sum(count)
+	FROM metric_rollups_1m
+	WHERE ts >= $1 AND ts < $2
+	GROUP BY name, type, date_trunc('hour', ts)
+	ON CONFLICT (name, type, ts) DO UPDATE
+	SET min = LEAST(metric_rollups_1h.min, EXCLUDED.min),
+		max = GREATEST(metric_rollups_1h.max, EXCLUDED.max),
+		sum = metric_rollups_1h.sum + EXCLUDED.sum,
+		last = EXCLUDED.last,
+		count = metric_rollups_1h.count + EXCLUDED.count;`
+)
+
+func (dbs *DBStorage) AppendSamples(ctx context.Context, samples []Sample) error {
+	if len(samples) == 0 {
+		return nil
+	}
+	rows := make([][]interface{}, 0, len(samples))
+	for _, s := range samples {
+		rows = append(rows, []interface{}{s.Name, string(s.Type), s.Time, s.Value})
+	}
+
+	_, err := dbs.conn.CopyFrom(ctx, pgx.Identifier{samplesTable},
+		[]string{"name", "type", "ts", "value"}, pgx.CopyFromRows(rows))
+	if err != nil {
+		dbs.log.Error("can't copy samples", zap.Error(err))
+		return fmt.Errorf("can't copy samples %w", err)
+	}
+	return nil
+}
+
+func (dbs *DBStorage) QueryHistory(ctx context.Context, opts *HistoryOptions) (Resolution, []Point, error) {
+	resolution := PickResolution(opts.Step, opts.From, time.Now())
+
+	var query string
+	switch resolution {
+	case ResolutionRaw:
+		query = `SELECT ts, value, value, value, value, 1 FROM metric_samples
+		WHERE name=$1 AND type=$2 AND ts >= $3 AND ts < $4 ORDER BY ts`
+	case ResolutionMinute:
+		query = `SELECT ts, min, max, sum, last, count FROM metric_rollups_1m
+		WHERE name=$1 AND type=$2 AND ts >= $3 AND ts < $4 ORDER BY ts`
+	case ResolutionHour:
+		query = `SELECT ts, min, max, sum, last, count FROM metric_rollups_1h
+		WHERE name=$1 AND type=$2 AND ts >= $3 AND ts < $4 ORDER BY ts`
+	}
+
+	rows, err := dbs.conn.Query(ctx, query, opts.MetricName, opts.MetricType, opts.From, opts.To)
+	if err != nil {
+		dbs.log.Error("QueryContext error", zap.Error(err))
+		return resolution, nil, fmt.Errorf("QueryContext error: %w", err)
+	}
+	defer rows.Close()
+
+	var points []Point
+	for rows.Next() {
+		var p Point
+		if err := rows.Scan(&p.Time, &p.Min, &p.Max, &p.Sum, &p.Last, &p.Count); err != nil {
+			dbs.log.Error("cant scan point", zap.Error(err))
+			return resolution, nil, fmt.Errorf("cant scan point: %w", err)
+		}
+		points = append(points, p)
+	}
+	if err := rows.Err(); err != nil {
+		dbs.log.Error("rows iteration error", zap.Error(err))
+		return resolution, nil, fmt.Errorf("rows iteration error: %w", err)
+	}
+
+	return resolution, bucketPoints(points, opts.Step), nil
+}
+
+func (dbs *DBStorage) Compact(ctx context.Context, now time.Time) error {
+	rollUpUntil := now.Add(-rollUpDelay)
+	if err := dbs.rollUp(ctx, rollups1mTable, rollUpSamplesSQL, rollUpUntil.Truncate(time.Minute)); err != nil {
+		return err
+	}
+	if err := dbs.rollUp(ctx, rollups1hTable, rollUpMinutesSQL, rollUpUntil.Truncate(time.Hour)); err != nil {
+		return err
+	}
+
+	if err := dbs.maintainSamplePartitions(ctx, now); err != nil {
+		return err
+	}
+	retention := []struct {
+		table     string
+		retention time.Duration
+	}{
+		{rollups1mTable, MinuteRetention},
+		{rollups1hTable, HourRetention},
+	}
+	for _, r := range retention {
+		_, err := dbs.conn.Exec(ctx, fmt.Sprintf(`DELETE FROM %s WHERE ts < $1`, r.table),
+			now.Add(-r.retention))
+		if err != nil {
+			dbs.log.Error("can't drop expired history", zap.String("table", r.table), zap.Error(err))
+			return fmt.Errorf("can't drop expired history from %s %w", r.table, err)
+		}
+	}
+	return nil
+}
+
+// maintainSamplePartitions creates the partitions of the coming days and
+// drops the expired ones, the samples in the default partition are deleted.
+func (dbs *DBStorage) maintainSamplePartitions(ctx context.Context, now time.Time) error {
+	rows, err := dbs.conn.Query(ctx, listSamplePartitionsSQL, samplesTable)
+	if err != nil {
+		dbs.log.Error("can't list sample partitions", zap.Error(err))
+		return fmt.Errorf("can't list sample partitions %w", err)
+	}
+	var existing []time.Time
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return fmt.Errorf("can't scan sample partition %w", err)
+		}
+		if day, ok := samplePartitionDay(name); ok {
+			existing = append(existing, day)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("can't list sample partitions %w", err)
+	}
+
+	create, drop := planSamplePartitions(existing, now, samplePartitionsAhead, RawRetention)
+	for _, day := range create {
+		err := dbs.conn.BeginFunc(ctx, func(tx pgx.Tx) error {
+			for _, stmt := range createSamplePartitionSQL(day) {
+				if _, err := tx.Exec(ctx, stmt); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			dbs.log.Error("can't create sample partition",
+				zap.String("partition", samplePartitionName(day)), zap.Error(err))
+			return fmt.Errorf("can't create sample partition %s %w", samplePartitionName(day), err)
+		}
+		dbs.log.Info("sample partition created", zap.String("partition", samplePartitionName(day)))
+	}
+	for _, day := range drop {
+		if _, err := dbs.conn.Exec(ctx, dropSamplePartitionSQL(day)); err != nil {
+			dbs.log.Error("can't drop sample partition",
+				zap.String("partition", samplePartitionName(day)), zap.Error(err))
+			return fmt.Errorf("can't drop sample partition %s %w", samplePartitionName(day), err)
+		}
+		dbs.log.Info("expired sample partition dropped", zap.String("partition", samplePartitionName(day)))
+	}
+
+	if _, err := dbs.conn.Exec(ctx, expireDefaultPartitionSQL, now.Add(-RawRetention)); err != nil {
+		dbs.log.Error("can't drop expired history", zap.String("table", samplesDefaultPartition), zap.Error(err))
+		return fmt.Errorf("can't drop expired history from %s %w", samplesDefaultPartition, err)
+	}
+	return nil
+}
+
+// rollUp runs one rollup over the window that follows the previous run and
+// moves the window end in the same transaction.
+func (dbs *DBStorage) rollUp(ctx context.Context, rollup, query string, until time.Time) error {
+	err := dbs.conn.BeginFunc(ctx, func(tx pgx.Tx) error {
+		var from time.Time
+		err := tx.QueryRow(ctx, `SELECT rolled_until FROM metric_rollup_state WHERE rollup=$1 FOR UPDATE`,
+			rollup).Scan(&from)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			return fmt.Errorf("can't get rollup state %w", err)
+		}
+		if !until.After(from) {
+			return nil
+		}
+
+		if _, err := tx.Exec(ctx, query, from, until); err != nil {
+			return fmt.Errorf("can't roll up %w", err)
+		}
+		_, err = tx.Exec(ctx, `
+		INSERT INTO metric_rollup_state (rollup, rolled_until) VALUES ($1, $2)
+		ON CONFLICT (rollup) DO UPDATE SET rolled_until = EXCLUDED.rolled_until`,
+			rollup, until)
+		if err != nil {
+			return fmt.Errorf("can't save rollup state %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		dbs.log.Error("rollup failed", zap.String("rollup", rollup), zap.Error(err))
+		return fmt.Errorf("rollup into %s failed %w", rollup, err)
+	}
+	return nil
+}
@@ -2,49 +2,46 @@ package storage
 
 import (
 	"context"
-	"embed"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
+	"time"
 
 	"github.com/ElizavetaFirst/go-metrics-alerts/internal/constants"
-	"github.com/golang-migrate/migrate/v4"
-	_ "github.com/golang-migrate/migrate/v4/database/postgres"
-	"github.com/golang-migrate/migrate/v4/source/iofs"
+	"github.com/ElizavetaFirst/go-metrics-alerts/internal/metrics"
+	"github.com/cenkalti/backoff"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 	"go.uber.org/zap"
 )
 
-//go:embed migrations/*.sql
-var migrationsDir embed.FS
-
-func runMigrations(databaseDSN string) error {
-	d, err := iofs.New(migrationsDir, "migrations")
-	if err != nil {
-		return fmt.Errorf("failed to return an iofs driver: %w", err)
-	}
-
-	m, err := migrate.NewWithSourceInstance("iofs", d, databaseDSN)
-	if err != nil {
-		return fmt.Errorf("failed to get a new migrate instance: %w", err)
-	}
-	if err := m.Up(); err != nil {
-		if !errors.Is(err, migrate.ErrNoChange) {
-			return fmt.Errorf("failed to apply migrations to the DB: %w", err)
-		}
-	}
-	return nil
+// pgxPool is the part of *pgxpool.Pool that the DB storage uses,
+// so that the tests can run without a database.
+type pgxPool interface {
+	Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+	BeginFunc(ctx context.Context, f func(pgx.Tx) error) error
+	CopyFrom(ctx context.Context, table pgx.Identifier, columns []string, src pgx.CopyFromSource) (int64, error)
+	Ping(ctx context.Context) error
+	Stat() *pgxpool.Stat
+	Close()
 }
 
 type DBStorage struct {
-	conn *pgxpool.Pool
+	conn pgxPool
 	log  *zap.Logger
 }
 
-func NewPostgresStorage(ctx context.Context, databaseDSN string, log *zap.Logger) (*DBStorage, error) {
-	if err := runMigrations(databaseDSN); err != nil {
-		return nil, fmt.Errorf("failed to run DB migrations: %w", err)
+// NewPostgresStorage applies the pending migrations first unless
+// AutoMigrate is off, then the schema is only checked to be up to date.
+func NewPostgresStorage(ctx context.Context, databaseDSN string, opts *PostgresOptions, log *zap.Logger) (*DBStorage, error) {
+	if err := checkMigrations(databaseDSN, opts.AutoMigrate, log); err != nil {
+		return nil, err
 	}
-	conn, err := newDB(ctx, databaseDSN)
+	conn, err := newDB(ctx, databaseDSN, opts)
 	if err != nil {
 		log.Error("database is not inited", zap.Error(err))
 		return nil, fmt.Errorf("database is not inited: %w", ErrCantConnectDB)
@@ -58,43 +55,247 @@ func NewPostgresStorage(ctx context.Context, databaseDSN string, log *zap.Logger
 	return &dbStorage, nil
 }
 
-func (dbs *DBStorage) Update(ctx context.Context, opts *UpdateOptions) error {
+// upsertScalar writes a gauge or a counter: counters are added and gauges
+// are combined with the stored value by the op in $5. The update time in $6
+// is only given when restoring, it is now() otherwise. It returns the stored
+// value and update time.
+const upsertScalar = `
+	INSERT INTO metrics (name, type, value, delta, updated_at)
+	VALUES ($1, $2, $3, $4, COALESCE($6, now()))
+	ON CONFLICT(name, type) DO UPDATE
+	SET value = CASE $5
+			WHEN 'add' THEN metrics.value + EXCLUDED.value
+			WHEN 'max' THEN GREATEST(metrics.value, EXCLUDED.value)
+			WHEN 'min' THEN LEAST(metrics.value, EXCLUDED.value)
+			ELSE EXCLUDED.value
+		END,
+		delta = CASE 
+			WHEN metrics.type = 'counter' THEN metrics.delta + EXCLUDED.delta
+			ELSE EXCLUDED.delta
+		END,
+		updated_at = EXCLUDED.updated_at
+	RETURNING value, updated_at;`
+
+// scalarArgs returns the upsertScalar arguments, ok is false for the
+// types that aren't scalar.
+func scalarArgs(name string, metric Metric, op GaugeOp) ([]interface{}, bool) {
 	var value, delta interface{}
-	switch opts.Update.Type {
-	case constants.Counter:
-		delta = opts.Update.Value
-	case constants.Gauge:
-		value = opts.Update.Value
+	switch v := metric.Value.(type) {
+	case metrics.Counter:
+		delta = int64(v)
+	case metrics.Gauge:
+		value = float64(v)
 	default:
+		return nil, false
+	}
+	return []interface{}{name, metric.Type(), value, delta, string(op), updatedAtArg(metric)}, true
+}
+
+// updatedAtArg is NULL for a metric without an update time.
+func updatedAtArg(metric Metric) interface{} {
+	if metric.UpdatedAt.IsZero() {
+		return nil
+	}
+	return metric.UpdatedAt
+}
+
+func (dbs *DBStorage) Update(ctx context.Context, opts *UpdateOptions) error {
+	// Updates happen now, only SetAll keeps the given update times.
+	update := Metric{Value: opts.Update.Value}
+	if opts.Op != GaugeSet && update.Type() != Gauge {
+		return fmt.Errorf("can't apply %s to %s %s: %w", opts.Op, update.Type(), opts.MetricName, ErrIncorrectType)
+	}
+	if isMergeable(update.Type()) {
+		return dbs.updateMergeable(ctx, opts.MetricName, update)
+	}
+	args, ok := scalarArgs(opts.MetricName, update, opts.Op)
+	if !ok {
 		dbs.log.Error("incorrect type for update metric %s",
-			zap.String("MetricType", string(opts.Update.Type)))
+			zap.String("MetricType", string(update.Type())))
 		return ErrIncorrectType
 	}
 
-	_, err := dbs.conn.Exec(ctx, `
-	INSERT INTO metrics (name, type, value, delta)
-	VALUES ($1, $2, $3, $4)
-	ON CONFLICT(name, type) DO UPDATE
-	SET value = EXCLUDED.value, 
-		delta = CASE 
-			WHEN metrics.type = 'counter' THEN metrics.delta + EXCLUDED.delta
-			ELSE EXCLUDED.delta
-		END;`,
-		opts.MetricName, opts.Update.Type, value, delta)
-
-	if err != nil {
+	if opts.Result != nil && update.Type() == Gauge {
+		result, err := scanGauge(dbs.conn.QueryRow(ctx, upsertScalar, args...))
+		if err != nil {
+			dbs.log.Error("QueryRowContext return error", zap.Error(err))
+			return fmt.Errorf("QueryRowContext return error %w", err)
+		}
+		*opts.Result = result
+		return nil
+	}
+	if _, err := dbs.conn.Exec(ctx, upsertScalar, args...); err != nil {
 		dbs.log.Error("ExecContext return error", zap.Error(err))
 		return fmt.Errorf("ExecContext return error %w", err)
 	}
 	return nil
 }
 
+// scanGauge reads the gauge returned by upsertScalar.
+func scanGauge(row pgx.Row) (Metric, error) {
+	var value float64
+	var updatedAt time.Time
+	if err := row.Scan(&value, &updatedAt); err != nil {
+		return Metric{}, fmt.Errorf("can't scan gauge %w", err)
+	}
+	return Metric{Value: metrics.Gauge(value), UpdatedAt: updatedAt}, nil
+}
+
+type mergeableColumn struct {
+	name    string
+	sqlType string
+}
+
+// mergeableColumns hold the encoded values of the mergeable types: JSON for
+// histograms and sketches, the raw registers for sets.
+var mergeableColumns = map[MetricType]mergeableColumn{
+	Histogram: {name: "histogram", sqlType: "jsonb"},
+	Summary:   {name: "sketch", sqlType: "jsonb"},
+	Set:       {name: "registers", sqlType: "bytea"},
+}
+
+// updateMergeable retries the merge when a concurrent insert of the same
+// series won the race.
+func (dbs *DBStorage) updateMergeable(ctx context.Context, name string, update Metric) error {
+	err := retryTx(ctx, func() error {
+		return dbs.conn.BeginFunc(ctx, func(tx pgx.Tx) error {
+			return mergeInTx(ctx, tx, name, update)
+		})
+	})
+	if err != nil {
+		dbs.log.Error("can't update mergeable metric", zap.String("name", name), zap.Error(err))
+		return fmt.Errorf("can't update %s %w", update.Type(), err)
+	}
+	return nil
+}
+
+// mergeInTx merges the update into the stored value under a row lock,
+// since the encoded values can't be merged in the upsert itself.
+func mergeInTx(ctx context.Context, tx pgx.Tx, name string, metric Metric) error {
+	t := metric.Type()
+	update := metric.Value
+	column := mergeableColumns[t]
+
+	var stored []byte
+	err := tx.QueryRow(ctx, fmt.Sprintf(`SELECT %s FROM metrics WHERE name=$1 AND type=$2 FOR UPDATE`, column.name),
+		name, t).Scan(&stored)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+	case err != nil:
+		return fmt.Errorf("can't get %s %w", t, err)
+	default:
+		current, err := decodeMergeable(t, stored)
+		if err != nil {
+			return err
+		}
+		if update, err = metrics.Merge(current, update); err != nil {
+			return fmt.Errorf("can't merge %s %s: %w", t, name, err)
+		}
+	}
+
+	encoded, err := encodeMergeable(t, update)
+	if err != nil {
+		return err
+	}
+	// A concurrent first insert makes ON CONFLICT fire, and the merge is then lost;
+	// the caller gets an error instead so that it can retry.
+	tag, err := tx.Exec(ctx, fmt.Sprintf(`
+	INSERT INTO metrics (name, type, %[1]s, updated_at)
+	VALUES ($1, $2, $3, COALESCE($5::timestamptz, now()))
+	ON CONFLICT(name, type) DO UPDATE
+	SET %[1]s = EXCLUDED.%[1]s, updated_at = EXCLUDED.updated_at
+	WHERE metrics.%[1]s IS NOT DISTINCT FROM $4::%[2]s`, column.name, column.sqlType),
+		name, t, encoded, stored, updatedAtArg(metric))
+	if err != nil {
+		return fmt.Errorf("can't save %s %w", t, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("%s %s was created concurrently: %w", t, name, ErrConcurrentUpdate)
+	}
+	return nil
+}
+
+func encodeMergeable(t MetricType, v metrics.Value) ([]byte, error) {
+	if hll, ok := v.(metrics.HyperLogLog); ok {
+		return hll.Registers, nil
+	}
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("can't encode %s %w", t, err)
+	}
+	return encoded, nil
+}
+
+func decodeMergeable(t MetricType, data []byte) (metrics.Value, error) {
+	if t == Set {
+		hll := metrics.HyperLogLog{Registers: data}
+		if err := hll.Validate(); err != nil {
+			return nil, fmt.Errorf("can't decode %s %w", t, err)
+		}
+		return hll, nil
+	}
+	value, err := metrics.DecodeValue(string(t), data)
+	if err != nil {
+		return nil, fmt.Errorf("can't decode %s %w", t, err)
+	}
+	return value, nil
+}
+
+// metricColumns are the columns read by metricRow.
+const metricColumns = `value, delta, histogram, sketch, registers, updated_at`
+
+type metricRow struct {
+	value     interface{}
+	delta     interface{}
+	histogram []byte
+	sketch    []byte
+	registers []byte
+	updatedAt time.Time
+}
+
+func (r *metricRow) dest() []interface{} {
+	return []interface{}{&r.value, &r.delta, &r.histogram, &r.sketch, &r.registers, &r.updatedAt}
+}
+
+func (r *metricRow) metric() (Metric, error) {
+	value, err := r.metricValue()
+	if err != nil {
+		return Metric{}, err
+	}
+	return Metric{Value: value, UpdatedAt: r.updatedAt}, nil
+}
+
+func (r *metricRow) metricValue() (metrics.Value, error) {
+	switch {
+	case r.value != nil:
+		value, ok := r.value.(float64)
+		if !ok {
+			return nil, ErrIncorrectType
+		}
+		return metrics.Gauge(value), nil
+	case r.delta != nil:
+		delta, ok := r.delta.(int64)
+		if !ok {
+			return nil, ErrIncorrectType
+		}
+		return metrics.Counter(delta), nil
+	case r.histogram != nil:
+		return decodeMergeable(Histogram, r.histogram)
+	case r.sketch != nil:
+		return decodeMergeable(Summary, r.sketch)
+	case r.registers != nil:
+		return decodeMergeable(Set, r.registers)
+	default:
+		return nil, ErrMetricNotFound
+	}
+}
+
 func (dbs *DBStorage) Get(ctx context.Context, opts *GetOptions) (Metric, error) {
-	row := dbs.conn.QueryRow(ctx, `SELECT value, delta FROM metrics WHERE name=$1 AND type=$2`,
+	row := dbs.conn.QueryRow(ctx, `SELECT `+metricColumns+` FROM metrics WHERE name=$1 AND type=$2`,
 		opts.MetricName, opts.MetricType)
 
-	var value, delta interface{}
-	err := row.Scan(&value, &delta)
+	var r metricRow
+	err := row.Scan(r.dest()...)
 	if err != nil {
 		dbs.log.Error("can't get metric from DBStorage",
 			zap.String("name", opts.MetricName),
@@ -104,79 +305,246 @@ func (dbs *DBStorage) Get(ctx context.Context, opts *GetOptions) (Metric, error)
 			opts.MetricName, opts.MetricType, ErrMetricNotFound)
 	}
 
-	var metricValue interface{}
-	var ok bool
-	switch {
-	case value != nil:
-		if metricValue, ok = value.(float64); !ok {
-			return Metric{}, ErrIncorrectType
-		}
-	case delta != nil:
-		if metricValue, ok = delta.(int64); !ok {
-			return Metric{}, ErrIncorrectType
-		}
-	default:
-		return Metric{}, ErrMetricNotFound
+	metric, err := r.metric()
+	if err != nil {
+		return Metric{}, err
 	}
 
-	metric := Metric{
-		Value: metricValue,
-		Type:  MetricType(opts.MetricType),
-	}
 	return metric, nil
 }
 
-func (dbs *DBStorage) GetAll(ctx context.Context) (map[string]Metric, error) {
-	rows, err := dbs.conn.Query(ctx, `SELECT name, type, value, delta FROM metrics`)
+func (dbs *DBStorage) GetAll(ctx context.Context) (map[MetricKey]Metric, error) {
+	rows, err := dbs.conn.Query(ctx, `SELECT name, type, `+metricColumns+` FROM metrics`)
 	if err != nil {
 		dbs.log.Error("QueryContext error", zap.Error(err))
 		return nil, fmt.Errorf("QueryContext error: %w", err)
 	}
 	defer rows.Close()
 
-	metrics := make(map[string]Metric)
+	metrics := make(map[MetricKey]Metric)
 	for rows.Next() {
 		var (
-			name, t      string
-			value, delta interface{}
+			name, t string
+			r       metricRow
 		)
-		if err := rows.Scan(&name, &t, &value, &delta); err != nil {
+		if err := rows.Scan(append([]interface{}{&name, &t}, r.dest()...)...); err != nil {
 			dbs.log.Error("cant scan metric", zap.Error(err))
 			continue
 		}
 
-		var metricValue interface{}
-		if value != nil {
-			metricValue = value
-		} else if delta != nil {
-			metricValue = delta
+		metric, err := r.metric()
+		if err != nil {
+			dbs.log.Error("cant decode metric value", zap.String("name", name), zap.Error(err))
+			continue
 		}
 
-		metricKey := fmt.Sprintf("%s_%s", name, t)
-		metrics[metricKey] = Metric{Type: MetricType(t), Value: metricValue}
+		metrics[MetricKey{Name: name, Type: MetricType(t)}] = metric
 	}
 
 	return metrics, nil
 }
 
+// SetAll applies the whole batch in one transaction, retrying it on
+// serialization failures, deadlocks and lost connections.
 func (dbs *DBStorage) SetAll(ctx context.Context, opts *SetAllOptions) error {
-	for key, metric := range opts.Metrics {
-		updateOpts := &UpdateOptions{
-			MetricName: key,
-			Update:     metric,
+	// A fixed order makes concurrent batches lock their rows in the same
+	// order, so that they wait for each other instead of deadlocking.
+	keys := make([]MetricKey, 0, len(opts.Metrics))
+	for key := range opts.Metrics {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Name != keys[j].Name {
+			return keys[i].Name < keys[j].Name
+		}
+		return keys[i].Type < keys[j].Type
+	})
+
+	err := retryTx(ctx, func() error {
+		return dbs.conn.BeginFunc(ctx, func(tx pgx.Tx) error {
+			return setAllInTx(ctx, tx, keys, opts)
+		})
+	})
+	if err != nil {
+		dbs.log.Error("can't set all metrics in DBStorage",
+			zap.Int("count", len(keys)), zap.Error(err))
+		return fmt.Errorf("can't set all metrics in DBStorage %w", err)
+	}
+	return nil
+}
+
+func setAllInTx(ctx context.Context, tx pgx.Tx, keys []MetricKey, opts *SetAllOptions) error {
+	batch := &pgx.Batch{}
+	if opts.Replace {
+		for _, key := range keys {
+			batch.Queue(`DELETE FROM metrics WHERE name=$1 AND type=$2`, key.Name, key.Type)
+		}
+	}
+	var mergeable []MetricKey
+	// returning maps the batch index of an upsert to the key its result is for.
+	returning := make(map[int]MetricKey)
+	for _, key := range keys {
+		metric := opts.Metrics[key]
+		if metric.Type() != key.Type {
+			return backoff.Permanent(fmt.Errorf("can't set %s %s to a %s value: %w",
+				key.Type, key.Name, metric.Type(), ErrIncorrectType))
+		}
+		op := opts.GaugeOps[key]
+		if op != GaugeSet && key.Type != Gauge {
+			return backoff.Permanent(fmt.Errorf("can't apply %s to %s %s: %w", op, key.Type, key.Name, ErrIncorrectType))
+		}
+		if isMergeable(key.Type) {
+			mergeable = append(mergeable, key)
+			continue
+		}
+		args, ok := scalarArgs(key.Name, metric, op)
+		if !ok {
+			return backoff.Permanent(fmt.Errorf("can't set %s %s: %w", key.Type, key.Name, ErrIncorrectType))
+		}
+		if opts.Results != nil && op != GaugeSet && !opts.Replace {
+			returning[batch.Len()] = key
+		}
+		batch.Queue(upsertScalar, args...)
+	}
+
+	if batch.Len() > 0 {
+		results := tx.SendBatch(ctx, batch)
+		for i := 0; i < batch.Len(); i++ {
+			if key, ok := returning[i]; ok {
+				result, err := scanGauge(results.QueryRow())
+				if err != nil {
+					_ = results.Close()
+					return fmt.Errorf("can't upsert metric %w", err)
+				}
+				opts.Results[key] = result
+				continue
+			}
+			if _, err := results.Exec(); err != nil {
+				_ = results.Close()
+				return fmt.Errorf("can't upsert metric %w", err)
+			}
+		}
+		if err := results.Close(); err != nil {
+			return fmt.Errorf("can't close batch results %w", err)
+		}
+	}
+
+	for _, key := range mergeable {
+		if err := mergeInTx(ctx, tx, key.Name, opts.Metrics[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (dbs *DBStorage) List(ctx context.Context, opts *ListOptions) ([]NamedMetric, error) {
+	var limit interface{}
+	if opts.Limit > 0 {
+		limit = opts.Limit
+	}
+
+	rows, err := dbs.conn.Query(ctx, `
+	SELECT name, type, `+metricColumns+` FROM metrics
+	WHERE ($1 = '' OR type = $1)
+		AND name LIKE $2
+		AND (name COLLATE "C", type COLLATE "C") > ($3, $4)
+	ORDER BY name COLLATE "C", type COLLATE "C"
+	LIMIT $5`,
+		opts.MetricType, globToLike(opts.Match), opts.AfterName, opts.AfterType, limit)
+	if err != nil {
+		dbs.log.Error("QueryContext error", zap.Error(err))
+		return nil, fmt.Errorf("QueryContext error: %w", err)
+	}
+	defer rows.Close()
+
+	var metrics []NamedMetric
+	for rows.Next() {
+		var (
+			name, t string
+			r       metricRow
+		)
+		if err := rows.Scan(append([]interface{}{&name, &t}, r.dest()...)...); err != nil {
+			dbs.log.Error("cant scan metric", zap.Error(err))
+			return nil, fmt.Errorf("cant scan metric: %w", err)
 		}
-		if err := dbs.Update(ctx, updateOpts); err != nil {
-			dbs.log.Error("can't update DBStorage by",
-				zap.String("MetricName", key),
-				zap.String("MetricType", string(metric.Type)),
-				zap.Error(err))
-			return fmt.Errorf("can't update DBStorage by %s %s: %w", key, metric, err)
+
+		metric, err := r.metric()
+		if err != nil {
+			dbs.log.Error("cant decode metric value", zap.String("name", name), zap.Error(err))
+			continue
 		}
+
+		metrics = append(metrics, NamedMetric{Name: name, Metric: metric})
+	}
+	if err := rows.Err(); err != nil {
+		dbs.log.Error("rows iteration error", zap.Error(err))
+		return nil, fmt.Errorf("rows iteration error: %w", err)
+	}
+
+	return metrics, nil
+}
+
+func (dbs *DBStorage) Delete(ctx context.Context, opts *DeleteOptions) error {
+	tag, err := dbs.conn.Exec(ctx, `DELETE FROM metrics WHERE name=$1 AND type=$2`,
+		opts.MetricName, opts.MetricType)
+	if err != nil {
+		dbs.log.Error("ExecContext return error", zap.Error(err))
+		return fmt.Errorf("ExecContext return error %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("can't delete metric from DBStorage %s %s: %w",
+			opts.MetricName, opts.MetricType, ErrMetricNotFound)
+	}
+	return nil
+}
+
+func (dbs *DBStorage) DeleteMatching(ctx context.Context, opts *DeleteMatchingOptions) (int64, error) {
+	tag, err := dbs.conn.Exec(ctx, `DELETE FROM metrics WHERE ($1 = '' OR type = $1) AND name LIKE $2`,
+		opts.MetricType, globToLike(opts.Match))
+	if err != nil {
+		dbs.log.Error("ExecContext return error", zap.Error(err))
+		return 0, fmt.Errorf("ExecContext return error %w", err)
 	}
+	return tag.RowsAffected(), nil
+}
 
+func (dbs *DBStorage) Reset(ctx context.Context, opts *ResetOptions) error {
+	if opts.MetricType != constants.Counter {
+		return fmt.Errorf("can't reset %s metric %s: %w", opts.MetricType, opts.MetricName, ErrIncorrectType)
+	}
+	tag, err := dbs.conn.Exec(ctx, `UPDATE metrics SET delta = 0, updated_at = now() WHERE name=$1 AND type=$2`,
+		opts.MetricName, opts.MetricType)
+	if err != nil {
+		dbs.log.Error("ExecContext return error", zap.Error(err))
+		return fmt.Errorf("ExecContext return error %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("can't reset metric in DBStorage %s %s: %w",
+			opts.MetricName, opts.MetricType, ErrMetricNotFound)
+	}
 	return nil
 }
 
+func (dbs *DBStorage) DeleteStale(ctx context.Context, opts *DeleteStaleOptions) (int64, error) {
+	if opts.DryRun {
+		var stale int64
+		err := dbs.conn.QueryRow(ctx, `SELECT count(*) FROM metrics WHERE updated_at < $1`,
+			opts.Before).Scan(&stale)
+		if err != nil {
+			dbs.log.Error("can't count stale metrics", zap.Error(err))
+			return 0, fmt.Errorf("can't count stale metrics %w", err)
+		}
+		return stale, nil
+	}
+
+	tag, err := dbs.conn.Exec(ctx, `DELETE FROM metrics WHERE updated_at < $1`, opts.Before)
+	if err != nil {
+		dbs.log.Error("ExecContext return error", zap.Error(err))
+		return 0, fmt.Errorf("ExecContext return error %w", err)
+	}
+	return tag.RowsAffected(), nil
+}
+
 func (dbs *DBStorage) Ping(ctx context.Context) error {
 	if err := dbs.conn.Ping(ctx); err != nil {
 		dbs.log.Error("db ping error", zap.Error(err))
@@ -189,11 +557,3 @@ func (dbs *DBStorage) Close() error {
 	dbs.conn.Close()
 	return nil
 }
-
-func newDB(ctx context.Context, dataSourceName string) (*pgxpool.Pool, error) {
-	conn, err := pgxpool.Connect(ctx, dataSourceName)
-	if err != nil {
-		return nil, fmt.Errorf("can't open database %w", err)
-	}
-	return conn, nil
-}
@@ -0,0 +1,36 @@
+//go:build integration
+
+package storage
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+// TestDBStorage_Conformance runs against TEST_DATABASE_DSN, which must be
+// a scratch database: every case starts by deleting all metrics.
+//
+//	TEST_DATABASE_DSN=postgres://... go test -tags integration ./internal/server/storage/
+func TestDBStorage_Conformance(t *testing.T) {
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_DSN is not set")
+	}
+	testConformance(t, func(t *testing.T) Storage {
+		ctx := context.Background()
+		dbs, err := NewPostgresStorage(ctx, dsn, &PostgresOptions{AutoMigrate: true}, zap.NewNop())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := dbs.DeleteMatching(ctx, &DeleteMatchingOptions{Match: "*"}); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			_ = dbs.Close()
+		})
+		return dbs
+	})
+}
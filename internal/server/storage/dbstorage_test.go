@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"github.com/ElizavetaFirst/go-metrics-alerts/internal/metrics"
+)
+
+// The DB benchmarks run against TEST_DATABASE_DSN and are skipped without it.
+func newBenchDBStorage(b *testing.B) *DBStorage {
+	b.Helper()
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		b.Skip("TEST_DATABASE_DSN is not set")
+	}
+	dbs, err := NewPostgresStorage(context.Background(), dsn, &PostgresOptions{AutoMigrate: true}, zap.NewNop())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		_, _ = dbs.DeleteMatching(context.Background(), &DeleteMatchingOptions{Match: "bench_*"})
+		_ = dbs.Close()
+	})
+	return dbs
+}
+
+func benchBatch(n int) map[MetricKey]Metric {
+	batch := make(map[MetricKey]Metric, n)
+	for i := 0; i < n; i++ {
+		if i%2 == 0 {
+			batch[MetricKey{Name: fmt.Sprintf("bench_gauge_%d", i), Type: Gauge}] = Metric{Value: metrics.Gauge(i)}
+		} else {
+			batch[MetricKey{Name: fmt.Sprintf("bench_counter_%d", i), Type: Counter}] = Metric{Value: metrics.Counter(i)}
+		}
+	}
+	return batch
+}
+
+func BenchmarkDBStorage_SetAll1k(b *testing.B) {
+	ctx := context.Background()
+	dbs := newBenchDBStorage(b)
+	batch := benchBatch(1000)
+
+	b.Run("batch", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if err := dbs.SetAll(ctx, &SetAllOptions{Metrics: batch}); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(b.N*len(batch))/b.Elapsed().Seconds(), "metrics/s")
+	})
+	// The former SetAll: one autocommitted upsert per metric.
+	b.Run("update-per-metric", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for key, metric := range batch {
+				if err := dbs.Update(ctx, &UpdateOptions{MetricName: key.Name, Update: metric}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+		b.ReportMetric(float64(b.N*len(batch))/b.Elapsed().Seconds(), "metrics/s")
+	})
+}
@@ -0,0 +1,427 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"github.com/jackc/pgconn"
+	"go.uber.org/zap"
+
+	"github.com/ElizavetaFirst/go-metrics-alerts/internal/metrics"
+)
+
+const (
+	reconnectInitialInterval = time.Second
+	reconnectMaxInterval     = 30 * time.Second
+)
+
+var (
+	// ErrDegraded is returned by the Ping of a Fallback that serves the
+	// metrics from memory.
+	ErrDegraded = errors.New("storage is degraded")
+	// ErrBufferFull means a degraded Fallback has buffered as many writes
+	// as it may, the write is refused so that memory and the database
+	// don't diverge.
+	ErrBufferFull = errors.New("degraded write buffer is full")
+)
+
+// FallbackStatus is the state of a Fallback.
+type FallbackStatus struct {
+	Degraded bool `json:"degraded"`
+	// Buffered is the number of writes waiting to be replayed.
+	Buffered      int       `json:"buffered"`
+	DegradedSince time.Time `json:"degraded_since,omitempty"`
+	LastError     string    `json:"last_error,omitempty"`
+}
+
+// pendingWrite is a write made in memory while degraded, replayed into the
+// storage once it is connected.
+type pendingWrite struct {
+	method string
+	apply  func(ctx context.Context, s Storage) error
+}
+
+// Fallback serves the metrics from memory while the storage returned by
+// connect can't be opened. The writes are buffered and replayed in order
+// once Run connects, then every call goes to the connected storage.
+// Reads made while degraded only see the buffered writes.
+type Fallback struct {
+	connect     func(ctx context.Context) (Storage, error)
+	onConnected func(s Storage)
+	mem         *MemStorage
+	maxBuffered int
+	log         *zap.Logger
+
+	mu        sync.Mutex
+	connected Storage
+	pending   []pendingWrite
+	since     time.Time
+	lastErr   error
+}
+
+// NewFallback tries connect once and starts degraded when it fails.
+// maxBuffered bounds the writes kept for the replay, zero means no bound.
+// onConnected, when not nil, is called with the storage Fallback switches
+// to, never with one whose replay failed.
+func NewFallback(
+	ctx context.Context,
+	connect func(ctx context.Context) (Storage, error),
+	onConnected func(s Storage),
+	maxBuffered int,
+	log *zap.Logger,
+) *Fallback {
+	f := &Fallback{
+		connect:     connect,
+		onConnected: onConnected,
+		mem:         NewMemStorage(log),
+		maxBuffered: maxBuffered,
+		log:         log,
+	}
+	s, err := connect(ctx)
+	if err != nil {
+		f.since, f.lastErr = time.Now(), err
+		log.Warn("storage is unreachable, serving metrics from memory", zap.Error(err))
+		return f
+	}
+	f.switchTo(s)
+	return f
+}
+
+// switchTo makes s the connected storage, f.mu must be held unless f isn't
+// shared yet.
+func (f *Fallback) switchTo(s Storage) {
+	f.connected = s
+	if f.onConnected != nil {
+		f.onConnected(s)
+	}
+}
+
+func (f *Fallback) Status() FallbackStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	status := FallbackStatus{Degraded: f.connected == nil, Buffered: len(f.pending)}
+	if status.Degraded {
+		status.DegradedSince = f.since
+		if f.lastErr != nil {
+			status.LastError = f.lastErr.Error()
+		}
+	}
+	return status
+}
+
+// Run keeps connecting with backoff until ctx is done or the buffered
+// writes are replayed into the connected storage. A replay cut short by
+// the storage going away again starts over with a new connection.
+func (f *Fallback) Run(ctx context.Context) error {
+	for f.current() == nil {
+		s, ok := f.reconnect(ctx)
+		if !ok {
+			return nil
+		}
+		replayed, err := f.replay(ctx, s)
+		if err != nil {
+			f.log.Warn("storage went away during the replay", zap.Int("replayed", replayed), zap.Error(err))
+			if closeErr := s.Close(); closeErr != nil {
+				f.log.Warn("can't close the storage", zap.Error(closeErr))
+			}
+			continue
+		}
+		f.log.Info("storage is back, left the degraded mode", zap.Int("replayed", replayed))
+	}
+	return nil
+}
+
+// reconnect waits with backoff and calls connect until it succeeds, ok is
+// false once ctx is done.
+func (f *Fallback) reconnect(ctx context.Context) (s Storage, ok bool) {
+	exponentialBackOff := backoff.NewExponentialBackOff()
+	exponentialBackOff.InitialInterval = reconnectInitialInterval
+	exponentialBackOff.MaxInterval = reconnectMaxInterval
+	exponentialBackOff.MaxElapsedTime = 0
+	exponentialBackOff.Reset()
+
+	for attempt := 1; ; attempt++ {
+		timer := time.NewTimer(exponentialBackOff.NextBackOff())
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, false
+		case <-timer.C:
+		}
+
+		s, err := f.connect(ctx)
+		if err == nil {
+			f.log.Info("storage is reachable, replaying the buffered writes", zap.Int("attempt", attempt))
+			return s, true
+		}
+		f.mu.Lock()
+		f.lastErr = err
+		f.mu.Unlock()
+		f.log.Warn("storage is still unreachable", zap.Int("attempt", attempt), zap.Error(err))
+	}
+}
+
+// replay drains the buffer into s and switches to it. The batches are
+// replayed without the lock so that the writes aren't held up; the switch
+// happens under it once no write is left.
+func (f *Fallback) replay(ctx context.Context, s Storage) (int, error) {
+	replayed := 0
+	for {
+		f.mu.Lock()
+		batch := f.pending
+		f.pending = nil
+		if len(batch) == 0 {
+			f.switchTo(s)
+			f.lastErr = nil
+			f.mu.Unlock()
+			return replayed, nil
+		}
+		f.mu.Unlock()
+
+		for i, w := range batch {
+			err := w.apply(ctx, s)
+			if err == nil {
+				replayed++
+				continue
+			}
+			if !isRejection(err) || ctx.Err() != nil {
+				// Keep the rest for the next replay, in order.
+				f.mu.Lock()
+				f.pending = append(batch[i:len(batch):len(batch)], f.pending...)
+				f.lastErr = err
+				f.mu.Unlock()
+				return replayed, fmt.Errorf("can't replay the buffered writes %w", err)
+			}
+			f.log.Warn("dropping a buffered write the storage refused",
+				zap.String("method", w.method), zap.Error(err))
+		}
+	}
+}
+
+// isRejection reports whether the storage definitely refused a write: the
+// database rejected it with an error outside the connection class, or the
+// storage found it incompatible with what it keeps. Any other error may
+// mean the write never arrived.
+func isRejection(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return !strings.HasPrefix(pgErr.Code, pgConnectionException)
+	}
+	return errors.Is(err, ErrMetricNotFound) ||
+		errors.Is(err, ErrIncorrectType) ||
+		errors.Is(err, metrics.ErrHistogramBounds) ||
+		errors.Is(err, metrics.ErrSketchAlpha) ||
+		errors.Is(err, metrics.ErrSketchBins) ||
+		errors.Is(err, metrics.ErrHyperLogLogRegisters) ||
+		errors.Is(err, metrics.ErrTypeMismatch)
+}
+
+// current returns the connected storage, nil while degraded.
+func (f *Fallback) current() Storage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.connected
+}
+
+// write applies a write to the connected storage, or while degraded to
+// memory under the lock and to the buffer when memory accepted it.
+func (f *Fallback) write(ctx context.Context, method string, apply func(ctx context.Context, s Storage) error) error {
+	return f.writeReplayed(ctx, method, apply, apply)
+}
+
+// writeReplayed is write with a separate replay of the buffered write, for
+// the writes that hand results back to the caller: the replay happens after
+// the caller has returned.
+func (f *Fallback) writeReplayed(ctx context.Context, method string, apply, replay func(ctx context.Context, s Storage) error) error {
+	f.mu.Lock()
+	if s := f.connected; s != nil {
+		f.mu.Unlock()
+		return apply(ctx, s)
+	}
+	defer f.mu.Unlock()
+	if f.maxBuffered > 0 && len(f.pending) >= f.maxBuffered {
+		return fmt.Errorf("%s failed %w", method, ErrBufferFull)
+	}
+	if err := apply(ctx, f.mem); err != nil {
+		return err
+	}
+	f.pending = append(f.pending, pendingWrite{method: method, apply: replay})
+	return nil
+}
+
+func (f *Fallback) reader() Storage {
+	if s := f.current(); s != nil {
+		return s
+	}
+	return f.mem
+}
+
+func (f *Fallback) Update(ctx context.Context, opts *UpdateOptions) error {
+	replayed := *opts
+	replayed.Result = nil
+	return f.writeReplayed(ctx, "Update", func(ctx context.Context, s Storage) error {
+		return s.Update(ctx, opts)
+	}, func(ctx context.Context, s Storage) error {
+		return s.Update(ctx, &replayed)
+	})
+}
+
+func (f *Fallback) Get(ctx context.Context, opts *GetOptions) (Metric, error) {
+	return f.reader().Get(ctx, opts)
+}
+
+func (f *Fallback) GetAll(ctx context.Context) (map[MetricKey]Metric, error) {
+	return f.reader().GetAll(ctx)
+}
+
+func (f *Fallback) SetAll(ctx context.Context, opts *SetAllOptions) error {
+	replayed := *opts
+	replayed.Results = nil
+	return f.writeReplayed(ctx, "SetAll", func(ctx context.Context, s Storage) error {
+		return s.SetAll(ctx, opts)
+	}, func(ctx context.Context, s Storage) error {
+		return s.SetAll(ctx, &replayed)
+	})
+}
+
+func (f *Fallback) List(ctx context.Context, opts *ListOptions) ([]NamedMetric, error) {
+	return f.reader().List(ctx, opts)
+}
+
+func (f *Fallback) Delete(ctx context.Context, opts *DeleteOptions) error {
+	return f.write(ctx, "Delete", func(ctx context.Context, s Storage) error {
+		return s.Delete(ctx, opts)
+	})
+}
+
+func (f *Fallback) DeleteMatching(ctx context.Context, opts *DeleteMatchingOptions) (int64, error) {
+	var deleted int64
+	err := f.write(ctx, "DeleteMatching", func(ctx context.Context, s Storage) error {
+		var err error
+		deleted, err = s.DeleteMatching(ctx, opts)
+		return err
+	})
+	return deleted, err
+}
+
+func (f *Fallback) Reset(ctx context.Context, opts *ResetOptions) error {
+	return f.write(ctx, "Reset", func(ctx context.Context, s Storage) error {
+		return s.Reset(ctx, opts)
+	})
+}
+
+func (f *Fallback) DeleteStale(ctx context.Context, opts *DeleteStaleOptions) (int64, error) {
+	if opts.DryRun {
+		return f.reader().DeleteStale(ctx, opts)
+	}
+	var deleted int64
+	err := f.write(ctx, "DeleteStale", func(ctx context.Context, s Storage) error {
+		var err error
+		deleted, err = s.DeleteStale(ctx, opts)
+		return err
+	})
+	return deleted, err
+}
+
+// Ping fails with ErrDegraded while the metrics are served from memory.
+func (f *Fallback) Ping(ctx context.Context) error {
+	if s := f.current(); s != nil {
+		return s.Ping(ctx)
+	}
+	return fmt.Errorf("ping failed %w", ErrDegraded)
+}
+
+// Close drops the writes that were never replayed.
+func (f *Fallback) Close() error {
+	f.mu.Lock()
+	s, pending := f.connected, len(f.pending)
+	f.mu.Unlock()
+	if s == nil {
+		if pending > 0 {
+			f.log.Warn("closing degraded storage, the buffered writes are lost", zap.Int("buffered", pending))
+		}
+		return f.mem.Close()
+	}
+	return s.Close()
+}
+
+// FallbackHistory keeps the history in memory while connected returns nil,
+// and uses the history connected returns otherwise, once the samples recorded
+// in memory are moved there.
+type FallbackHistory struct {
+	connected func() History
+
+	mu      sync.Mutex
+	mem     *MemHistory
+	pending []Sample
+}
+
+// NewFallbackHistory takes connected returning nil while degraded.
+func NewFallbackHistory(connected func() History) *FallbackHistory {
+	return &FallbackHistory{connected: connected, mem: NewMemHistory()}
+}
+
+// target returns the connected history, nil while the samples are kept in
+// memory. h.mu must be held.
+func (h *FallbackHistory) target(ctx context.Context) History {
+	db := h.connected()
+	if db == nil || len(h.pending) == 0 {
+		return db
+	}
+	// Stay in memory until the samples are moved, the next call retries.
+	if err := db.AppendSamples(ctx, h.pending); err != nil {
+		return nil
+	}
+	h.pending, h.mem = nil, NewMemHistory()
+	return db
+}
+
+func (h *FallbackHistory) AppendSamples(ctx context.Context, samples []Sample) error {
+	h.mu.Lock()
+	db := h.target(ctx)
+	if db == nil {
+		defer h.mu.Unlock()
+		h.pending = append(h.pending, samples...)
+		return h.mem.AppendSamples(ctx, samples)
+	}
+	h.mu.Unlock()
+	return db.AppendSamples(ctx, samples)
+}
+
+func (h *FallbackHistory) QueryHistory(ctx context.Context, opts *HistoryOptions) (Resolution, []Point, error) {
+	h.mu.Lock()
+	db, mem := h.target(ctx), h.mem
+	h.mu.Unlock()
+	if db == nil {
+		return mem.QueryHistory(ctx, opts)
+	}
+	return db.QueryHistory(ctx, opts)
+}
+
+// Compact drops the pending samples the database would no longer keep raw.
+func (h *FallbackHistory) Compact(ctx context.Context, now time.Time) error {
+	h.mu.Lock()
+	db := h.target(ctx)
+	if db == nil {
+		defer h.mu.Unlock()
+		h.pending = dropSamplesBefore(h.pending, now.Add(-RawRetention))
+		return h.mem.Compact(ctx, now)
+	}
+	h.mu.Unlock()
+	return db.Compact(ctx, now)
+}
+
+func dropSamplesBefore(samples []Sample, before time.Time) []Sample {
+	kept := samples[:0]
+	for _, s := range samples {
+		if !s.Time.Before(before) {
+			kept = append(kept, s)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,187 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/ElizavetaFirst/go-metrics-alerts/internal/metrics"
+)
+
+var errUnreachable = errors.New("connection refused")
+
+// flakyConnect fails until up is called, then connects to target.
+type flakyConnect struct {
+	mu       sync.Mutex
+	target   Storage
+	up       bool
+	attempts int
+}
+
+func (c *flakyConnect) connect(context.Context) (Storage, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.attempts++
+	if !c.up {
+		return nil, errUnreachable
+	}
+	return c.target, nil
+}
+
+func (c *flakyConnect) setUp() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.up = true
+}
+
+func TestFallback_Conformance(t *testing.T) {
+	t.Run("Connected", func(t *testing.T) {
+		testConformance(t, func(t *testing.T) Storage {
+			c := &flakyConnect{target: NewMemStorage(zap.NewNop()), up: true}
+			return NewFallback(context.Background(), c.connect, nil, 0, zap.NewNop())
+		})
+	})
+	t.Run("Degraded", func(t *testing.T) {
+		testConformance(t, func(t *testing.T) Storage {
+			c := &flakyConnect{}
+			return NewFallback(context.Background(), c.connect, nil, 0, zap.NewNop())
+		})
+	})
+}
+
+func TestFallback_Replay(t *testing.T) {
+	ctx := context.Background()
+	db := NewMemStorage(zap.NewNop())
+	require.NoError(t, db.Update(ctx, &UpdateOptions{MetricName: "Hits", Update: Metric{Value: metrics.Counter(10)}}))
+	c := &flakyConnect{target: db}
+
+	f := NewFallback(ctx, c.connect, nil, 0, zap.NewNop())
+	assert.ErrorIs(t, f.Ping(ctx), ErrDegraded)
+
+	require.NoError(t, f.Update(ctx, &UpdateOptions{MetricName: "Hits", Update: Metric{Value: metrics.Counter(2)}}))
+	require.NoError(t, f.Update(ctx, &UpdateOptions{MetricName: "Alloc", Update: Metric{Value: metrics.Gauge(5)}}))
+	require.NoError(t, f.Update(ctx, &UpdateOptions{
+		MetricName: "Alloc", Update: Metric{Value: metrics.Gauge(3)}, Op: GaugeMin,
+	}))
+	// Degraded reads only see the buffered writes.
+	assert.Equal(t, metrics.Counter(2), mustGet(t, f, "Hits", Counter).Value)
+
+	status := f.Status()
+	assert.True(t, status.Degraded)
+	assert.Equal(t, 3, status.Buffered)
+	assert.Equal(t, errUnreachable.Error(), status.LastError)
+
+	c.setUp()
+	require.NoError(t, f.Run(ctx))
+	require.NoError(t, f.Ping(ctx))
+	assert.Equal(t, FallbackStatus{}, f.Status())
+	assert.Equal(t, metrics.Counter(12), mustGet(t, db, "Hits", Counter).Value)
+	assert.Equal(t, metrics.Gauge(3), mustGet(t, db, "Alloc", Gauge).Value)
+
+	// Connected, the writes go straight to the storage.
+	require.NoError(t, f.Update(ctx, &UpdateOptions{MetricName: "Hits", Update: Metric{Value: metrics.Counter(1)}}))
+	assert.Equal(t, metrics.Counter(13), mustGet(t, db, "Hits", Counter).Value)
+}
+
+// failingStorage fails the updates with err while it is set.
+type failingStorage struct {
+	Storage
+	err error
+}
+
+func (s *failingStorage) Update(ctx context.Context, opts *UpdateOptions) error {
+	if s.err != nil {
+		return s.err
+	}
+	return s.Storage.Update(ctx, opts)
+}
+
+func TestFallback_ReplayDropsOnlyRejectedWrites(t *testing.T) {
+	ctx := context.Background()
+	db := &failingStorage{Storage: NewMemStorage(zap.NewNop())}
+	var switched []Storage
+	f := NewFallback(ctx, (&flakyConnect{}).connect, func(s Storage) { switched = append(switched, s) }, 0, zap.NewNop())
+	require.NoError(t, f.Update(ctx, &UpdateOptions{MetricName: "Hits", Update: Metric{Value: metrics.Counter(1)}}))
+
+	// An error that doesn't say the write was refused keeps it, and the
+	// storage isn't switched to.
+	for _, err := range []error{errors.New("connection reset by peer"), &pgconn.PgError{Code: "08006"}} {
+		db.err = err
+		_, replayErr := f.replay(ctx, db)
+		assert.ErrorIs(t, replayErr, err)
+		assert.Equal(t, 1, f.Status().Buffered)
+		assert.Empty(t, switched)
+	}
+
+	db.err = &pgconn.PgError{Code: "23505"}
+	replayed, err := f.replay(ctx, db)
+	require.NoError(t, err)
+	assert.Equal(t, 0, replayed)
+	assert.Equal(t, FallbackStatus{}, f.Status())
+	assert.Equal(t, []Storage{db}, switched)
+}
+
+func TestFallback_BufferFull(t *testing.T) {
+	ctx := context.Background()
+	c := &flakyConnect{}
+	f := NewFallback(ctx, c.connect, nil, 1, zap.NewNop())
+
+	require.NoError(t, f.Update(ctx, &UpdateOptions{MetricName: "Hits", Update: Metric{Value: metrics.Counter(1)}}))
+	err := f.Update(ctx, &UpdateOptions{MetricName: "Hits", Update: Metric{Value: metrics.Counter(1)}})
+	assert.ErrorIs(t, err, ErrBufferFull)
+	// The refused write isn't applied in memory either.
+	assert.Equal(t, metrics.Counter(1), mustGet(t, f, "Hits", Counter).Value)
+}
+
+func TestFallback_RunStopsWithContext(t *testing.T) {
+	c := &flakyConnect{}
+	f := NewFallback(context.Background(), c.connect, nil, 0, zap.NewNop())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	require.NoError(t, f.Run(ctx))
+	assert.True(t, f.Status().Degraded)
+}
+
+func TestFallbackHistory_MovesToStorageOnConnect(t *testing.T) {
+	ctx := context.Background()
+	db := NewMemHistory()
+	var connected History
+	h := NewFallbackHistory(func() History { return connected })
+
+	start := time.Now().Add(-time.Hour).Truncate(time.Minute)
+	sample := func(at time.Duration, value float64) []Sample {
+		return []Sample{{Time: start.Add(at), Name: "Alloc", Type: Gauge, Value: value}}
+	}
+	query := func(s History) []Point {
+		_, points, err := s.QueryHistory(ctx, &HistoryOptions{
+			MetricName: "Alloc", MetricType: string(Gauge), From: start, To: start.Add(time.Hour), Step: time.Second,
+		})
+		require.NoError(t, err)
+		return points
+	}
+
+	// Degraded, the samples are kept and queried in memory.
+	require.NoError(t, h.AppendSamples(ctx, sample(time.Second, 1)))
+	assert.Len(t, query(h), 1)
+	assert.Empty(t, query(db))
+
+	// Once connected, they are moved and the new ones go to the storage.
+	connected = db
+	require.NoError(t, h.AppendSamples(ctx, sample(time.Minute, 2)))
+	assert.Len(t, query(db), 2)
+	assert.Len(t, query(h), 2)
+
+	// Without a connected history, they are kept in memory again.
+	connected = nil
+	require.NoError(t, h.AppendSamples(ctx, sample(2*time.Minute, 3)))
+	assert.Len(t, query(h), 1)
+	assert.Len(t, query(db), 2)
+}
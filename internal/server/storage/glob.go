@@ -0,0 +1,52 @@
+package storage
+
+import "strings"
+
+// Globs support only `*` (any run of characters) and `?` (exactly one character),
+// so the same pattern can be evaluated in memory and translated to SQL LIKE.
+
+func matchGlob(pattern, name string) bool {
+	p, n := []rune(pattern), []rune(name)
+	pi, ni := 0, 0
+	starPi, starNi := -1, 0
+	for ni < len(n) {
+		switch {
+		case pi < len(p) && (p[pi] == '?' || p[pi] == n[ni]):
+			pi++
+			ni++
+		case pi < len(p) && p[pi] == '*':
+			starPi, starNi = pi, ni
+			pi++
+		case starPi >= 0:
+			starNi++
+			pi, ni = starPi+1, starNi
+		default:
+			return false
+		}
+	}
+	for pi < len(p) && p[pi] == '*' {
+		pi++
+	}
+	return pi == len(p)
+}
+
+func globToLike(pattern string) string {
+	if pattern == "" {
+		return "%"
+	}
+	var b strings.Builder
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			b.WriteRune('%')
+		case '?':
+			b.WriteRune('_')
+		case '%', '_', '\\':
+			b.WriteRune('\\')
+			b.WriteRune(r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,232 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"math"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/ElizavetaFirst/go-metrics-alerts/internal/metrics"
+)
+
+// Retention of every history tier. Raw samples are rolled up into minute
+// aggregates, and minute aggregates into hour aggregates, by Compact.
+const (
+	RawRetention    = 24 * time.Hour
+	MinuteRetention = 30 * 24 * time.Hour
+	HourRetention   = 365 * 24 * time.Hour
+
+	// rollUpDelay leaves time for the samples stamped right before
+	// a bucket boundary to be appended before the bucket is rolled up.
+	rollUpDelay = 10 * time.Second
+)
+
+type (
+	Resolution time.Duration
+
+	Sample struct {
+		Time  time.Time
+		Name  string
+		Type  MetricType
+		Value float64
+	}
+
+	// Point aggregates the samples of one bucket. A raw sample is a point with Count 1.
+	Point struct {
+		Time  time.Time
+		Min   float64
+		Max   float64
+		Sum   float64
+		Last  float64
+		Count int64
+	}
+
+	HistoryOptions struct {
+		From       time.Time
+		To         time.Time
+		MetricName string
+		MetricType string
+		// Step is the bucket width of the result, zero returns points as stored.
+		Step time.Duration
+	}
+)
+
+const (
+	ResolutionRaw    Resolution = 0
+	ResolutionMinute            = Resolution(time.Minute)
+	ResolutionHour              = Resolution(time.Hour)
+)
+
+type History interface {
+	AppendSamples(ctx context.Context, samples []Sample) error
+	QueryHistory(ctx context.Context, opts *HistoryOptions) (Resolution, []Point, error)
+	Compact(ctx context.Context, now time.Time) error
+}
+
+func (r Resolution) String() string {
+	if r == ResolutionRaw {
+		return "raw"
+	}
+	return time.Duration(r).String()
+}
+
+func (p Point) Avg() float64 {
+	if p.Count == 0 {
+		return 0
+	}
+	return p.Sum / float64(p.Count)
+}
+
+// merge folds a later point into p.
+func (p Point) merge(later Point) Point {
+	if p.Count == 0 {
+		return later
+	}
+	p.Min = math.Min(p.Min, later.Min)
+	p.Max = math.Max(p.Max, later.Max)
+	p.Sum += later.Sum
+	p.Count += later.Count
+	p.Last = later.Last
+	return p
+}
+
+func pointFromSample(s Sample) Point {
+	return Point{Time: s.Time, Min: s.Value, Max: s.Value, Sum: s.Value, Last: s.Value, Count: 1}
+}
+
+// PickResolution returns the coarsest tier not wider than step that still
+// holds data as old as from.
+func PickResolution(step time.Duration, from, now time.Time) Resolution {
+	tiers := []struct {
+		resolution Resolution
+		retention  time.Duration
+	}{
+		{ResolutionRaw, RawRetention},
+		{ResolutionMinute, MinuteRetention},
+		{ResolutionHour, HourRetention},
+	}
+
+	picked := 0
+	for i, tier := range tiers {
+		if time.Duration(tier.resolution) <= step {
+			picked = i
+		}
+	}
+	for picked < len(tiers)-1 && from.Before(now.Add(-tiers[picked].retention)) {
+		picked++
+	}
+	return tiers[picked].resolution
+}
+
+// bucketPoints merges time-ordered points into buckets of step width.
+func bucketPoints(points []Point, step time.Duration) []Point {
+	if step <= 0 || len(points) == 0 {
+		return points
+	}
+	result := make([]Point, 0, len(points))
+	for _, p := range points {
+		bucket := p.Time.Truncate(step)
+		if len(result) > 0 && result[len(result)-1].Time.Equal(bucket) {
+			result[len(result)-1] = result[len(result)-1].merge(p)
+			continue
+		}
+		p.Time = bucket
+		result = append(result, p)
+	}
+	return result
+}
+
+// historyRecorder appends a sample for every successful write.
+type historyRecorder struct {
+	Storage
+	history History
+	log     *zap.Logger
+	now     func() time.Time
+}
+
+// WithHistory wraps s so that every update is also recorded in h.
+// Counters are recorded as increments, gauges as values.
+func WithHistory(s Storage, h History, log *zap.Logger) Storage {
+	return &historyRecorder{
+		Storage: s,
+		history: h,
+		log:     log,
+		now:     time.Now,
+	}
+}
+
+func (hr *historyRecorder) Update(ctx context.Context, opts *UpdateOptions) error {
+	if opts.Op == GaugeSet {
+		if err := hr.Storage.Update(ctx, opts); err != nil {
+			return fmt.Errorf("can't update metric %w", err)
+		}
+		hr.record(ctx, map[MetricKey]Metric{{Name: opts.MetricName, Type: opts.Update.Type()}: opts.Update})
+		return nil
+	}
+	// The sample is the resulting gauge, not the operand.
+	withResult := *opts
+	var result Metric
+	withResult.Result = &result
+	if err := hr.Storage.Update(ctx, &withResult); err != nil {
+		return fmt.Errorf("can't update metric %w", err)
+	}
+	if opts.Result != nil {
+		*opts.Result = result
+	}
+	hr.record(ctx, map[MetricKey]Metric{{Name: opts.MetricName, Type: Gauge}: result})
+	return nil
+}
+
+func (hr *historyRecorder) SetAll(ctx context.Context, opts *SetAllOptions) error {
+	if len(opts.GaugeOps) == 0 || opts.Replace {
+		if err := hr.Storage.SetAll(ctx, opts); err != nil {
+			return fmt.Errorf("can't set all metrics %w", err)
+		}
+		hr.record(ctx, opts.Metrics)
+		return nil
+	}
+	// The samples of the gauges with an op are the resulting gauges.
+	withResults := *opts
+	withResults.Results = make(map[MetricKey]Metric, len(opts.GaugeOps))
+	if err := hr.Storage.SetAll(ctx, &withResults); err != nil {
+		return fmt.Errorf("can't set all metrics %w", err)
+	}
+	updates := maps.Clone(opts.Metrics)
+	for key, result := range withResults.Results {
+		updates[key] = result
+		if opts.Results != nil {
+			opts.Results[key] = result
+		}
+	}
+	hr.record(ctx, updates)
+	return nil
+}
+
+// record never fails the write: history is secondary to the current values.
+func (hr *historyRecorder) record(ctx context.Context, updates map[MetricKey]Metric) {
+	now := hr.now()
+	samples := make([]Sample, 0, len(updates))
+	for key, metric := range updates {
+		value, ok := sampleValue(metric.Value)
+		if !ok {
+			continue
+		}
+		samples = append(samples, Sample{Time: now, Name: key.Name, Type: key.Type, Value: value})
+	}
+	if err := hr.history.AppendSamples(ctx, samples); err != nil {
+		hr.log.Warn("can't append samples to history", zap.Error(err))
+	}
+}
+
+func sampleValue(v metrics.Value) (float64, bool) {
+	switch value := v.(type) {
+	case metrics.Gauge:
+		return float64(value), true
+	case metrics.Counter:
+		return float64(value), true
+	}
+	return 0, false
+}
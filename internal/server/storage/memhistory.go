@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+type series struct {
+	raw    []Point
+	minute []Point
+	hour   []Point
+	// minuteUntil and hourUntil are the ends of the already rolled up windows.
+	minuteUntil time.Time
+	hourUntil   time.Time
+}
+
+type MemHistory struct {
+	series map[string]*series
+	mu     sync.Mutex
+}
+
+func NewMemHistory() *MemHistory {
+	return &MemHistory{series: make(map[string]*series)}
+}
+
+func (mh *MemHistory) AppendSamples(ctx context.Context, samples []Sample) error {
+	mh.mu.Lock()
+	defer mh.mu.Unlock()
+
+	for _, s := range samples {
+		key := s.Name + string(s.Type)
+		ser, ok := mh.series[key]
+		if !ok {
+			ser = &series{}
+			mh.series[key] = ser
+		}
+		ser.raw = append(ser.raw, pointFromSample(s))
+	}
+	return nil
+}
+
+func (mh *MemHistory) QueryHistory(ctx context.Context, opts *HistoryOptions) (Resolution, []Point, error) {
+	resolution := PickResolution(opts.Step, opts.From, time.Now())
+
+	mh.mu.Lock()
+	defer mh.mu.Unlock()
+
+	ser, ok := mh.series[opts.MetricName+opts.MetricType]
+	if !ok {
+		return resolution, nil, nil
+	}
+
+	var tier []Point
+	switch resolution {
+	case ResolutionRaw:
+		tier = ser.raw
+	case ResolutionMinute:
+		tier = ser.minute
+	case ResolutionHour:
+		tier = ser.hour
+	}
+
+	var points []Point
+	for _, p := range tier {
+		if !p.Time.Before(opts.From) && p.Time.Before(opts.To) {
+			points = append(points, p)
+		}
+	}
+	return resolution, bucketPoints(points, opts.Step), nil
+}
+
+func (mh *MemHistory) Compact(ctx context.Context, now time.Time) error {
+	mh.mu.Lock()
+	defer mh.mu.Unlock()
+
+	for key, ser := range mh.series {
+		ser.minute, ser.minuteUntil = rollUp(ser.raw, ser.minute, ser.minuteUntil, now.Add(-rollUpDelay), time.Minute)
+		ser.hour, ser.hourUntil = rollUp(ser.minute, ser.hour, ser.hourUntil, now.Add(-rollUpDelay), time.Hour)
+
+		ser.raw = dropBefore(ser.raw, now.Add(-RawRetention))
+		ser.minute = dropBefore(ser.minute, now.Add(-MinuteRetention))
+		ser.hour = dropBefore(ser.hour, now.Add(-HourRetention))
+		if len(ser.raw) == 0 && len(ser.minute) == 0 && len(ser.hour) == 0 {
+			delete(mh.series, key)
+		}
+	}
+	return nil
+}
+
+// rollUp aggregates the points of the complete buckets in [from, now) into dst.
+func rollUp(src, dst []Point, from, now time.Time, bucket time.Duration) ([]Point, time.Time) {
+	until := now.Truncate(bucket)
+	if !until.After(from) {
+		return dst, from
+	}
+
+	var window []Point
+	for _, p := range src {
+		if !p.Time.Before(from) && p.Time.Before(until) {
+			window = append(window, p)
+		}
+	}
+	sort.SliceStable(window, func(i, j int) bool {
+		return window[i].Time.Before(window[j].Time)
+	})
+	return append(dst, bucketPoints(window, bucket)...), until
+}
+
+func dropBefore(points []Point, before time.Time) []Point {
+	i := sort.Search(len(points), func(i int) bool {
+		return !points[i].Time.Before(before)
+	})
+	return points[i:]
+}
@@ -2,64 +2,169 @@ package storage
 
 import (
 	"context"
-	"errors"
 	"fmt"
+	"hash/maphash"
+	"sort"
 	"sync"
+	"time"
 
 	"go.uber.org/zap"
 
-	"github.com/ElizavetaFirst/go-metrics-alerts/internal/constants"
+	"github.com/ElizavetaFirst/go-metrics-alerts/internal/metrics"
 )
 
+// memShards spreads the keys over independently locked maps, so that writes
+// to different series rarely wait for each other.
+const memShards = 32
+
+var memSeed = maphash.MakeSeed()
+
+type memShard struct {
+	mu   sync.RWMutex
+	data map[MetricKey]Metric
+}
+
+// MemStorage is ready to use as a zero value, the shard maps are made on first write.
 type MemStorage struct {
-	log  *zap.Logger
-	data sync.Map
+	log    *zap.Logger
+	shards [memShards]memShard
 }
 
 func NewMemStorage(log *zap.Logger) *MemStorage {
 	return &MemStorage{log: log}
 }
 
+func (ms *MemStorage) shard(key MetricKey) *memShard {
+	var h maphash.Hash
+	h.SetSeed(memSeed)
+	_, _ = h.WriteString(key.Name)
+	_ = h.WriteByte(0)
+	_, _ = h.WriteString(string(key.Type))
+	return &ms.shards[h.Sum64()%memShards]
+}
+
+// forEach calls fn for every shard under its write lock.
+func (ms *MemStorage) forEach(fn func(s *memShard)) {
+	for i := range ms.shards {
+		s := &ms.shards[i]
+		s.mu.Lock()
+		fn(s)
+		s.mu.Unlock()
+	}
+}
+
+// forEachRead calls fn for every shard under its read lock.
+func (ms *MemStorage) forEachRead(fn func(s *memShard)) {
+	for i := range ms.shards {
+		s := &ms.shards[i]
+		s.mu.RLock()
+		fn(s)
+		s.mu.RUnlock()
+	}
+}
+
 func (ms *MemStorage) Update(ctx context.Context, opts *UpdateOptions) error {
-	metricName := opts.MetricName
 	update := opts.Update
-	uniqueID := metricName + string(update.Type)
-	m, exists := ms.data.Load(uniqueID)
+	if update.Value == nil {
+		return fmt.Errorf("can't update %s without a value: %w", opts.MetricName, ErrIncorrectType)
+	}
+	key := MetricKey{Name: opts.MetricName, Type: update.Type()}
+	if opts.Op != GaugeSet && key.Type != Gauge {
+		return fmt.Errorf("can't apply %s to %s %s: %w", opts.Op, key.Type, key.Name, ErrIncorrectType)
+	}
+	update.UpdatedAt = time.Now()
+
+	s := ms.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := ms.apply(s, key, update, opts.Op); err != nil {
+		return err
+	}
+	if opts.Result != nil && key.Type == Gauge {
+		*opts.Result = s.data[key]
+	}
+	return nil
+}
+
+// apply combines the update with the stored metric, the shard must be locked.
+func (ms *MemStorage) apply(s *memShard, key MetricKey, update Metric, op GaugeOp) error {
+	if s.data == nil {
+		s.data = make(map[MetricKey]Metric)
+	}
+	metric, exists := s.data[key]
 	if !exists {
-		ms.data.Store(uniqueID, update)
+		s.data[key] = update
 		return nil
 	}
-	metric, ok := m.(Metric)
-	if !ok {
-		return errors.New("can't get metric")
-	}
 
-	switch metric.Type {
-	case Gauge:
-		metric.Value = update.Value
-	case Counter:
-		if value, ok := metric.Value.(int64); ok {
-			if newValue, ok := update.Value.(int64); ok {
-				metric.Value = value + newValue
-			}
-		} else {
-			ms.log.Error("unexpected value type for counter metric",
-				zap.String("uniqueID", uniqueID))
-			return errors.New("unexpected value type for counter metric")
+	if current, ok := metric.Value.(metrics.Gauge); ok {
+		if gauge, ok := update.Value.(metrics.Gauge); ok {
+			update.Value = metrics.Gauge(op.apply(float64(current), float64(gauge)))
 		}
 	}
+	merged, err := metrics.Merge(metric.Value, update.Value)
+	if err != nil {
+		ms.log.Error("can't merge metric",
+			zap.String("name", key.Name), zap.String("type", string(key.Type)), zap.Error(err))
+		return fmt.Errorf("can't merge %s %s: %w", key.Type, key.Name, err)
+	}
 
-	ms.data.Store(uniqueID, metric)
+	s.data[key] = Metric{Value: merged, UpdatedAt: update.UpdatedAt}
 	return nil
 }
 
+// put stores the metric as is, replacing the stored one.
+func (ms *MemStorage) put(key MetricKey, metric Metric) {
+	s := ms.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.data == nil {
+		s.data = make(map[MetricKey]Metric)
+	}
+	s.data[key] = metric
+}
+
+// lookup is Get without the logging, for callers that expect misses.
+func (ms *MemStorage) lookup(key MetricKey) (Metric, bool) {
+	s := ms.shard(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	metric, ok := s.data[key]
+	return metric, ok
+}
+
+// remove deletes the metric if it is stored.
+func (ms *MemStorage) remove(key MetricKey) {
+	s := ms.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.data, key)
+}
+
+// keys returns the keys of the metrics fn accepts.
+func (ms *MemStorage) keys(fn func(key MetricKey, metric Metric) bool) []MetricKey {
+	var keys []MetricKey
+	ms.forEachRead(func(s *memShard) {
+		for key, metric := range s.data {
+			if fn(key, metric) {
+				keys = append(keys, key)
+			}
+		}
+	})
+	return keys
+}
+
 func (ms *MemStorage) Get(ctx context.Context, opts *GetOptions) (Metric, error) {
 	metricName := opts.MetricName
 	metricType := opts.MetricType
-	uniqueID := metricName + metricType
-	metric, exists := ms.data.Load(uniqueID)
+	key := MetricKey{Name: metricName, Type: MetricType(metricType)}
+
+	s := ms.shard(key)
+	s.mu.RLock()
+	metric, exists := s.data[key]
+	s.mu.RUnlock()
 	if exists {
-		return metric.(Metric), nil
+		return metric, nil
 	}
 	ms.log.Error("can't get metric from MemStorage",
 		zap.String("MetricName", metricName),
@@ -67,38 +172,153 @@ func (ms *MemStorage) Get(ctx context.Context, opts *GetOptions) (Metric, error)
 	return Metric{}, fmt.Errorf("can't get metric from MemStorage %s %s: %w", metricName, metricType, ErrMetricNotFound)
 }
 
-func (ms *MemStorage) GetAll(ctx context.Context) (map[string]Metric, error) {
-	result := make(map[string]Metric)
-	ms.data.Range(func(key, value interface{}) bool {
-		keyStr, ok := key.(string)
-		if !ok {
-			ms.log.Warn("can't get key value")
+func (ms *MemStorage) GetAll(ctx context.Context) (map[MetricKey]Metric, error) {
+	result := make(map[MetricKey]Metric)
+	ms.forEachRead(func(s *memShard) {
+		for key, metric := range s.data {
+			result[key] = metric
+		}
+	})
+	return result, nil
+}
+
+// SetAll applies the metrics like Update does: counters are added,
+// mergeable values are merged and gauges are overwritten. A batch with a
+// value of the wrong type is rejected before anything is written.
+func (ms *MemStorage) SetAll(ctx context.Context, opts *SetAllOptions) error {
+	for key, metric := range opts.Metrics {
+		if metric.Value == nil || metric.Type() != key.Type {
+			return fmt.Errorf("can't set %s %s to a %s value: %w", key.Type, key.Name, metric.Type(), ErrIncorrectType)
+		}
+		if op := opts.GaugeOps[key]; op != GaugeSet && key.Type != Gauge {
+			return fmt.Errorf("can't apply %s to %s %s: %w", op, key.Type, key.Name, ErrIncorrectType)
+		}
+	}
+
+	now := time.Now()
+	for key, metric := range opts.Metrics {
+		if metric.UpdatedAt.IsZero() {
+			metric.UpdatedAt = now
 		}
 
-		valueMetric, ok := value.(Metric)
-		if !ok {
-			ms.log.Warn("can't get value")
+		if opts.Replace {
+			ms.put(key, metric)
+			continue
+		}
+		s := ms.shard(key)
+		s.mu.Lock()
+		op := opts.GaugeOps[key]
+		err := ms.apply(s, key, metric, op)
+		if err == nil && opts.Results != nil && op != GaugeSet {
+			opts.Results[key] = s.data[key]
+		}
+		s.mu.Unlock()
+		if err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-		result[keyStr] = valueMetric
-		return true
+func (ms *MemStorage) List(ctx context.Context, opts *ListOptions) ([]NamedMetric, error) {
+	var result []NamedMetric
+	ms.forEachRead(func(s *memShard) {
+		result = appendListed(result, s.data, opts)
 	})
-	return result, nil
+	return sortListed(result, opts), nil
 }
 
-func (ms *MemStorage) SetAll(ctx context.Context, opts *SetAllOptions) error {
-	metrics := opts.Metrics
+// appendListed appends the metrics that pass the filters of opts.
+func appendListed(result []NamedMetric, metrics map[MetricKey]Metric, opts *ListOptions) []NamedMetric {
 	for key, metric := range metrics {
-		if metric.Type == constants.Counter && metric.Value != nil {
-			if value, ok := metric.Value.(float64); ok {
-				metric.Value = int64(value)
+		nm := NamedMetric{Name: key.Name, Metric: metric}
+		if opts.MetricType != "" && string(nm.Type()) != opts.MetricType {
+			continue
+		}
+		if opts.Match != "" && !matchGlob(opts.Match, nm.Name) {
+			continue
+		}
+		if !nm.after(opts.AfterName, opts.AfterType) {
+			continue
+		}
+		result = append(result, nm)
+	}
+	return result
+}
+
+// sortListed puts the listed metrics in the List order and cuts the page.
+func sortListed(result []NamedMetric, opts *ListOptions) []NamedMetric {
+	sort.Slice(result, func(i, j int) bool {
+		return result[j].after(result[i].Name, string(result[i].Type()))
+	})
+	if opts.Limit > 0 && len(result) > opts.Limit {
+		result = result[:opts.Limit]
+	}
+	return result
+}
+
+func (ms *MemStorage) Delete(ctx context.Context, opts *DeleteOptions) error {
+	key := MetricKey{Name: opts.MetricName, Type: MetricType(opts.MetricType)}
+	s := ms.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.data[key]; !exists {
+		return fmt.Errorf("can't delete metric from MemStorage %s %s: %w",
+			opts.MetricName, opts.MetricType, ErrMetricNotFound)
+	}
+	delete(s.data, key)
+	return nil
+}
+
+func (ms *MemStorage) DeleteMatching(ctx context.Context, opts *DeleteMatchingOptions) (int64, error) {
+	var deleted int64
+	ms.forEach(func(s *memShard) {
+		for key := range s.data {
+			if opts.MetricType != "" && string(key.Type) != opts.MetricType {
+				continue
+			}
+			if !matchGlob(opts.Match, key.Name) {
+				continue
 			}
+			delete(s.data, key)
+			deleted++
 		}
-		ms.data.Store(key, metric)
+	})
+	return deleted, nil
+}
+
+func (ms *MemStorage) Reset(ctx context.Context, opts *ResetOptions) error {
+	if opts.MetricType != string(Counter) {
+		return fmt.Errorf("can't reset %s metric %s: %w", opts.MetricType, opts.MetricName, ErrIncorrectType)
 	}
+	key := MetricKey{Name: opts.MetricName, Type: Counter}
+	s := ms.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.data[key]; !exists {
+		return fmt.Errorf("can't reset metric in MemStorage %s %s: %w",
+			opts.MetricName, opts.MetricType, ErrMetricNotFound)
+	}
+	s.data[key] = Metric{Value: metrics.Counter(0), UpdatedAt: time.Now()}
 	return nil
 }
 
+func (ms *MemStorage) DeleteStale(ctx context.Context, opts *DeleteStaleOptions) (int64, error) {
+	var deleted int64
+	ms.forEach(func(s *memShard) {
+		for key, metric := range s.data {
+			if !metric.UpdatedAt.Before(opts.Before) {
+				continue
+			}
+			if !opts.DryRun {
+				delete(s.data, key)
+			}
+			deleted++
+		}
+	})
+	return deleted, nil
+}
+
 func (ms *MemStorage) Ping(ctx context.Context) error {
 	return nil
 }
@@ -0,0 +1,205 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/ElizavetaFirst/go-metrics-alerts/internal/metrics"
+)
+
+const (
+	stressWorkers = 16
+	stressUpdates = 500
+)
+
+func stress(fn func(worker, i int)) {
+	var wg sync.WaitGroup
+	for w := 0; w < stressWorkers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < stressUpdates; i++ {
+				fn(w, i)
+			}
+		}(w)
+	}
+	wg.Wait()
+}
+
+func TestMemStorage_ConcurrentUpdatesAreNotLost(t *testing.T) {
+	ctx := context.Background()
+	ms := NewMemStorage(zap.NewNop())
+
+	stress(func(w, i int) {
+		assert.NoError(t, ms.Update(ctx, &UpdateOptions{
+			MetricName: "Hits",
+			Update:     Metric{Value: metrics.Counter(1)},
+		}))
+		assert.NoError(t, ms.SetAll(ctx, &SetAllOptions{Metrics: map[MetricKey]Metric{
+			{Name: "Hits", Type: Counter}: {Value: metrics.Counter(2)},
+		}}))
+		assert.NoError(t, ms.Update(ctx, &UpdateOptions{
+			MetricName: "Depth",
+			Update:     Metric{Value: metrics.Gauge(1)},
+			Op:         GaugeAdd,
+		}))
+		histogram := metrics.NewHistogram([]float64{1, 10})
+		histogram.Observe(float64(i))
+		assert.NoError(t, ms.Update(ctx, &UpdateOptions{
+			MetricName: "Latency",
+			Update:     Metric{Value: histogram},
+		}))
+	})
+
+	total := stressWorkers * stressUpdates
+	hits, err := ms.Get(ctx, &GetOptions{MetricName: "Hits", MetricType: "counter"})
+	require.NoError(t, err)
+	assert.Equal(t, metrics.Counter(3*total), hits.Value)
+
+	depth, err := ms.Get(ctx, &GetOptions{MetricName: "Depth", MetricType: "gauge"})
+	require.NoError(t, err)
+	assert.Equal(t, metrics.Gauge(total), depth.Value)
+
+	latency, err := ms.Get(ctx, &GetOptions{MetricName: "Latency", MetricType: "histogram"})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(total), latency.Value.(metrics.Histogram).Count)
+}
+
+func TestMemStorage_ConcurrentDeletesAndSweeps(t *testing.T) {
+	ctx := context.Background()
+	ms := NewMemStorage(zap.NewNop())
+
+	var sweeps atomic.Int64
+	stress(func(w, i int) {
+		name := fmt.Sprintf("m%d", i%10)
+		switch w % 4 {
+		case 0:
+			sketch := metrics.NewSketch(metrics.DefaultSketchAlpha)
+			sketch.Add(float64(i))
+			assert.NoError(t, ms.Update(ctx, &UpdateOptions{
+				MetricName: name,
+				Update:     Metric{Value: sketch},
+			}))
+		case 1:
+			_ = ms.Delete(ctx, &DeleteOptions{MetricName: name, MetricType: "summary"})
+		case 2:
+			_, err := ms.DeleteStale(ctx, &DeleteStaleOptions{Before: time.Now()})
+			assert.NoError(t, err)
+			sweeps.Add(1)
+		case 3:
+			_, err := ms.List(ctx, &ListOptions{Match: "m*"})
+			assert.NoError(t, err)
+		}
+	})
+
+	assert.Equal(t, int64(stressWorkers/4*stressUpdates), sweeps.Load())
+}
+
+func TestMemStorage_KeysByNameAndType(t *testing.T) {
+	ctx := context.Background()
+	ms := NewMemStorage(zap.NewNop())
+
+	require.NoError(t, ms.SetAll(ctx, &SetAllOptions{Metrics: map[MetricKey]Metric{
+		{Name: "foo", Type: Gauge}:        {Value: metrics.Gauge(1)},
+		{Name: "foogauge", Type: Counter}: {Value: metrics.Counter(2)},
+		{Name: "foo", Type: Counter}:      {Value: metrics.Counter(3)},
+	}}))
+	assert.ErrorIs(t, ms.SetAll(ctx, &SetAllOptions{Metrics: map[MetricKey]Metric{
+		{Name: "foo", Type: Gauge}: {Value: metrics.Counter(1)},
+	}}), ErrIncorrectType)
+
+	all, err := ms.GetAll(ctx)
+	require.NoError(t, err)
+	assert.Len(t, all, 3)
+	assert.Equal(t, metrics.Gauge(1), all[MetricKey{Name: "foo", Type: Gauge}].Value)
+	assert.Equal(t, metrics.Counter(2), all[MetricKey{Name: "foogauge", Type: Counter}].Value)
+
+	listed, err := ms.List(ctx, &ListOptions{})
+	require.NoError(t, err)
+	var keys []MetricKey
+	for _, nm := range listed {
+		keys = append(keys, nm.Key())
+	}
+	assert.Equal(t, []MetricKey{
+		{Name: "foo", Type: Counter},
+		{Name: "foo", Type: Gauge},
+		{Name: "foogauge", Type: Counter},
+	}, keys)
+}
+
+// syncMapStorage is the former MemStorage update path, kept as a baseline.
+type syncMapStorage struct {
+	data sync.Map
+}
+
+func (s *syncMapStorage) update(key string, delta int64) {
+	if m, ok := s.data.Load(key); ok {
+		metric := m.(Metric)
+		metric.Value = metric.Value.(metrics.Counter) + metrics.Counter(delta)
+		s.data.Store(key, metric)
+		return
+	}
+	s.data.Store(key, Metric{Value: metrics.Counter(delta)})
+}
+
+func benchmarkKeys(n int) []MetricKey {
+	keys := make([]MetricKey, n)
+	for i := range keys {
+		keys[i] = MetricKey{Name: fmt.Sprintf("metric%d", i), Type: Counter}
+	}
+	return keys
+}
+
+func BenchmarkMemStorage_Update(b *testing.B) {
+	for _, n := range []int{1, 1000} {
+		keys := benchmarkKeys(n)
+		b.Run(fmt.Sprintf("sharded/keys=%d", n), func(b *testing.B) {
+			ctx := context.Background()
+			ms := NewMemStorage(zap.NewNop())
+			var next atomic.Int64
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					key := keys[int(next.Add(1))%n]
+					_ = ms.Update(ctx, &UpdateOptions{
+						MetricName: key.Name,
+						Update:     Metric{Value: metrics.Counter(1)},
+					})
+				}
+			})
+		})
+		b.Run(fmt.Sprintf("syncmap/keys=%d", n), func(b *testing.B) {
+			var s syncMapStorage
+			var next atomic.Int64
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					key := keys[int(next.Add(1))%n]
+					s.update(key.Name+string(key.Type), 1)
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkMemStorage_Get(b *testing.B) {
+	ctx := context.Background()
+	ms := NewMemStorage(zap.NewNop())
+	keys := benchmarkKeys(1000)
+	for _, key := range keys {
+		_ = ms.SetAll(ctx, &SetAllOptions{Metrics: map[MetricKey]Metric{key: {Value: metrics.Counter(1)}}})
+	}
+	var next atomic.Int64
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			key := keys[int(next.Add(1))%len(keys)]
+			_, _ = ms.Get(ctx, &GetOptions{MetricName: key.Name, MetricType: string(key.Type)})
+		}
+	})
+}
@@ -0,0 +1,240 @@
+package storage
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+
+	"github.com/golang-migrate/migrate/v4"
+	_ "github.com/golang-migrate/migrate/v4/database/postgres"
+	"github.com/golang-migrate/migrate/v4/source"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+	"go.uber.org/zap"
+)
+
+//go:embed migrations/*.sql
+var migrationsDir embed.FS
+
+// MigrationStep is one migration that a command would run.
+type MigrationStep struct {
+	Version uint
+	Name    string
+	// Up is false for a migration that is rolled back.
+	Up bool
+}
+
+func (s MigrationStep) String() string {
+	direction := "down"
+	if s.Up {
+		direction = "up"
+	}
+	return fmt.Sprintf("%s %d %s", direction, s.Version, s.Name)
+}
+
+// Migrator runs the embedded migrations against a database.
+type Migrator struct {
+	source source.Driver
+	m      *migrate.Migrate
+}
+
+func NewMigrator(databaseDSN string) (*Migrator, error) {
+	d, err := iofs.New(migrationsDir, "migrations")
+	if err != nil {
+		return nil, fmt.Errorf("failed to return an iofs driver: %w", err)
+	}
+	m, err := migrate.NewWithSourceInstance("iofs", d, databaseDSN)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get a new migrate instance: %w", err)
+	}
+	return &Migrator{source: d, m: m}, nil
+}
+
+// Up applies all pending migrations.
+func (mg *Migrator) Up() error {
+	if err := mg.m.Up(); err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return fmt.Errorf("failed to apply migrations to the DB: %w", err)
+	}
+	return nil
+}
+
+// Down rolls back the given number of the latest migrations.
+func (mg *Migrator) Down(steps int) error {
+	if err := mg.m.Steps(-steps); err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return fmt.Errorf("failed to roll back migrations: %w", err)
+	}
+	return nil
+}
+
+// Goto migrates up or down to the version.
+func (mg *Migrator) Goto(version uint) error {
+	if err := mg.m.Migrate(version); err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return fmt.Errorf("failed to migrate to version %d: %w", version, err)
+	}
+	return nil
+}
+
+// Force sets the version without running anything, to recover from a
+// failed migration that left the database dirty. -1 means no version.
+func (mg *Migrator) Force(version int) error {
+	if err := mg.m.Force(version); err != nil {
+		return fmt.Errorf("failed to force version %d: %w", version, err)
+	}
+	return nil
+}
+
+// Version returns the applied version, ok is false when none is.
+func (mg *Migrator) Version() (version uint, dirty, ok bool, err error) {
+	version, dirty, err = mg.m.Version()
+	if errors.Is(err, migrate.ErrNilVersion) {
+		return 0, false, false, nil
+	}
+	if err != nil {
+		return 0, false, false, fmt.Errorf("failed to get the DB version: %w", err)
+	}
+	return version, dirty, true, nil
+}
+
+// PlanUp returns the migrations Up would apply.
+func (mg *Migrator) PlanUp() ([]MigrationStep, error) {
+	current, ok, err := mg.cleanVersion()
+	if err != nil {
+		return nil, err
+	}
+	return planUp(mg.source, current, ok, nil)
+}
+
+// PlanDown returns the migrations Down would roll back.
+func (mg *Migrator) PlanDown(steps int) ([]MigrationStep, error) {
+	current, ok, err := mg.cleanVersion()
+	if err != nil {
+		return nil, err
+	}
+	return planDown(mg.source, current, ok, func(done int, _ uint) bool { return done < steps })
+}
+
+// PlanGoto returns the migrations Goto would run.
+func (mg *Migrator) PlanGoto(version uint) ([]MigrationStep, error) {
+	current, ok, err := mg.cleanVersion()
+	if err != nil {
+		return nil, err
+	}
+	return planGoto(mg.source, current, ok, version)
+}
+
+// cleanVersion refuses to plan from a dirty database, migrate would too.
+func (mg *Migrator) cleanVersion() (uint, bool, error) {
+	version, dirty, ok, err := mg.Version()
+	if err != nil {
+		return 0, false, err
+	}
+	if dirty {
+		return 0, false, fmt.Errorf("the DB is dirty at version %d, force a version first", version)
+	}
+	return version, ok, nil
+}
+
+func (mg *Migrator) Close() error {
+	sourceErr, dbErr := mg.m.Close()
+	return errors.Join(sourceErr, dbErr)
+}
+
+// planUp lists the migrations after current, up to and including until
+// when it is set. ok is false for a database without any.
+func planUp(src source.Driver, current uint, ok bool, until *uint) ([]MigrationStep, error) {
+	var (
+		version uint
+		err     error
+	)
+	if ok {
+		version, err = src.Next(current)
+	} else {
+		version, err = src.First()
+	}
+	var steps []MigrationStep
+	for err == nil && (until == nil || version <= *until) {
+		step, stepErr := readStep(src, version, true)
+		if stepErr != nil {
+			return nil, stepErr
+		}
+		steps = append(steps, step)
+		version, err = src.Next(version)
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to list migrations: %w", err)
+	}
+	return steps, nil
+}
+
+// planDown lists the migrations from current down, while more says so
+// given how many are listed and the version that would be rolled back next.
+func planDown(src source.Driver, current uint, ok bool, more func(done int, version uint) bool) ([]MigrationStep, error) {
+	var steps []MigrationStep
+	version := current
+	for ok && more(len(steps), version) {
+		step, err := readStep(src, version, false)
+		if err != nil {
+			return nil, err
+		}
+		steps = append(steps, step)
+		version, err = src.Prev(version)
+		if errors.Is(err, fs.ErrNotExist) {
+			ok = false
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to list migrations: %w", err)
+		}
+	}
+	return steps, nil
+}
+
+func planGoto(src source.Driver, current uint, ok bool, target uint) ([]MigrationStep, error) {
+	if _, err := readStep(src, target, true); err != nil {
+		return nil, err
+	}
+	if !ok || target > current {
+		return planUp(src, current, ok, &target)
+	}
+	return planDown(src, current, ok, func(_ int, version uint) bool { return version > target })
+}
+
+func readStep(src source.Driver, version uint, up bool) (MigrationStep, error) {
+	read := src.ReadDown
+	if up {
+		read = src.ReadUp
+	}
+	r, name, err := read(version)
+	if err != nil {
+		return MigrationStep{}, fmt.Errorf("no migration %d: %w", version, err)
+	}
+	_ = r.Close()
+	return MigrationStep{Version: version, Name: name, Up: up}, nil
+}
+
+// checkMigrations migrates up, or with autoMigrate off warns about the
+// pending migrations that are left to the DBA.
+func checkMigrations(databaseDSN string, autoMigrate bool, log *zap.Logger) (err error) {
+	mg, err := NewMigrator(databaseDSN)
+	if err != nil {
+		return fmt.Errorf("failed to run DB migrations: %w", err)
+	}
+	defer func() {
+		err = errors.Join(err, mg.Close())
+	}()
+
+	if autoMigrate {
+		if err := mg.Up(); err != nil {
+			return fmt.Errorf("failed to run DB migrations: %w", err)
+		}
+		return nil
+	}
+	pending, err := mg.PlanUp()
+	if err != nil {
+		log.Warn("can't check the DB migrations", zap.Error(err))
+		return nil
+	}
+	if len(pending) > 0 {
+		log.Warn("the DB schema is behind, run the server migrate up command",
+			zap.Int("pending", len(pending)), zap.Stringer("next", pending[0]))
+	}
+	return nil
+}
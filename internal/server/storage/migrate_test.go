@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlanMigrations(t *testing.T) {
+	files := fstest.MapFS{}
+	for _, name := range []string{"001_create", "002_index", "005_history"} {
+		files[name+".up.sql"] = &fstest.MapFile{}
+		files[name+".down.sql"] = &fstest.MapFile{}
+	}
+	src, err := iofs.New(files, ".")
+	require.NoError(t, err)
+
+	versions := func(steps []MigrationStep) []uint {
+		var v []uint
+		for _, step := range steps {
+			v = append(v, step.Version)
+		}
+		return v
+	}
+
+	steps, err := planUp(src, 0, false, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []uint{1, 2, 5}, versions(steps))
+	assert.Equal(t, "up 1 create", steps[0].String())
+
+	steps, err = planUp(src, 5, true, nil)
+	require.NoError(t, err)
+	assert.Empty(t, steps)
+
+	steps, err = planDown(src, 5, true, func(done int, _ uint) bool { return done < 2 })
+	require.NoError(t, err)
+	assert.Equal(t, []uint{5, 2}, versions(steps))
+	assert.Equal(t, "down 5 history", steps[0].String())
+
+	steps, err = planDown(src, 2, true, func(done int, _ uint) bool { return done < 5 })
+	require.NoError(t, err)
+	assert.Equal(t, []uint{2, 1}, versions(steps))
+
+	steps, err = planGoto(src, 1, true, 5)
+	require.NoError(t, err)
+	assert.Equal(t, []uint{2, 5}, versions(steps))
+
+	steps, err = planGoto(src, 0, false, 2)
+	require.NoError(t, err)
+	assert.Equal(t, []uint{1, 2}, versions(steps))
+
+	steps, err = planGoto(src, 5, true, 1)
+	require.NoError(t, err)
+	assert.Equal(t, []uint{5, 2}, versions(steps))
+	assert.False(t, steps[0].Up)
+
+	_, err = planGoto(src, 5, true, 3)
+	assert.Error(t, err)
+}
+
+func TestEmbeddedMigrationsPair(t *testing.T) {
+	src, err := iofs.New(migrationsDir, "migrations")
+	require.NoError(t, err)
+	steps, err := planUp(src, 0, false, nil)
+	require.NoError(t, err)
+	require.NotEmpty(t, steps)
+	// Every migration can be rolled back.
+	down, err := planDown(src, steps[len(steps)-1].Version, true, func(int, uint) bool { return true })
+	require.NoError(t, err)
+	assert.Len(t, down, len(steps))
+}
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS metrics_name_type_c_idx;
@@ -0,0 +1,2 @@
+CREATE INDEX IF NOT EXISTS metrics_name_type_c_idx
+    ON metrics (name COLLATE "C", type COLLATE "C");
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS metrics_updated_at_idx;
+ALTER TABLE metrics DROP COLUMN IF EXISTS updated_at;
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS metric_rollup_state;
+DROP TABLE IF EXISTS metric_rollups_1h;
+DROP TABLE IF EXISTS metric_rollups_1m;
+DROP TABLE IF EXISTS metric_samples;
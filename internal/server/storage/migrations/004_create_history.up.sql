@@ -0,0 +1,39 @@
+CREATE TABLE IF NOT EXISTS metric_samples (
+    name  text NOT NULL,
+    type  text NOT NULL,
+    ts    timestamptz NOT NULL,
+    value double precision NOT NULL
+);
+CREATE INDEX IF NOT EXISTS metric_samples_series_ts_idx ON metric_samples (name, type, ts);
+CREATE INDEX IF NOT EXISTS metric_samples_ts_idx ON metric_samples (ts);
+
+CREATE TABLE IF NOT EXISTS metric_rollups_1m (
+    name  text NOT NULL,
+    type  text NOT NULL,
+    ts    timestamptz NOT NULL,
+    min   double precision NOT NULL,
+    max   double precision NOT NULL,
+    sum   double precision NOT NULL,
+    last  double precision NOT NULL,
+    count bigint NOT NULL,
+    PRIMARY KEY (name, type, ts)
+);
+CREATE INDEX IF NOT EXISTS metric_rollups_1m_ts_idx ON metric_rollups_1m (ts);
+
+CREATE TABLE IF NOT EXISTS metric_rollups_1h (
+    name  text NOT NULL,
+    type  text NOT NULL,
+    ts    timestamptz NOT NULL,
+    min   double precision NOT NULL,
+    max   double precision NOT NULL,
+    sum   double precision NOT NULL,
+    last  double precision NOT NULL,
+    count bigint NOT NULL,
+    PRIMARY KEY (name, type, ts)
+);
+CREATE INDEX IF NOT EXISTS metric_rollups_1h_ts_idx ON metric_rollups_1h (ts);
+
+CREATE TABLE IF NOT EXISTS metric_rollup_state (
+    rollup       text PRIMARY KEY,
+    rolled_until timestamptz NOT NULL
+);
@@ -0,0 +1,2 @@
+DELETE FROM metrics WHERE type = 'histogram';
+ALTER TABLE metrics DROP COLUMN IF EXISTS histogram;
@@ -0,0 +1,2 @@
+DELETE FROM metrics WHERE type = 'summary';
+ALTER TABLE metrics DROP COLUMN IF EXISTS sketch;
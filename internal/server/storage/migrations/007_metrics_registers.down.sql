@@ -0,0 +1,2 @@
+DELETE FROM metrics WHERE type = 'set';
+ALTER TABLE metrics DROP COLUMN IF EXISTS registers;
@@ -0,0 +1,14 @@
+CREATE TABLE metric_samples_unpartitioned (
+    name  text NOT NULL,
+    type  text NOT NULL,
+    ts    timestamptz NOT NULL,
+    value double precision NOT NULL
+);
+
+INSERT INTO metric_samples_unpartitioned (name, type, ts, value)
+SELECT name, type, ts, value FROM metric_samples;
+DROP TABLE metric_samples;
+ALTER TABLE metric_samples_unpartitioned RENAME TO metric_samples;
+
+CREATE INDEX metric_samples_series_ts_idx ON metric_samples (name, type, ts);
+CREATE INDEX metric_samples_ts_idx ON metric_samples (ts);
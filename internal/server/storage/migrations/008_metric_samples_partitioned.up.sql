@@ -0,0 +1,18 @@
+-- The samples are partitioned by day so that the expired ones are dropped
+-- with their partition. The day partitions are created by the server ahead
+-- of time; the default partition takes the rows no day partition covers.
+CREATE TABLE metric_samples_partitioned (
+    name  text NOT NULL,
+    type  text NOT NULL,
+    ts    timestamptz NOT NULL,
+    value double precision NOT NULL
+) PARTITION BY RANGE (ts);
+CREATE TABLE metric_samples_default PARTITION OF metric_samples_partitioned DEFAULT;
+
+INSERT INTO metric_samples_partitioned (name, type, ts, value)
+SELECT name, type, ts, value FROM metric_samples;
+DROP TABLE metric_samples;
+ALTER TABLE metric_samples_partitioned RENAME TO metric_samples;
+
+CREATE INDEX metric_samples_series_ts_idx ON metric_samples (name, type, ts);
+CREATE INDEX metric_samples_ts_idx ON metric_samples (ts);
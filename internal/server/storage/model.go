@@ -1,6 +1,113 @@
 package storage
 
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ElizavetaFirst/go-metrics-alerts/internal/metrics"
+)
+
 type Metric struct {
-	Value any
-	Type  MetricType
+	UpdatedAt time.Time
+	Value     metrics.Value
+}
+
+// Type is the type of the value, empty for a metric without one.
+func (m Metric) Type() MetricType {
+	if m.Value == nil {
+		return ""
+	}
+	return MetricType(m.Value.MetricType())
+}
+
+// metricJSON is the file form of a Metric, the name is only set for a
+// NamedMetric. Snapshots written before values were typed have the same
+// fields under the Go names, UpdatedAt among them; the other names match
+// case-insensitively.
+type metricJSON struct {
+	Name            string          `json:"name,omitempty"`
+	Type            string          `json:"type"`
+	Value           json.RawMessage `json:"value"`
+	UpdatedAt       time.Time       `json:"updated_at"`
+	LegacyUpdatedAt *time.Time      `json:"UpdatedAt,omitempty"`
+}
+
+func (m Metric) MarshalJSON() ([]byte, error) {
+	return m.marshalJSON("")
+}
+
+func (m *Metric) UnmarshalJSON(data []byte) error {
+	_, err := m.unmarshalJSON(data)
+	return err
+}
+
+func (m Metric) marshalJSON(name string) ([]byte, error) {
+	value, err := json.Marshal(m.Value)
+	if err != nil {
+		return nil, fmt.Errorf("can't encode %s value %w", m.Type(), err)
+	}
+	data, err := json.Marshal(metricJSON{Name: name, Type: string(m.Type()), Value: value, UpdatedAt: m.UpdatedAt})
+	if err != nil {
+		return nil, fmt.Errorf("can't encode metric %w", err)
+	}
+	return data, nil
+}
+
+func (m *Metric) unmarshalJSON(data []byte) (string, error) {
+	var raw metricJSON
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return "", fmt.Errorf("can't decode metric %w", err)
+	}
+	value, err := metrics.DecodeValue(raw.Type, raw.Value)
+	if err != nil {
+		return "", fmt.Errorf("can't decode metric value %w", err)
+	}
+	m.Value = value
+	m.UpdatedAt = raw.UpdatedAt
+	if m.UpdatedAt.IsZero() && raw.LegacyUpdatedAt != nil {
+		m.UpdatedAt = *raw.LegacyUpdatedAt
+	}
+	return raw.Name, nil
+}
+
+func isMergeable(t MetricType) bool {
+	return t == Histogram || t == Summary || t == Set
+}
+
+type NamedMetric struct {
+	Name string
+	Metric
+}
+
+// Key returns the key of the series in GetAll and SetAll.
+func (nm NamedMetric) Key() MetricKey {
+	return MetricKey{Name: nm.Name, Type: nm.Type()}
+}
+
+// MarshalJSON writes the name next to the metric fields, the promoted
+// Metric methods would drop it.
+func (nm NamedMetric) MarshalJSON() ([]byte, error) {
+	return nm.Metric.marshalJSON(nm.Name)
+}
+
+func (nm *NamedMetric) UnmarshalJSON(data []byte) error {
+	name, err := nm.Metric.unmarshalJSON(data)
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		return errors.New("metric name is required")
+	}
+	nm.Name = name
+	return nil
+}
+
+// after reports whether nm follows the given key in the order used by List.
+func (nm NamedMetric) after(name, metricType string) bool {
+	if nm.Name != name {
+		return nm.Name > name
+	}
+	return string(nm.Type()) > metricType
 }
@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ElizavetaFirst/go-metrics-alerts/internal/metrics"
+)
+
+func TestMetric_JSON(t *testing.T) {
+	updatedAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	histogram := metrics.NewHistogram([]float64{1})
+	histogram.Observe(0.5)
+
+	snapshot := map[string]Metric{
+		"Allocgauge":       {Value: metrics.Gauge(1.5), UpdatedAt: updatedAt},
+		"PollCountcounter": {Value: metrics.Counter(7), UpdatedAt: updatedAt},
+		"GCPausehistogram": {Value: histogram, UpdatedAt: updatedAt},
+	}
+	data, err := json.Marshal(snapshot)
+	require.NoError(t, err)
+
+	var decoded map[string]Metric
+	require.NoError(t, json.Unmarshal(data, &decoded))
+	assert.Equal(t, snapshot, decoded)
+}
+
+func TestMetric_DecodesOldSnapshots(t *testing.T) {
+	// Files written while values were untyped: Go field names, counters
+	// restored as floats and no update time in the oldest ones.
+	old := `{
+		"Allocgauge": {"Value": 1.5, "Type": "gauge"},
+		"PollCountcounter": {"UpdatedAt": "2024-05-01T12:00:00Z", "Value": 7.0, "Type": "counter"},
+		"GCPausehistogram": {"Value": {"bounds": [1], "counts": [1, 0], "sum": 0.5, "count": 1}, "Type": "histogram"}
+	}`
+
+	var decoded map[string]Metric
+	require.NoError(t, json.Unmarshal([]byte(old), &decoded))
+
+	assert.Equal(t, metrics.Gauge(1.5), decoded["Allocgauge"].Value)
+	assert.True(t, decoded["Allocgauge"].UpdatedAt.IsZero())
+	assert.Equal(t, metrics.Counter(7), decoded["PollCountcounter"].Value)
+	assert.Equal(t, time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), decoded["PollCountcounter"].UpdatedAt)
+	assert.Equal(t, Histogram, decoded["GCPausehistogram"].Type())
+
+	var bad map[string]Metric
+	assert.Error(t, json.Unmarshal([]byte(`{"x": {"Value": 1.5, "Type": "counter"}}`), &bad))
+	assert.Error(t, json.Unmarshal([]byte(`{"x": {"Value": 1, "Type": "unknown"}}`), &bad))
+}
+
+func TestNamedMetric_JSON(t *testing.T) {
+	snapshot := []NamedMetric{
+		{Name: "foo", Metric: Metric{Value: metrics.Gauge(1.5)}},
+		{Name: "foogauge", Metric: Metric{Value: metrics.Counter(7)}},
+	}
+	data, err := json.Marshal(snapshot)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"name":"foogauge"`)
+
+	var decoded []NamedMetric
+	require.NoError(t, json.Unmarshal(data, &decoded))
+	assert.Equal(t, snapshot, decoded)
+	assert.Equal(t, MetricKey{Name: "foogauge", Type: Counter}, decoded[1].Key())
+
+	var unnamed []NamedMetric
+	assert.Error(t, json.Unmarshal([]byte(`[{"type": "gauge", "value": 1}]`), &unnamed))
+}
@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// The samples table is partitioned by UTC day, see migration 008. The day
+// partitions are named by their day; the default partition holds the rows
+// that arrived before their day had a partition.
+const (
+	samplesDefaultPartition = samplesTable + "_default"
+	samplePartitionPrefix   = samplesTable + "_p"
+	samplePartitionLayout   = "20060102"
+	// samplePartitionsAhead is how many days after today get their
+	// partition before the first sample.
+	samplePartitionsAhead = 3
+
+	listSamplePartitionsSQL = `
+	SELECT c.relname FROM pg_inherits i
+	JOIN pg_class c ON c.oid = i.inhrelid
+	WHERE i.inhparent = $1::regclass`
+
+	expireDefaultPartitionSQL = `DELETE FROM ` + samplesDefaultPartition + ` WHERE ts < $1`
+)
+
+func utcDay(t time.Time) time.Time {
+	y, m, d := t.UTC().Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+func samplePartitionName(day time.Time) string {
+	return samplePartitionPrefix + day.Format(samplePartitionLayout)
+}
+
+// samplePartitionDay returns the day of a partition name, ok is false for
+// the default partition and the tables the server didn't create.
+func samplePartitionDay(name string) (day time.Time, ok bool) {
+	suffix, ok := strings.CutPrefix(name, samplePartitionPrefix)
+	if !ok {
+		return time.Time{}, false
+	}
+	day, err := time.Parse(samplePartitionLayout, suffix)
+	return day, err == nil
+}
+
+// planSamplePartitions returns the days from today up to ahead days later
+// that have no partition yet, and the partitions whose whole day is older
+// than the retention.
+func planSamplePartitions(existing []time.Time, now time.Time, ahead int, retention time.Duration) (create, drop []time.Time) {
+	have := make(map[time.Time]bool, len(existing))
+	for _, day := range existing {
+		have[day] = true
+	}
+	today := utcDay(now)
+	for i := 0; i <= ahead; i++ {
+		day := today.AddDate(0, 0, i)
+		if !have[day] {
+			create = append(create, day)
+		}
+	}
+
+	cutoff := now.Add(-retention)
+	for _, day := range existing {
+		if !day.AddDate(0, 0, 1).After(cutoff) {
+			drop = append(drop, day)
+		}
+	}
+	sort.Slice(drop, func(i, j int) bool { return drop[i].Before(drop[j]) })
+	return create, drop
+}
+
+// createSamplePartitionSQL returns the statements that create the partition
+// of the day, to run in one transaction. The rows of the day are moved out
+// of the default partition first, attaching would fail on them otherwise.
+func createSamplePartitionSQL(day time.Time) []string {
+	name := pgx.Identifier{samplePartitionName(day)}.Sanitize()
+	from := day.Format(time.RFC3339)
+	to := day.AddDate(0, 0, 1).Format(time.RFC3339)
+	return []string{
+		fmt.Sprintf(`CREATE TABLE %s (LIKE %s INCLUDING DEFAULTS INCLUDING CONSTRAINTS)`, name, samplesTable),
+		fmt.Sprintf(`WITH moved AS (
+		DELETE FROM %s WHERE ts >= '%s' AND ts < '%s' RETURNING name, type, ts, value
+	)
+	INSERT INTO %s (name, type, ts, value) SELECT name, type, ts, value FROM moved`,
+			samplesDefaultPartition, from, to, name),
+		fmt.Sprintf(`ALTER TABLE %s ATTACH PARTITION %s FOR VALUES FROM ('%s') TO ('%s')`,
+			samplesTable, name, from, to),
+	}
+}
+
+func dropSamplePartitionSQL(day time.Time) string {
+	return fmt.Sprintf(`DROP TABLE IF EXISTS %s`, pgx.Identifier{samplePartitionName(day)}.Sanitize())
+}
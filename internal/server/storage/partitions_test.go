@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func day(s string) time.Time {
+	d, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+func TestSamplePartitionDay(t *testing.T) {
+	d := day("2024-05-01")
+	assert.Equal(t, "metric_samples_p20240501", samplePartitionName(d))
+
+	got, ok := samplePartitionDay(samplePartitionName(d))
+	require.True(t, ok)
+	assert.True(t, got.Equal(d))
+
+	for _, name := range []string{samplesDefaultPartition, "metric_samples_p2024", "metric_rollups_1m"} {
+		_, ok := samplePartitionDay(name)
+		assert.False(t, ok, name)
+	}
+}
+
+func TestPlanSamplePartitions(t *testing.T) {
+	// Already 05-10 in UTC+3, but the days are UTC: today is still 05-09.
+	now := time.Date(2024, 5, 10, 1, 30, 0, 0, time.FixedZone("MSK", 3*60*60))
+	existing := []time.Time{day("2024-05-07"), day("2024-05-08"), day("2024-05-09"), day("2024-05-10")}
+
+	create, drop := planSamplePartitions(existing, now, 2, 24*time.Hour)
+	assert.Equal(t, []time.Time{day("2024-05-11")}, create)
+	// 05-08 still holds samples newer than a day before now.
+	assert.Equal(t, []time.Time{day("2024-05-07")}, drop)
+
+	create, drop = planSamplePartitions(nil, now, 0, 24*time.Hour)
+	assert.Equal(t, []time.Time{day("2024-05-09")}, create)
+	assert.Empty(t, drop)
+}
+
+func TestCreateSamplePartitionSQL(t *testing.T) {
+	stmts := createSamplePartitionSQL(day("2024-05-01"))
+	require.Len(t, stmts, 3)
+	assert.Equal(t, `CREATE TABLE "metric_samples_p20240501" (LIKE metric_samples INCLUDING DEFAULTS INCLUDING CONSTRAINTS)`, stmts[0])
+	assert.Contains(t, stmts[1], `DELETE FROM metric_samples_default WHERE ts >= '2024-05-01T00:00:00Z' AND ts < '2024-05-02T00:00:00Z'`)
+	assert.Contains(t, stmts[1], `INSERT INTO "metric_samples_p20240501"`)
+	assert.Equal(t, `ALTER TABLE metric_samples ATTACH PARTITION "metric_samples_p20240501" `+
+		`FOR VALUES FROM ('2024-05-01T00:00:00Z') TO ('2024-05-02T00:00:00Z')`, stmts[2])
+
+	assert.Equal(t, `DROP TABLE IF EXISTS "metric_samples_p20240501"`, dropSamplePartitionSQL(day("2024-05-01")))
+}
@@ -0,0 +1,161 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// statementTimeoutGrace is how much longer the client waits than the
+// server-side statement timeout, so that the server cancels a slow
+// statement itself and the connection stays usable.
+const statementTimeoutGrace = time.Second
+
+// PostgresOptions configure the DB storage. The zero pool fields keep the
+// pgxpool defaults.
+type PostgresOptions struct {
+	// AutoMigrate applies the pending migrations on start.
+	AutoMigrate       bool
+	MaxConns          int32
+	MinConns          int32
+	MaxConnLifetime   time.Duration
+	HealthCheckPeriod time.Duration
+	// StatementTimeout bounds every statement, zero leaves them to the
+	// caller's context.
+	StatementTimeout time.Duration
+}
+
+// PoolStats is the state of the connection pool.
+type PoolStats struct {
+	MaxConns          int32 `json:"max_conns"`
+	TotalConns        int32 `json:"total_conns"`
+	AcquiredConns     int32 `json:"acquired_conns"`
+	IdleConns         int32 `json:"idle_conns"`
+	ConstructingConns int32 `json:"constructing_conns"`
+	AcquireCount      int64 `json:"acquire_count"`
+	// EmptyAcquireCount counts the acquires that had to wait for a
+	// connection, AcquireWaitSeconds is the time all acquires took.
+	EmptyAcquireCount    int64   `json:"empty_acquire_count"`
+	CanceledAcquireCount int64   `json:"canceled_acquire_count"`
+	AcquireWaitSeconds   float64 `json:"acquire_wait_seconds"`
+}
+
+func (dbs *DBStorage) PoolStats() PoolStats {
+	stat := dbs.conn.Stat()
+	return PoolStats{
+		MaxConns:             stat.MaxConns(),
+		TotalConns:           stat.TotalConns(),
+		AcquiredConns:        stat.AcquiredConns(),
+		IdleConns:            stat.IdleConns(),
+		ConstructingConns:    stat.ConstructingConns(),
+		AcquireCount:         stat.AcquireCount(),
+		EmptyAcquireCount:    stat.EmptyAcquireCount(),
+		CanceledAcquireCount: stat.CanceledAcquireCount(),
+		AcquireWaitSeconds:   stat.AcquireDuration().Seconds(),
+	}
+}
+
+func newDB(ctx context.Context, dataSourceName string, opts *PostgresOptions) (pgxPool, error) {
+	config, err := poolConfig(dataSourceName, opts)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := pgxpool.ConnectConfig(ctx, config)
+	if err != nil {
+		return nil, fmt.Errorf("can't open database %w", err)
+	}
+	if opts.StatementTimeout > 0 {
+		return &timeoutPool{pgxPool: pool, timeout: opts.StatementTimeout + statementTimeoutGrace}, nil
+	}
+	return pool, nil
+}
+
+func poolConfig(dataSourceName string, opts *PostgresOptions) (*pgxpool.Config, error) {
+	config, err := pgxpool.ParseConfig(dataSourceName)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse database DSN %w", err)
+	}
+	if opts.MaxConns > 0 {
+		config.MaxConns = opts.MaxConns
+	}
+	if opts.MinConns > 0 {
+		config.MinConns = opts.MinConns
+	}
+	if opts.MaxConnLifetime > 0 {
+		config.MaxConnLifetime = opts.MaxConnLifetime
+	}
+	if opts.HealthCheckPeriod > 0 {
+		config.HealthCheckPeriod = opts.HealthCheckPeriod
+	}
+	if opts.StatementTimeout > 0 {
+		config.ConnConfig.RuntimeParams["statement_timeout"] =
+			strconv.FormatInt(opts.StatementTimeout.Milliseconds(), 10)
+	}
+	return config, nil
+}
+
+// timeoutPool puts a deadline on the calls that run one statement, for
+// when the server can't cancel it because it can't be reached. The
+// statements of a transaction are bounded by the server only.
+type timeoutPool struct {
+	pgxPool
+	timeout time.Duration
+}
+
+func (p *timeoutPool) Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	return p.pgxPool.Exec(ctx, sql, args...)
+}
+
+// Query keeps the deadline until the rows are closed.
+func (p *timeoutPool) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	rows, err := p.pgxPool.Query(ctx, sql, args...)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &timeoutRows{Rows: rows, cancel: cancel}, nil
+}
+
+func (p *timeoutPool) QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	return &timeoutRow{row: p.pgxPool.QueryRow(ctx, sql, args...), cancel: cancel}
+}
+
+func (p *timeoutPool) CopyFrom(
+	ctx context.Context,
+	table pgx.Identifier,
+	columns []string,
+	src pgx.CopyFromSource,
+) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	return p.pgxPool.CopyFrom(ctx, table, columns, src)
+}
+
+type timeoutRows struct {
+	pgx.Rows
+	cancel context.CancelFunc
+}
+
+func (r *timeoutRows) Close() {
+	r.Rows.Close()
+	r.cancel()
+}
+
+type timeoutRow struct {
+	row    pgx.Row
+	cancel context.CancelFunc
+}
+
+func (r *timeoutRow) Scan(dest ...interface{}) error {
+	defer r.cancel()
+	return r.row.Scan(dest...)
+}
@@ -0,0 +1,183 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"github.com/jackc/pgconn"
+	"go.uber.org/zap"
+)
+
+const (
+	txRetryInitialInterval = 50 * time.Millisecond
+	txRetryMaxInterval     = time.Second
+	txRetries              = 5
+
+	pgSerializationFailure = "40001"
+	pgDeadlockDetected     = "40P01"
+	// pgConnectionException is the class of the connection error codes.
+	pgConnectionException = "08"
+)
+
+// isConnectionError reports whether err means the server couldn't be
+// reached: a connection exception code, or a failure that pgconn knows
+// happened before anything was sent. An error that may have interrupted a
+// statement already on the wire is not one, since the statement could have
+// been applied.
+func isConnectionError(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return strings.HasPrefix(pgErr.Code, pgConnectionException)
+	}
+	var safe interface{ SafeToRetry() bool }
+	return errors.As(err, &safe) && safe.SafeToRetry()
+}
+
+// isRetryableTx reports whether a failed transaction can run again.
+// The server rolls back serialization failures and deadlocks on its own.
+func isRetryableTx(err error) bool {
+	if errors.Is(err, ErrConcurrentUpdate) || isConnectionError(err) {
+		return true
+	}
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) &&
+		(pgErr.Code == pgSerializationFailure || pgErr.Code == pgDeadlockDetected)
+}
+
+// retryTx runs op until it succeeds, fails with an error that isn't
+// retryable, runs out of attempts or ctx is done.
+func retryTx(ctx context.Context, op func() error) error {
+	if err := retry(ctx, isRetryableTx, op); err != nil {
+		return fmt.Errorf("transaction failed %w", err)
+	}
+	return nil
+}
+
+func retry(ctx context.Context, retryable func(error) bool, op func() error) error {
+	operation := func() error {
+		err := op()
+		var permanent *backoff.PermanentError
+		if err == nil || errors.As(err, &permanent) || retryable(err) {
+			return err
+		}
+		return backoff.Permanent(err)
+	}
+
+	exponentialBackOff := backoff.NewExponentialBackOff()
+	exponentialBackOff.InitialInterval = txRetryInitialInterval
+	exponentialBackOff.MaxInterval = txRetryMaxInterval
+
+	b := backoff.WithContext(backoff.WithMaxRetries(exponentialBackOff, txRetries), ctx)
+	return backoff.Retry(operation, b)
+}
+
+// retrier repeats the storage calls that failed to reach the database.
+type retrier struct {
+	Storage
+	log *zap.Logger
+}
+
+// WithRetry wraps s so that calls failing with a connection error are
+// retried with exponential backoff. SetAll and the updates of the mergeable
+// types aren't wrapped, they retry their own transactions.
+func WithRetry(s Storage, log *zap.Logger) Storage {
+	return &retrier{Storage: s, log: log}
+}
+
+func (r *retrier) do(ctx context.Context, method string, op func() error) error {
+	attempt := 0
+	err := retry(ctx, isConnectionError, func() error {
+		attempt++
+		err := op()
+		if err != nil && isConnectionError(err) {
+			r.log.Warn("storage call failed, retrying",
+				zap.String("method", method), zap.Int("attempt", attempt), zap.Error(err))
+		}
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("%s failed %w", method, err)
+	}
+	return nil
+}
+
+func (r *retrier) Update(ctx context.Context, opts *UpdateOptions) error {
+	if isMergeable(opts.Update.Type()) {
+		return r.Storage.Update(ctx, opts)
+	}
+	return r.do(ctx, "Update", func() error {
+		return r.Storage.Update(ctx, opts)
+	})
+}
+
+func (r *retrier) Get(ctx context.Context, opts *GetOptions) (Metric, error) {
+	var metric Metric
+	err := r.do(ctx, "Get", func() error {
+		var err error
+		metric, err = r.Storage.Get(ctx, opts)
+		return err
+	})
+	return metric, err
+}
+
+func (r *retrier) GetAll(ctx context.Context) (map[MetricKey]Metric, error) {
+	var metrics map[MetricKey]Metric
+	err := r.do(ctx, "GetAll", func() error {
+		var err error
+		metrics, err = r.Storage.GetAll(ctx)
+		return err
+	})
+	return metrics, err
+}
+
+func (r *retrier) List(ctx context.Context, opts *ListOptions) ([]NamedMetric, error) {
+	var metrics []NamedMetric
+	err := r.do(ctx, "List", func() error {
+		var err error
+		metrics, err = r.Storage.List(ctx, opts)
+		return err
+	})
+	return metrics, err
+}
+
+func (r *retrier) Delete(ctx context.Context, opts *DeleteOptions) error {
+	return r.do(ctx, "Delete", func() error {
+		return r.Storage.Delete(ctx, opts)
+	})
+}
+
+func (r *retrier) DeleteMatching(ctx context.Context, opts *DeleteMatchingOptions) (int64, error) {
+	var deleted int64
+	err := r.do(ctx, "DeleteMatching", func() error {
+		var err error
+		deleted, err = r.Storage.DeleteMatching(ctx, opts)
+		return err
+	})
+	return deleted, err
+}
+
+func (r *retrier) Reset(ctx context.Context, opts *ResetOptions) error {
+	return r.do(ctx, "Reset", func() error {
+		return r.Storage.Reset(ctx, opts)
+	})
+}
+
+func (r *retrier) DeleteStale(ctx context.Context, opts *DeleteStaleOptions) (int64, error) {
+	var deleted int64
+	err := r.do(ctx, "DeleteStale", func() error {
+		var err error
+		deleted, err = r.Storage.DeleteStale(ctx, opts)
+		return err
+	})
+	return deleted, err
+}
+
+func (r *retrier) Ping(ctx context.Context) error {
+	return r.do(ctx, "Ping", func() error {
+		return r.Storage.Ping(ctx)
+	})
+}
@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/ElizavetaFirst/go-metrics-alerts/internal/metrics"
+)
+
+type safeToRetryError struct{}
+
+func (safeToRetryError) Error() string     { return "write failed" }
+func (safeToRetryError) SafeToRetry() bool { return true }
+
+func TestIsRetryableTx(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"serialization failure", &pgconn.PgError{Code: "40001"}, true},
+		{"deadlock", &pgconn.PgError{Code: "40P01"}, true},
+		{"connection failure", fmt.Errorf("wrapped %w", &pgconn.PgError{Code: "08006"}), true},
+		{"unique violation", &pgconn.PgError{Code: "23505"}, false},
+		{"concurrent merge", fmt.Errorf("wrapped %w", ErrConcurrentUpdate), true},
+		{"nothing sent", fmt.Errorf("wrapped %w", safeToRetryError{}), true},
+		{"unknown", errors.New("boom"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, isRetryableTx(tt.err))
+		})
+	}
+}
+
+func TestRetryTx(t *testing.T) {
+	ctx := context.Background()
+
+	calls := 0
+	err := retryTx(ctx, func() error {
+		calls++
+		if calls < 3 {
+			return &pgconn.PgError{Code: "40001"}
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, calls)
+
+	calls = 0
+	err = retryTx(ctx, func() error {
+		calls++
+		return &pgconn.PgError{Code: "23505"}
+	})
+	var pgErr *pgconn.PgError
+	assert.ErrorAs(t, err, &pgErr)
+	assert.Equal(t, 1, calls)
+
+	calls = 0
+	err = retryTx(ctx, func() error {
+		calls++
+		return ErrConcurrentUpdate
+	})
+	assert.ErrorIs(t, err, ErrConcurrentUpdate)
+	assert.Equal(t, txRetries+1, calls)
+}
+
+// fakePool answers Exec and Ping with the scripted errors, then succeeds.
+type fakePool struct {
+	pgxPool
+	errs  []error
+	calls int
+}
+
+func (p *fakePool) next() error {
+	p.calls++
+	if len(p.errs) == 0 {
+		return nil
+	}
+	err := p.errs[0]
+	if len(p.errs) > 1 {
+		p.errs = p.errs[1:]
+	}
+	return err
+}
+
+func (p *fakePool) Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error) {
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	return pgconn.CommandTag("DELETE 1"), nil
+}
+
+func (p *fakePool) BeginFunc(ctx context.Context, f func(pgx.Tx) error) error {
+	return p.next()
+}
+
+func (p *fakePool) Ping(ctx context.Context) error {
+	return p.next()
+}
+
+func TestWithRetry(t *testing.T) {
+	ctx := context.Background()
+	log := zap.NewNop()
+	connectionFailure := &pgconn.PgError{Code: "08006"}
+
+	t.Run("connection errors are retried", func(t *testing.T) {
+		pool := &fakePool{errs: []error{connectionFailure, safeToRetryError{}, nil}}
+		s := WithRetry(&DBStorage{conn: pool, log: log}, log)
+
+		err := s.Update(ctx, &UpdateOptions{MetricName: "Alloc", Update: Metric{Value: metrics.Gauge(1)}})
+		assert.NoError(t, err)
+		assert.Equal(t, 3, pool.calls)
+	})
+
+	t.Run("constraint errors are not retried", func(t *testing.T) {
+		pool := &fakePool{errs: []error{&pgconn.PgError{Code: "23505"}}}
+		s := WithRetry(&DBStorage{conn: pool, log: log}, log)
+
+		err := s.Delete(ctx, &DeleteOptions{MetricName: "Alloc", MetricType: "gauge"})
+		var pgErr *pgconn.PgError
+		assert.ErrorAs(t, err, &pgErr)
+		assert.Equal(t, 1, pool.calls)
+	})
+
+	t.Run("mergeable updates retry only their transaction", func(t *testing.T) {
+		pool := &fakePool{errs: []error{connectionFailure}}
+		s := WithRetry(&DBStorage{conn: pool, log: log}, log)
+
+		histogram := metrics.NewHistogram([]float64{1})
+		assert.Error(t, s.Update(ctx, &UpdateOptions{MetricName: "Latency", Update: Metric{Value: histogram}}))
+		assert.Equal(t, txRetries+1, pool.calls)
+	})
+
+	t.Run("retries stop after the last attempt", func(t *testing.T) {
+		pool := &fakePool{errs: []error{connectionFailure}}
+		s := WithRetry(&DBStorage{conn: pool, log: log}, log)
+
+		assert.Error(t, s.Ping(ctx))
+		assert.Equal(t, txRetries+1, pool.calls)
+	})
+}
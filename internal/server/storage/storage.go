@@ -2,22 +2,43 @@ package storage
 
 import (
 	"context"
+	"fmt"
+	"time"
 
 	"github.com/ElizavetaFirst/go-metrics-alerts/internal/constants"
 	"github.com/pkg/errors"
 )
 
 const (
-	Gauge   MetricType = constants.Gauge
-	Counter MetricType = constants.Counter
+	Gauge     MetricType = constants.Gauge
+	Counter   MetricType = constants.Counter
+	Histogram MetricType = constants.Histogram
+	Summary   MetricType = constants.Summary
+	Set       MetricType = constants.Set
+)
+
+const (
+	// GaugeSet overwrites the gauge, the only op the other types accept.
+	GaugeSet GaugeOp = ""
+	GaugeAdd GaugeOp = "add"
+	GaugeMax GaugeOp = "max"
+	GaugeMin GaugeOp = "min"
 )
 
 type (
 	MetricType string
 
+	// GaugeOp tells how a gauge update is combined with the stored value.
+	// A missing gauge is always set to the update value.
+	GaugeOp string
+
 	UpdateOptions struct {
 		MetricName string
 		Update     Metric
+		Op         GaugeOp
+		// Result, when not nil, receives the stored gauge after a gauge
+		// update, read by the write itself so no other writer comes between.
+		Result *Metric
 	}
 
 	GetOptions struct {
@@ -25,8 +46,58 @@ type (
 		MetricType string
 	}
 
+	// MetricKey identifies a series, two series may share a name.
+	MetricKey struct {
+		Name string
+		Type MetricType
+	}
+
 	SetAllOptions struct {
-		Metrics map[string]Metric
+		Metrics map[MetricKey]Metric
+		// Replace overwrites the stored series instead of merging into
+		// them, so that a restored counter has the value it was saved with.
+		Replace bool
+		// GaugeOps combines the gauges of Metrics with the stored values in
+		// the same batch, the gauges without an op are set. Replace ignores it.
+		GaugeOps map[MetricKey]GaugeOp
+		// Results, when not nil, receives the stored gauges of the keys
+		// with an op in GaugeOps, like UpdateOptions.Result.
+		Results map[MetricKey]Metric
+	}
+
+	ListOptions struct {
+		// MetricType limits the result to one type when not empty.
+		MetricType string
+		// Match is a glob over metric names, see matchGlob.
+		Match string
+		// AfterName and AfterType are the key of the last metric of the previous page.
+		AfterName string
+		AfterType string
+		Limit     int
+	}
+
+	DeleteOptions struct {
+		MetricName string
+		MetricType string
+	}
+
+	DeleteMatchingOptions struct {
+		// MetricType limits the deletion to one type when not empty.
+		MetricType string
+		// Match is a glob over metric names, see matchGlob.
+		Match string
+	}
+
+	ResetOptions struct {
+		MetricName string
+		MetricType string
+	}
+
+	DeleteStaleOptions struct {
+		// Before is the oldest last update time a metric may have to be kept.
+		Before time.Time
+		// DryRun only counts the stale metrics.
+		DryRun bool
 	}
 )
 
@@ -35,13 +106,60 @@ var (
 	ErrMetricNotFound = errors.New("metric not found")
 	ErrIncorrectType  = errors.New("incorrect metric type")
 	ErrCantConnectDB  = errors.New("can't connect to db")
+	// ErrConcurrentUpdate means the write lost a race and can be retried.
+	ErrConcurrentUpdate = errors.New("concurrent update")
+	ErrUnknownOp        = errors.New("unknown gauge op")
 )
 
+// ParseGaugeOp accepts the ops of GaugeOp and "set" for GaugeSet.
+func ParseGaugeOp(op string) (GaugeOp, error) {
+	switch GaugeOp(op) {
+	case GaugeSet, "set":
+		return GaugeSet, nil
+	case GaugeAdd, GaugeMax, GaugeMin:
+		return GaugeOp(op), nil
+	default:
+		return GaugeSet, fmt.Errorf("%q: %w", op, ErrUnknownOp)
+	}
+}
+
+// CombineGaugeOps folds two gauge updates of one series into one, ok is
+// false when no single op gives the result of applying them in order.
+func CombineGaugeOps(first GaugeOp, a float64, then GaugeOp, b float64) (GaugeOp, float64, bool) {
+	switch {
+	case then == GaugeSet:
+		return GaugeSet, b, true
+	case first == GaugeSet, first == then:
+		return first, then.apply(a, b), true
+	default:
+		return first, a, false
+	}
+}
+
+// apply combines a stored gauge value with an update.
+func (op GaugeOp) apply(current, update float64) float64 {
+	switch op {
+	case GaugeAdd:
+		return current + update
+	case GaugeMax:
+		return max(current, update)
+	case GaugeMin:
+		return min(current, update)
+	default:
+		return update
+	}
+}
+
 type Storage interface {
 	Update(ctx context.Context, opts *UpdateOptions) error
 	Get(ctx context.Context, opts *GetOptions) (Metric, error)
-	GetAll(ctx context.Context) (map[string]Metric, error)
+	GetAll(ctx context.Context) (map[MetricKey]Metric, error)
 	SetAll(ctx context.Context, opts *SetAllOptions) error
+	List(ctx context.Context, opts *ListOptions) ([]NamedMetric, error)
+	Delete(ctx context.Context, opts *DeleteOptions) error
+	DeleteMatching(ctx context.Context, opts *DeleteMatchingOptions) (int64, error)
+	Reset(ctx context.Context, opts *ResetOptions) error
+	DeleteStale(ctx context.Context, opts *DeleteStaleOptions) (int64, error)
 	Ping(ctx context.Context) error
 	Close() error
 }
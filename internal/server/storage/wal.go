@@ -0,0 +1,225 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/ElizavetaFirst/go-metrics-alerts/internal/fsutil"
+)
+
+const (
+	// walHeaderSize is the record length and the CRC-32C of the payload.
+	walHeaderSize = 8
+	// walMaxRecord guards replay against a corrupted length.
+	walMaxRecord = 64 << 20
+)
+
+var walTable = crc32.MakeTable(crc32.Castagnoli)
+
+// wal is an append-only file of checksummed records. Appends only reach
+// the buffer; sync makes them durable, and writers that call it while an
+// fsync is running share the next one.
+type wal struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	file    *os.File
+	w       *bufio.Writer
+	end     int64
+	written uint64 // records appended
+	durable uint64 // records known to be on disk
+	syncing bool
+	// err stops all writes: after a failed fsync the file contents are unknown.
+	err error
+}
+
+// openWAL opens the log at path and calls fn for every intact record.
+// A torn or corrupted tail, left by a crash in the middle of an append,
+// is cut off and its offset returned as dropped; a failing fn fails the open.
+func openWAL(path string, fn func(payload []byte) error) (l *wal, dropped int64, err error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, 0, fmt.Errorf("can't open WAL %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = file.Close()
+		}
+	}()
+	if err := fsutil.SyncDir(filepath.Dir(path)); err != nil {
+		return nil, 0, err
+	}
+
+	end, err := replayWAL(file, fn)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return nil, 0, fmt.Errorf("can't stat WAL %w", err)
+	}
+	if end < info.Size() {
+		dropped = info.Size() - end
+		if err := file.Truncate(end); err != nil {
+			return nil, 0, fmt.Errorf("can't cut the WAL tail %w", err)
+		}
+		if err := file.Sync(); err != nil {
+			return nil, 0, fmt.Errorf("can't sync WAL %w", err)
+		}
+	}
+
+	l = &wal{file: file, w: bufio.NewWriter(file), end: end}
+	l.cond = sync.NewCond(&l.mu)
+	return l, dropped, nil
+}
+
+// replayWAL returns the offset after the last intact record.
+func replayWAL(file *os.File, fn func(payload []byte) error) (int64, error) {
+	r := bufio.NewReader(file)
+	var (
+		offset int64
+		header [walHeaderSize]byte
+	)
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return offset, nil
+		}
+		length := binary.LittleEndian.Uint32(header[:4])
+		if length > walMaxRecord {
+			return offset, nil
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return offset, nil
+		}
+		if crc32.Checksum(payload, walTable) != binary.LittleEndian.Uint32(header[4:]) {
+			return offset, nil
+		}
+		if err := fn(payload); err != nil {
+			return 0, fmt.Errorf("can't replay WAL record at %d: %w", offset, err)
+		}
+		offset += walHeaderSize + int64(length)
+	}
+}
+
+// append buffers a record and returns its sequence number for sync.
+func (l *wal) append(payload []byte) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err != nil {
+		return 0, l.err
+	}
+
+	var header [walHeaderSize]byte
+	binary.LittleEndian.PutUint32(header[:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(header[4:], crc32.Checksum(payload, walTable))
+	if _, err := l.w.Write(header[:]); err != nil {
+		l.err = fmt.Errorf("can't write WAL %w", err)
+		return 0, l.err
+	}
+	if _, err := l.w.Write(payload); err != nil {
+		l.err = fmt.Errorf("can't write WAL %w", err)
+		return 0, l.err
+	}
+	l.end += walHeaderSize + int64(len(payload))
+	l.written++
+	return l.written, nil
+}
+
+// sync returns once the record seq and all before it are on disk.
+func (l *wal) sync(seq uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for l.durable < seq {
+		if l.err != nil {
+			return l.err
+		}
+		if l.syncing {
+			l.cond.Wait()
+			continue
+		}
+
+		l.syncing = true
+		target := l.written
+		err := l.w.Flush()
+		l.mu.Unlock()
+		if err == nil {
+			err = l.file.Sync()
+		}
+		l.mu.Lock()
+		l.syncing = false
+		if err != nil {
+			l.err = fmt.Errorf("can't sync WAL %w", err)
+		} else {
+			l.durable = max(l.durable, target)
+		}
+		l.cond.Broadcast()
+	}
+	return nil
+}
+
+// reset empties the log once its records are in a snapshot.
+func (l *wal) reset() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for l.syncing {
+		l.cond.Wait()
+	}
+	if l.err != nil {
+		return l.err
+	}
+
+	l.w.Reset(l.file)
+	if err := l.file.Truncate(0); err != nil {
+		l.err = fmt.Errorf("can't truncate WAL %w", err)
+		return l.err
+	}
+	if err := l.file.Sync(); err != nil {
+		l.err = fmt.Errorf("can't sync WAL %w", err)
+		return l.err
+	}
+	l.end = 0
+	l.durable = l.written
+	l.cond.Broadcast()
+	return nil
+}
+
+// size is the length of the log, buffered records included.
+func (l *wal) size() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.end
+}
+
+// failed returns the error that stopped the log, if any.
+func (l *wal) failed() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err
+}
+
+func (l *wal) close() error {
+	err := l.sync(l.lastSeq())
+	if closeErr := l.file.Close(); closeErr != nil && err == nil {
+		err = fmt.Errorf("can't close WAL %w", closeErr)
+	}
+	return err
+}
+
+// durableSeq is the last record known to be on disk.
+func (l *wal) durableSeq() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.durable
+}
+
+func (l *wal) lastSeq() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.written
+}
@@ -0,0 +1,435 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/ElizavetaFirst/go-metrics-alerts/internal/fsutil"
+)
+
+const (
+	walFile          = "wal.log"
+	walSnapshotFile  = "snapshot.json"
+	walCompactPeriod = time.Minute
+)
+
+type walRecordKind string
+
+const (
+	walPut            walRecordKind = "put"
+	walDelete         walRecordKind = "delete"
+	walDeleteMatching walRecordKind = "delete_matching"
+	walDeleteStale    walRecordKind = "delete_stale"
+)
+
+// walRecord is one change. Updates are logged as the values they produced,
+// so replaying a record that is already in the snapshot changes nothing.
+type walRecord struct {
+	Kind    walRecordKind `json:"kind"`
+	Metrics []NamedMetric `json:"metrics,omitempty"`
+	Name    string        `json:"name,omitempty"`
+	Type    MetricType    `json:"type,omitempty"`
+	Match   string        `json:"match,omitempty"`
+	Before  *time.Time    `json:"before,omitempty"`
+}
+
+// WALStorage keeps the metrics in memory and every change in a write-ahead
+// log, so that a crash loses no acknowledged update. Writes are applied and
+// logged one at a time and return once the log is synced; writers that
+// arrive during an fsync share the next one. A write the log fails to take
+// is rolled back in memory. Compact folds the log into a snapshot of the
+// state.
+type WALStorage struct {
+	log *zap.Logger
+	dir string
+	mem *MemStorage
+	// mu keeps the order of the records the same as of the changes.
+	mu  sync.Mutex
+	wal *wal
+	// undo holds what the changes not yet known to be durable replaced,
+	// oldest first, so that a failed log leaves none of them in memory.
+	undo []walUndo
+}
+
+// walUndo restores the metrics a change touched.
+type walUndo struct {
+	seq     uint64
+	prev    []NamedMetric
+	created []MetricKey
+}
+
+// NewWALStorage restores the state from the snapshot and the log in dir,
+// creating them on first start.
+func NewWALStorage(dir string, log *zap.Logger) (*WALStorage, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("can't create WAL dir %w", err)
+	}
+	ws := &WALStorage{
+		log: log,
+		dir: dir,
+		mem: NewMemStorage(log),
+	}
+
+	snapshot, err := readWALSnapshot(filepath.Join(dir, walSnapshotFile))
+	if err != nil {
+		return nil, err
+	}
+	for _, nm := range snapshot {
+		ws.mem.put(nm.Key(), nm.Metric)
+	}
+
+	var records int
+	l, dropped, err := openWAL(filepath.Join(dir, walFile), func(payload []byte) error {
+		records++
+		return ws.replay(payload)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if dropped > 0 {
+		log.Warn("dropped a torn WAL tail", zap.Int64("bytes", dropped))
+	}
+	log.Info("WAL storage restored",
+		zap.Int("snapshot", len(snapshot)), zap.Int("records", records))
+	ws.wal = l
+	return ws, nil
+}
+
+func (ws *WALStorage) replay(payload []byte) error {
+	var rec walRecord
+	if err := json.Unmarshal(payload, &rec); err != nil {
+		return fmt.Errorf("can't decode WAL record %w", err)
+	}
+	ctx := context.Background()
+	switch rec.Kind {
+	case walPut:
+		for _, nm := range rec.Metrics {
+			ws.mem.put(nm.Key(), nm.Metric)
+		}
+	case walDelete:
+		err := ws.mem.Delete(ctx, &DeleteOptions{MetricName: rec.Name, MetricType: string(rec.Type)})
+		if err != nil && !errors.Is(err, ErrMetricNotFound) {
+			return err
+		}
+	case walDeleteMatching:
+		_, err := ws.mem.DeleteMatching(ctx, &DeleteMatchingOptions{MetricType: string(rec.Type), Match: rec.Match})
+		return err
+	case walDeleteStale:
+		if rec.Before == nil {
+			return errors.New("stale WAL record without a time")
+		}
+		_, err := ws.mem.DeleteStale(ctx, &DeleteStaleOptions{Before: *rec.Before})
+		return err
+	default:
+		return fmt.Errorf("unknown WAL record %q", rec.Kind)
+	}
+	return nil
+}
+
+// write applies a change to the metrics that touched lists and logs the
+// record the change returns, a nil record means nothing changed. A change
+// that fails, or that the log doesn't take, is undone.
+func (ws *WALStorage) write(touched func() []MetricKey, change func() (*walRecord, error)) error {
+	ws.mu.Lock()
+	ws.dropDurableUndo()
+	undo := ws.undoFor(touched())
+	rec, err := change()
+	if err != nil || rec == nil {
+		ws.restore(undo)
+		ws.mu.Unlock()
+		return err
+	}
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		ws.restore(undo)
+		ws.mu.Unlock()
+		return fmt.Errorf("can't encode WAL record %w", err)
+	}
+	seq, err := ws.wal.append(payload)
+	if err != nil {
+		ws.restore(undo)
+		ws.rollBack()
+		ws.mu.Unlock()
+		ws.log.Error("can't write WAL", zap.Error(err))
+		return fmt.Errorf("can't log %s %w", rec.Kind, err)
+	}
+	undo.seq = seq
+	ws.undo = append(ws.undo, undo)
+	ws.mu.Unlock()
+
+	if err := ws.wal.sync(seq); err != nil {
+		ws.mu.Lock()
+		ws.rollBack()
+		ws.mu.Unlock()
+		ws.log.Error("can't write WAL", zap.Error(err))
+		return fmt.Errorf("can't log %s %w", rec.Kind, err)
+	}
+	return nil
+}
+
+// undoFor saves the metrics under keys before a change, ws.mu must be held.
+func (ws *WALStorage) undoFor(keys []MetricKey) walUndo {
+	var undo walUndo
+	for _, key := range keys {
+		if metric, ok := ws.mem.lookup(key); ok {
+			undo.prev = append(undo.prev, NamedMetric{Name: key.Name, Metric: metric})
+		} else {
+			undo.created = append(undo.created, key)
+		}
+	}
+	return undo
+}
+
+func (ws *WALStorage) restore(undo walUndo) {
+	for _, key := range undo.created {
+		ws.mem.remove(key)
+	}
+	for _, nm := range undo.prev {
+		ws.mem.put(nm.Key(), nm.Metric)
+	}
+}
+
+// rollBack undoes, newest first, the changes that didn't reach the disk.
+// The log takes no record after a failure, so none of them ever will.
+// ws.mu must be held.
+func (ws *WALStorage) rollBack() {
+	durable := ws.wal.durableSeq()
+	for i := len(ws.undo) - 1; i >= 0 && ws.undo[i].seq > durable; i-- {
+		ws.restore(ws.undo[i])
+	}
+	ws.undo = nil
+}
+
+// dropDurableUndo forgets the changes that are on disk, ws.mu must be held.
+func (ws *WALStorage) dropDurableUndo() {
+	durable := ws.wal.durableSeq()
+	i := 0
+	for i < len(ws.undo) && ws.undo[i].seq <= durable {
+		i++
+	}
+	ws.undo = ws.undo[i:]
+}
+
+// putRecord reads the values the change produced, ws.mu must be held.
+func (ws *WALStorage) putRecord(ctx context.Context, keys []MetricKey) (*walRecord, error) {
+	rec := &walRecord{Kind: walPut, Metrics: make([]NamedMetric, 0, len(keys))}
+	for _, key := range keys {
+		metric, err := ws.mem.Get(ctx, &GetOptions{MetricName: key.Name, MetricType: string(key.Type)})
+		if err != nil {
+			return nil, err
+		}
+		rec.Metrics = append(rec.Metrics, NamedMetric{Name: key.Name, Metric: metric})
+	}
+	return rec, nil
+}
+
+func (ws *WALStorage) Update(ctx context.Context, opts *UpdateOptions) error {
+	key := MetricKey{Name: opts.MetricName, Type: opts.Update.Type()}
+	return ws.write(func() []MetricKey { return []MetricKey{key} }, func() (*walRecord, error) {
+		if err := ws.mem.Update(ctx, opts); err != nil {
+			return nil, err
+		}
+		return ws.putRecord(ctx, []MetricKey{key})
+	})
+}
+
+func (ws *WALStorage) SetAll(ctx context.Context, opts *SetAllOptions) error {
+	keys := make([]MetricKey, 0, len(opts.Metrics))
+	for key := range opts.Metrics {
+		keys = append(keys, key)
+	}
+	return ws.write(func() []MetricKey { return keys }, func() (*walRecord, error) {
+		if len(opts.Metrics) == 0 {
+			return nil, nil
+		}
+		if err := ws.mem.SetAll(ctx, opts); err != nil {
+			return nil, err
+		}
+		return ws.putRecord(ctx, keys)
+	})
+}
+
+func (ws *WALStorage) Get(ctx context.Context, opts *GetOptions) (Metric, error) {
+	return ws.mem.Get(ctx, opts)
+}
+
+func (ws *WALStorage) GetAll(ctx context.Context) (map[MetricKey]Metric, error) {
+	return ws.mem.GetAll(ctx)
+}
+
+func (ws *WALStorage) List(ctx context.Context, opts *ListOptions) ([]NamedMetric, error) {
+	return ws.mem.List(ctx, opts)
+}
+
+func (ws *WALStorage) Delete(ctx context.Context, opts *DeleteOptions) error {
+	key := MetricKey{Name: opts.MetricName, Type: MetricType(opts.MetricType)}
+	return ws.write(func() []MetricKey { return []MetricKey{key} }, func() (*walRecord, error) {
+		if err := ws.mem.Delete(ctx, opts); err != nil {
+			return nil, err
+		}
+		return &walRecord{Kind: walDelete, Name: opts.MetricName, Type: MetricType(opts.MetricType)}, nil
+	})
+}
+
+func (ws *WALStorage) DeleteMatching(ctx context.Context, opts *DeleteMatchingOptions) (int64, error) {
+	var deleted int64
+	matching := func() []MetricKey {
+		return ws.mem.keys(func(key MetricKey, _ Metric) bool {
+			return (opts.MetricType == "" || string(key.Type) == opts.MetricType) && matchGlob(opts.Match, key.Name)
+		})
+	}
+	err := ws.write(matching, func() (*walRecord, error) {
+		var err error
+		if deleted, err = ws.mem.DeleteMatching(ctx, opts); err != nil || deleted == 0 {
+			return nil, err
+		}
+		return &walRecord{Kind: walDeleteMatching, Type: MetricType(opts.MetricType), Match: opts.Match}, nil
+	})
+	return deleted, err
+}
+
+func (ws *WALStorage) Reset(ctx context.Context, opts *ResetOptions) error {
+	key := MetricKey{Name: opts.MetricName, Type: MetricType(opts.MetricType)}
+	return ws.write(func() []MetricKey { return []MetricKey{key} }, func() (*walRecord, error) {
+		if err := ws.mem.Reset(ctx, opts); err != nil {
+			return nil, err
+		}
+		return ws.putRecord(ctx, []MetricKey{key})
+	})
+}
+
+func (ws *WALStorage) DeleteStale(ctx context.Context, opts *DeleteStaleOptions) (int64, error) {
+	if opts.DryRun {
+		return ws.mem.DeleteStale(ctx, opts)
+	}
+	var deleted int64
+	stale := func() []MetricKey {
+		return ws.mem.keys(func(_ MetricKey, metric Metric) bool {
+			return metric.UpdatedAt.Before(opts.Before)
+		})
+	}
+	err := ws.write(stale, func() (*walRecord, error) {
+		var err error
+		if deleted, err = ws.mem.DeleteStale(ctx, opts); err != nil || deleted == 0 {
+			return nil, err
+		}
+		return &walRecord{Kind: walDeleteStale, Before: &opts.Before}, nil
+	})
+	return deleted, err
+}
+
+// Ping fails once the log can't be written.
+func (ws *WALStorage) Ping(ctx context.Context) error {
+	if err := ws.wal.failed(); err != nil {
+		return fmt.Errorf("WAL is not writable %w", err)
+	}
+	return nil
+}
+
+// Run compacts the log periodically until ctx is cancelled.
+func (ws *WALStorage) Run(ctx context.Context) error {
+	ticker := time.NewTicker(walCompactPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := ws.Compact(ctx); err != nil {
+				ws.log.Warn("can't compact WAL", zap.Error(err))
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Compact writes the state to the snapshot and empties the log. Writes
+// wait for it, since the log may only lose what the snapshot holds.
+func (ws *WALStorage) Compact(ctx context.Context) error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if ws.wal.size() == 0 {
+		return nil
+	}
+
+	metrics, err := ws.mem.GetAll(ctx)
+	if err != nil {
+		return err
+	}
+	if err := writeWALSnapshot(ws.dir, metrics); err != nil {
+		return err
+	}
+	if err := ws.wal.reset(); err != nil {
+		return err
+	}
+	ws.log.Info("WAL compacted", zap.Int("metrics", len(metrics)))
+	return nil
+}
+
+func (ws *WALStorage) Close() error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return ws.wal.close()
+}
+
+func readWALSnapshot(path string) ([]NamedMetric, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("can't read WAL snapshot %w", err)
+	}
+	var snapshot []NamedMetric
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, fmt.Errorf("can't decode WAL snapshot %w", err)
+	}
+	return snapshot, nil
+}
+
+// writeWALSnapshot replaces the snapshot in one rename, so that a crash
+// leaves either the old or the new one.
+func writeWALSnapshot(dir string, metrics map[MetricKey]Metric) error {
+	snapshot := make([]NamedMetric, 0, len(metrics))
+	for key, metric := range metrics {
+		snapshot = append(snapshot, NamedMetric{Name: key.Name, Metric: metric})
+	}
+	sort.Slice(snapshot, func(i, j int) bool {
+		return snapshot[j].after(snapshot[i].Name, string(snapshot[i].Type()))
+	})
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return fmt.Errorf("can't encode WAL snapshot %w", err)
+	}
+
+	tmp, err := os.CreateTemp(dir, walSnapshotFile+".*")
+	if err != nil {
+		return fmt.Errorf("can't create WAL snapshot %w", err)
+	}
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("can't write WAL snapshot %w", err)
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, walSnapshotFile)); err != nil {
+		return fmt.Errorf("can't replace WAL snapshot %w", err)
+	}
+	return fsutil.SyncDir(dir)
+}
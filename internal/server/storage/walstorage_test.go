@@ -0,0 +1,238 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/ElizavetaFirst/go-metrics-alerts/internal/metrics"
+)
+
+func newTestWALStorage(t *testing.T, dir string) *WALStorage {
+	t.Helper()
+	ws, err := NewWALStorage(dir, zap.NewNop())
+	require.NoError(t, err)
+	return ws
+}
+
+// assertSameMetrics compares the update times as instants, they come back
+// from the files without the monotonic clock reading.
+func assertSameMetrics(t *testing.T, want, got map[MetricKey]Metric) {
+	t.Helper()
+	require.Len(t, got, len(want))
+	for key, w := range want {
+		g, ok := got[key]
+		require.True(t, ok, key)
+		assert.Equal(t, w.Value, g.Value, key)
+		assert.True(t, w.UpdatedAt.Equal(g.UpdatedAt), "%v updated at %v, want %v", key, g.UpdatedAt, w.UpdatedAt)
+	}
+}
+
+func TestWALStorage_Conformance(t *testing.T) {
+	testConformance(t, func(t *testing.T) Storage {
+		ws := newTestWALStorage(t, t.TempDir())
+		t.Cleanup(func() {
+			assert.NoError(t, ws.Close())
+		})
+		return ws
+	})
+}
+
+// writeHistory makes one change of every kind.
+func writeHistory(t *testing.T, s Storage) {
+	t.Helper()
+	ctx := context.Background()
+	histogram := metrics.NewHistogram([]float64{1, 10})
+	histogram.Observe(5)
+	stale := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, u := range []UpdateOptions{
+		{MetricName: "Hits", Update: Metric{Value: metrics.Counter(2)}},
+		{MetricName: "Hits", Update: Metric{Value: metrics.Counter(3)}},
+		{MetricName: "Depth", Update: Metric{Value: metrics.Gauge(1)}},
+		{MetricName: "Depth", Update: Metric{Value: metrics.Gauge(4)}, Op: GaugeAdd},
+		{MetricName: "Latency", Update: Metric{Value: histogram}},
+		{MetricName: "Latency", Update: Metric{Value: histogram}},
+		{MetricName: "Temp1", Update: Metric{Value: metrics.Gauge(1)}},
+		{MetricName: "Temp2", Update: Metric{Value: metrics.Gauge(1)}},
+		{MetricName: "Gone", Update: Metric{Value: metrics.Gauge(1)}},
+		{MetricName: "Resets", Update: Metric{Value: metrics.Counter(9)}},
+	} {
+		require.NoError(t, s.Update(ctx, &u))
+	}
+	require.NoError(t, s.SetAll(ctx, &SetAllOptions{Metrics: map[MetricKey]Metric{
+		{Name: "Hits", Type: Counter}:   {Value: metrics.Counter(10)},
+		{Name: "Old", Type: Gauge}:      {Value: metrics.Gauge(1), UpdatedAt: stale},
+		{Name: "Kept", Type: Gauge}:     {Value: metrics.Gauge(1), UpdatedAt: stale.Add(time.Hour)},
+		{Name: "Restored", Type: Gauge}: {Value: metrics.Gauge(7), UpdatedAt: stale.Add(time.Hour)},
+	}}))
+	require.NoError(t, s.Delete(ctx, &DeleteOptions{MetricName: "Gone", MetricType: string(Gauge)}))
+	deleted, err := s.DeleteMatching(ctx, &DeleteMatchingOptions{Match: "Temp*"})
+	require.NoError(t, err)
+	require.Equal(t, int64(2), deleted)
+	require.NoError(t, s.Reset(ctx, &ResetOptions{MetricName: "Resets", MetricType: string(Counter)}))
+	deleted, err = s.DeleteStale(ctx, &DeleteStaleOptions{Before: stale.Add(time.Minute)})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), deleted)
+}
+
+func TestWALStorage_RestoresAfterCrash(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	// The first storage is never closed, as if the process had died.
+	ws := newTestWALStorage(t, dir)
+	writeHistory(t, ws)
+	want, err := ws.GetAll(ctx)
+	require.NoError(t, err)
+	assert.Len(t, want, 6)
+
+	restored := newTestWALStorage(t, dir)
+	got, err := restored.GetAll(ctx)
+	require.NoError(t, err)
+	assertSameMetrics(t, want, got)
+	assert.NoError(t, restored.Close())
+}
+
+func TestWALStorage_CompactsIntoSnapshot(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	ws := newTestWALStorage(t, dir)
+	writeHistory(t, ws)
+	require.NoError(t, ws.Compact(ctx))
+	assert.Zero(t, ws.wal.size())
+	info, err := os.Stat(filepath.Join(dir, walFile))
+	require.NoError(t, err)
+	assert.Zero(t, info.Size())
+
+	require.NoError(t, ws.Update(ctx, &UpdateOptions{MetricName: "Hits", Update: Metric{Value: metrics.Counter(1)}}))
+	want, err := ws.GetAll(ctx)
+	require.NoError(t, err)
+	require.NoError(t, ws.Close())
+
+	restored := newTestWALStorage(t, dir)
+	got, err := restored.GetAll(ctx)
+	require.NoError(t, err)
+	assertSameMetrics(t, want, got)
+	assert.Equal(t, metrics.Counter(16), got[MetricKey{Name: "Hits", Type: Counter}].Value)
+	assert.NoError(t, restored.Close())
+}
+
+func TestWALStorage_DropsTornTail(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	path := filepath.Join(dir, walFile)
+
+	ws := newTestWALStorage(t, dir)
+	require.NoError(t, ws.Update(ctx, &UpdateOptions{MetricName: "Hits", Update: Metric{Value: metrics.Counter(1)}}))
+	intact := ws.wal.size()
+	require.NoError(t, ws.Update(ctx, &UpdateOptions{MetricName: "Hits", Update: Metric{Value: metrics.Counter(2)}}))
+	require.NoError(t, ws.Close())
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	for name, corrupt := range map[string][]byte{
+		"torn":      data[:len(data)-3],
+		"corrupted": append(append([]byte{}, data[:len(data)-2]...), data[len(data)-1]^0xff, data[len(data)-1]),
+	} {
+		t.Run(name, func(t *testing.T) {
+			require.NoError(t, os.WriteFile(path, corrupt, 0o644))
+
+			ws := newTestWALStorage(t, dir)
+			hits, err := ws.Get(ctx, &GetOptions{MetricName: "Hits", MetricType: string(Counter)})
+			require.NoError(t, err)
+			assert.Equal(t, metrics.Counter(1), hits.Value)
+			assert.Equal(t, intact, ws.wal.size())
+
+			// The records after the cut are read back.
+			require.NoError(t, ws.Update(ctx, &UpdateOptions{MetricName: "Hits", Update: Metric{Value: metrics.Counter(5)}}))
+			require.NoError(t, ws.Close())
+			ws = newTestWALStorage(t, dir)
+			hits, err = ws.Get(ctx, &GetOptions{MetricName: "Hits", MetricType: string(Counter)})
+			require.NoError(t, err)
+			assert.Equal(t, metrics.Counter(6), hits.Value)
+			require.NoError(t, ws.Close())
+		})
+	}
+}
+
+func TestWALStorage_FailedLogLeavesMemoryUnchanged(t *testing.T) {
+	ctx := context.Background()
+	ws := newTestWALStorage(t, t.TempDir())
+	require.NoError(t, ws.Update(ctx, &UpdateOptions{MetricName: "Hits", Update: Metric{Value: metrics.Counter(1)}}))
+	require.NoError(t, ws.Update(ctx, &UpdateOptions{MetricName: "Depth", Update: Metric{Value: metrics.Gauge(5)}}))
+	want, err := ws.GetAll(ctx)
+	require.NoError(t, err)
+
+	// The record reaches the buffer, the sync fails.
+	require.NoError(t, ws.wal.file.Close())
+	err = ws.Update(ctx, &UpdateOptions{MetricName: "Hits", Update: Metric{Value: metrics.Counter(2)}})
+	assert.Error(t, err)
+	assert.Error(t, ws.Ping(ctx))
+
+	// The failed log takes no more records.
+	err = ws.SetAll(ctx, &SetAllOptions{Metrics: map[MetricKey]Metric{
+		{Name: "Hits", Type: Counter}: {Value: metrics.Counter(3)},
+		{Name: "Fresh", Type: Gauge}:  {Value: metrics.Gauge(1)},
+		{Name: "Depth", Type: Gauge}:  {Value: metrics.Gauge(7)},
+	}})
+	assert.Error(t, err)
+	assert.Error(t, ws.Delete(ctx, &DeleteOptions{MetricName: "Depth", MetricType: string(Gauge)}))
+	_, err = ws.DeleteStale(ctx, &DeleteStaleOptions{Before: time.Now().Add(time.Hour)})
+	assert.Error(t, err)
+
+	got, err := ws.GetAll(ctx)
+	require.NoError(t, err)
+	assertSameMetrics(t, want, got)
+}
+
+func TestWALStorage_ConcurrentWritesAndCompactions(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	ws := newTestWALStorage(t, dir)
+
+	const workers, updates = 8, 100
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < updates; i++ {
+				assert.NoError(t, ws.Update(ctx, &UpdateOptions{MetricName: "Hits", Update: Metric{Value: metrics.Counter(1)}}))
+				if w == 0 && i%10 == 0 {
+					assert.NoError(t, ws.Compact(ctx))
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	require.NoError(t, ws.Close())
+
+	restored := newTestWALStorage(t, dir)
+	hits, err := restored.Get(ctx, &GetOptions{MetricName: "Hits", MetricType: string(Counter)})
+	require.NoError(t, err)
+	assert.Equal(t, metrics.Counter(workers*updates), hits.Value)
+	assert.NoError(t, restored.Close())
+}
+
+func BenchmarkWALStorage_Update(b *testing.B) {
+	ctx := context.Background()
+	ws, err := NewWALStorage(b.TempDir(), zap.NewNop())
+	require.NoError(b, err)
+	defer func() {
+		_ = ws.Close()
+	}()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			_ = ws.Update(ctx, &UpdateOptions{MetricName: "Hits", Update: Metric{Value: metrics.Counter(1)}})
+		}
+	})
+}
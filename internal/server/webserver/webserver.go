@@ -1,9 +1,10 @@
 package webserver
 
 import (
+	"context"
 	"fmt"
+	"net/http"
 	"strings"
-	"sync"
 	"time"
 
 	"go.uber.org/zap"
@@ -24,33 +25,49 @@ const (
 	multiplier      = 2
 	maxInterval     = 5 * time.Second
 	maxElapsedTime  = 9 * time.Second
+
+	readHeaderTimeout = 2 * time.Second
+	readTimeout       = 5 * time.Second
+	writeTimeout      = 10 * time.Second
+	idleTimeout       = 60 * time.Second
 )
 
 type Webserver struct {
 	Router *gin.Engine
+	server *http.Server
 }
 
 func NewWebserver(
+	addr string,
 	storage storage.Storage,
+	history storage.History,
+	diagnostics map[string]func() any,
 	log *zap.Logger,
 ) *Webserver {
-	router := setupRouter(storage, log)
+	router := setupRouter(storage, history, diagnostics, log)
 
 	return &Webserver{
 		Router: router,
+		server: &http.Server{
+			Addr:              addr,
+			Handler:           router,
+			ReadHeaderTimeout: readHeaderTimeout,
+			ReadTimeout:       readTimeout,
+			WriteTimeout:      writeTimeout,
+			IdleTimeout:       idleTimeout,
+		},
 	}
 }
 
-func (ws *Webserver) Run(addr string, wg *sync.WaitGroup) error {
-	wg.Add(1)
-	defer wg.Done()
-
-	var err error
-
+// Run serves HTTP until Shutdown is called. A graceful shutdown is not an error.
+func (ws *Webserver) Run() error {
 	operation := func() error {
-		err = ws.Router.Run(addr)
+		err := ws.server.ListenAndServe()
 
 		if err != nil {
+			if errors.Is(err, http.ErrServerClosed) {
+				return nil
+			}
 			if errors.Is(err, storage.ErrDBNotInited) ||
 				errors.Is(err, storage.ErrCantConnectDB) {
 				return fmt.Errorf("server Run return retriable error %w", err)
@@ -75,8 +92,24 @@ func (ws *Webserver) Run(addr string, wg *sync.WaitGroup) error {
 	return nil
 }
 
-func setupRouter(storage storage.Storage, log *zap.Logger) *gin.Engine {
+// Shutdown stops accepting new connections and waits for in-flight requests
+// to finish or for ctx to expire, whichever comes first.
+func (ws *Webserver) Shutdown(ctx context.Context) error {
+	if err := ws.server.Shutdown(ctx); err != nil {
+		return fmt.Errorf("server Shutdown return error %w", err)
+	}
+	return nil
+}
+
+func setupRouter(
+	storage storage.Storage,
+	history storage.History,
+	diagnostics map[string]func() any,
+	log *zap.Logger,
+) *gin.Engine {
 	handler := handler.NewHandler(storage, log)
+	handler.History = history
+	handler.Diagnostics = diagnostics
 
 	r := gin.Default()
 	r.Use(logger.InitLogger(log))